@@ -2,186 +2,231 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"time"
+	"fmt"
+	"sort"
 
-	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/segmentio/kafka-go"
 
 	"github.com/redstone/inventory-service/internal/redstone"
 )
 
-func (a *App) consumeOrdersLoop(ctx context.Context) {
-	for {
-		m, err := a.consumer.Fetch(ctx)
-		if err != nil {
-			a.log.Error("orders fetch failed", map[string]any{"err": err.Error()})
-			time.Sleep(500 * time.Millisecond)
-			continue
-		}
+// handleOrderEvent applies an order event and records it in
+// processed_events in one transaction, so a crash at any point either
+// leaves no trace or marks the event done together with its effects.
+func (a *App) handleOrderEvent(ctx context.Context, m kafka.Message) error {
+	md := redstone.MetadataOf(m)
+	et, eventID := md.EventType, md.EventID
+	if eventID == "" {
+		return errors.New("missing event_id")
+	}
 
-		var envelope map[string]any
-		if err := json.Unmarshal(m.Value, &envelope); err != nil {
-			_ = a.consumer.Commit(ctx, m)
-			continue
-		}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return redstone.Retryable(err)
+	}
+	defer tx.Rollback(ctx)
 
-		et, _ := envelope["event_type"].(string)
-		eventID, _ := envelope["event_id"].(string)
-		if eventID == "" {
-			_ = a.consumer.Commit(ctx, m)
-			continue
+	// event dedupe
+	tag, err := tx.Exec(ctx, `insert into processed_events(event_id,processed_at) values ($1,now()) on conflict (event_id) do nothing`, eventID)
+	if err != nil {
+		return redstone.Retryable(fmt.Errorf("mark processed: %w", err))
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	switch et {
+	case "OrderCreated":
+		var ev redstone.OrderCreated
+		if err := redstone.Decode(m, &ev); err != nil {
+			return err
 		}
 
-		// event dedupe
-		var exists string
-		err = a.db.QueryRow(ctx, `select event_id from processed_events where event_id=$1`, eventID).Scan(&exists)
-		if err == nil && exists != "" {
-			_ = a.consumer.Commit(ctx, m)
-			continue
+		reason, err := a.tryReserve(ctx, tx, ev.OrderID, ev.Items)
+		if errors.Is(err, errReservationSettled) {
+			return err
 		}
-		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
-			a.log.Error("event dedupe lookup failed", map[string]any{"err": err.Error(), "event_id": eventID})
-			time.Sleep(500 * time.Millisecond)
-			continue
+		if err != nil {
+			return redstone.Retryable(fmt.Errorf("reserve %s: %w", ev.OrderID, err))
 		}
-
-		switch et {
-		case "OrderCreated":
-			var ev redstone.OrderCreated
-			if json.Unmarshal(m.Value, &ev) != nil {
-				_ = a.consumer.Commit(ctx, m)
-				continue
+		var out any
+		if reason == "" {
+			out = redstone.InventoryReserved{
+				BaseEvent: redstone.CausedBy(ev.BaseEvent, "InventoryReserved"),
+				OrderID:   ev.OrderID,
+				Amount:    orderAmount(ev.Items),
 			}
-
-			ok, reason := a.tryReserve(ctx, ev.OrderID, ev.Items)
-			var out any
-			if ok {
-				out = redstone.InventoryReserved{
-					BaseEvent: redstone.BaseEvent{
-						EventID:       uuid.NewString(),
-						EventType:     "InventoryReserved",
-						OccurredAt:    time.Now().UTC(),
-						CorrelationID: ev.CorrelationID,
-					},
-					OrderID: ev.OrderID,
-				}
-			} else {
-				out = redstone.InventoryFailed{
-					BaseEvent: redstone.BaseEvent{
-						EventID:       uuid.NewString(),
-						EventType:     "InventoryFailed",
-						OccurredAt:    time.Now().UTC(),
-						CorrelationID: ev.CorrelationID,
-					},
-					OrderID: ev.OrderID,
-					Reason:  reason,
-				}
+		} else {
+			out = redstone.InventoryFailed{
+				BaseEvent: redstone.CausedBy(ev.BaseEvent, "InventoryFailed"),
+				OrderID:   ev.OrderID,
+				Reason:    reason,
 			}
-			_ = a.producer.Write(ctx, ev.OrderID, out)
-		case "OrderConfirmed":
-			var ev redstone.OrderConfirmed
-			if json.Unmarshal(m.Value, &ev) == nil {
-				if err := a.finalizeReservation(ctx, ev.OrderID); err != nil {
-					a.log.Error("finalize reservation failed", map[string]any{"err": err.Error(), "order_id": ev.OrderID})
-				}
+		}
+		// Publish before commit: if the commit then fails the event is
+		// redelivered and the result re-published, never lost.
+		if err := a.producer.Write(ctx, ev.OrderID, out); err != nil {
+			return redstone.Retryable(fmt.Errorf("publish inventory result: %w", err))
+		}
+	case "OrderConfirmed":
+		var ev redstone.OrderConfirmed
+		if redstone.Decode(m, &ev) == nil {
+			if err := finalizeReservation(ctx, tx, ev.OrderID); err != nil {
+				return redstone.Retryable(fmt.Errorf("finalize reservation %s: %w", ev.OrderID, err))
 			}
-		case "OrderCancelled":
-			var ev redstone.OrderCancelled
-			if json.Unmarshal(m.Value, &ev) == nil {
-				if err := a.releaseReservation(ctx, ev.OrderID); err != nil {
-					a.log.Error("release reservation failed", map[string]any{"err": err.Error(), "order_id": ev.OrderID})
-				}
+		}
+	case "OrderCancelled":
+		var ev redstone.OrderCancelled
+		if redstone.Decode(m, &ev) == nil {
+			if err := releaseReservation(ctx, tx, ev.OrderID); err != nil {
+				return redstone.Retryable(fmt.Errorf("release reservation %s: %w", ev.OrderID, err))
 			}
 		}
+	}
 
-		_, _ = a.db.Exec(ctx, `insert into processed_events(event_id,processed_at) values ($1,now()) on conflict (event_id) do nothing`, eventID)
-		_ = a.consumer.Commit(ctx, m)
+	if err := tx.Commit(ctx); err != nil {
+		return redstone.Retryable(fmt.Errorf("commit: %w", err))
 	}
+	return nil
 }
 
-func (a *App) tryReserve(ctx context.Context, orderID string, items []redstone.OrderItem) (bool, string) {
-	tx, err := a.db.Begin(ctx)
+// errReservationSettled rejects an OrderCreated whose order was already
+// confirmed or cancelled, e.g. one replayed after being forgotten.
+var errReservationSettled = errors.New("reservation already settled")
+
+// tryReserve reserves stock for every item of the order inside tx. A
+// non-empty reason is a business rejection and leaves stock untouched; a
+// non-nil error is transient and worth retrying, except
+// errReservationSettled.
+func (a *App) tryReserve(ctx context.Context, tx pgx.Tx, orderID string, items []redstone.OrderItem) (string, error) {
+	// An order holds at most one reservation set (unique on order_id, sku),
+	// and its rows change status together.
+	var status string
+	err := tx.QueryRow(ctx, `select status from reservations where order_id=$1 limit 1`, orderID).Scan(&status)
+	switch {
+	case err == nil && status == "RESERVED":
+		// Stock is still held for it: re-emit the original result.
+		a.log.InfoContext(ctx, "inventory already reserved", map[string]any{"order_id": orderID})
+		return "", nil
+	case err == nil:
+		// Reporting it reserved would take no stock.
+		return "", fmt.Errorf("order %s: %w (%s)", orderID, errReservationSettled, status)
+	case !errors.Is(err, pgx.ErrNoRows):
+		return "", err
+	}
+
+	// Savepoint, so a rejection undoes partial reservations but keeps the
+	// processed_events row of the outer transaction.
+	sp, err := tx.Begin(ctx)
 	if err != nil {
-		return false, "db error"
+		return "", err
 	}
-	defer tx.Rollback(ctx)
+	defer sp.Rollback(ctx)
 
-	for _, it := range items {
+	for _, it := range mergeItems(items) {
 		var onHand, reserved int64
-		if err := tx.QueryRow(ctx, `select on_hand,reserved from stock where sku=$1 for update`, it.SKU).Scan(&onHand, &reserved); err != nil {
-			return false, "sku not found: " + it.SKU
+		err := sp.QueryRow(ctx, `select on_hand,reserved from stock where sku=$1 for update`, it.SKU).Scan(&onHand, &reserved)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "sku not found: " + it.SKU, nil
+		}
+		if err != nil {
+			return "", err
 		}
 		available := onHand - reserved
 		if available < int64(it.Qty) {
-			return false, "insufficient stock for " + it.SKU
+			return "insufficient stock for " + it.SKU, nil
 		}
-		_, err := tx.Exec(ctx, `update stock set reserved = reserved + $2 where sku=$1`, it.SKU, int64(it.Qty))
-		if err != nil {
-			return false, "db error"
+		if _, err := sp.Exec(ctx, `update stock set reserved = reserved + $2 where sku=$1`, it.SKU, int64(it.Qty)); err != nil {
+			return "", err
+		}
+		if _, err := sp.Exec(ctx, `insert into reservations(order_id,sku,qty,status,created_at) values ($1,$2,$3,'RESERVED',now())`,
+			orderID, it.SKU, int64(it.Qty)); err != nil {
+			return "", err
 		}
-		_, _ = tx.Exec(ctx, `insert into reservations(order_id,sku,qty,status,created_at) values ($1,$2,$3,'RESERVED',now())`,
-			orderID, it.SKU, int64(it.Qty))
 	}
 
-	if err := tx.Commit(ctx); err != nil {
-		return false, "db error"
+	if err := sp.Commit(ctx); err != nil {
+		return "", err
 	}
-	a.log.Info("inventory reserved", map[string]any{"order_id": orderID})
-	return true, ""
+	a.log.InfoContext(ctx, "inventory reserved", map[string]any{"order_id": orderID})
+	return "", nil
 }
 
-func (a *App) finalizeReservation(ctx context.Context, orderID string) error {
-	return a.updateReservation(ctx, orderID, "COMPLETED", true)
+// mergeItems folds repeated SKUs into one line so each SKU is reserved once
+// per order, sorted by SKU.
+func mergeItems(items []redstone.OrderItem) []redstone.OrderItem {
+	out := make([]redstone.OrderItem, 0, len(items))
+	idx := make(map[string]int, len(items))
+	for _, it := range items {
+		if i, ok := idx[it.SKU]; ok {
+			out[i].Qty += it.Qty
+			continue
+		}
+		idx[it.SKU] = len(out)
+		out = append(out, it)
+	}
+	// Lock stock rows in a fixed order so concurrent reservations cannot
+	// deadlock.
+	sort.Slice(out, func(i, j int) bool { return out[i].SKU < out[j].SKU })
+	return out
 }
 
-func (a *App) releaseReservation(ctx context.Context, orderID string) error {
-	return a.updateReservation(ctx, orderID, "CANCELLED", false)
+func orderAmount(items []redstone.OrderItem) int64 {
+	var total int64
+	for _, it := range items {
+		total += int64(it.Qty) * it.UnitPrice
+	}
+	return total
 }
 
-func (a *App) updateReservation(ctx context.Context, orderID, status string, deductOnHand bool) error {
-	tx, err := a.db.Begin(ctx)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback(ctx)
+func finalizeReservation(ctx context.Context, tx pgx.Tx, orderID string) error {
+	return updateReservation(ctx, tx, orderID, "COMPLETED", true)
+}
+
+func releaseReservation(ctx context.Context, tx pgx.Tx, orderID string) error {
+	return updateReservation(ctx, tx, orderID, "CANCELLED", false)
+}
 
-	rows, err := tx.Query(ctx, `select sku, qty from reservations where order_id=$1 and status='RESERVED' for update`, orderID)
+func updateReservation(ctx context.Context, tx pgx.Tx, orderID, status string, deductOnHand bool) error {
+	rows, err := tx.Query(ctx, `select sku, qty from reservations where order_id=$1 and status='RESERVED' order by sku for update`, orderID)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-
-	var totalRows int
+	type line struct {
+		sku string
+		qty int64
+	}
+	var lines []line
 	for rows.Next() {
-		var sku string
-		var qty int64
-		if err := rows.Scan(&sku, &qty); err != nil {
+		var l line
+		if err := rows.Scan(&l.sku, &l.qty); err != nil {
+			rows.Close()
 			return err
 		}
-		totalRows++
+		lines = append(lines, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	for _, l := range lines {
 		if deductOnHand {
-			if _, err := tx.Exec(ctx, `update stock set on_hand = on_hand - $2, reserved = reserved - $2 where sku=$1`, sku, qty); err != nil {
+			if _, err := tx.Exec(ctx, `update stock set on_hand = on_hand - $2, reserved = reserved - $2 where sku=$1`, l.sku, l.qty); err != nil {
 				return err
 			}
 		} else {
-			if _, err := tx.Exec(ctx, `update stock set reserved = reserved - $2 where sku=$1`, sku, qty); err != nil {
+			if _, err := tx.Exec(ctx, `update stock set reserved = reserved - $2 where sku=$1`, l.sku, l.qty); err != nil {
 				return err
 			}
 		}
 	}
 
-	if totalRows == 0 {
-		if err := tx.Commit(ctx); err != nil {
-			return err
-		}
-		return nil
-	}
-
-	if _, err := tx.Exec(ctx, `update reservations set status=$2 where order_id=$1 and status='RESERVED'`, orderID, status); err != nil {
-		return err
-	}
-
-	return tx.Commit(ctx)
+	_, err = tx.Exec(ctx, `update reservations set status=$2 where order_id=$1 and status='RESERVED'`, orderID, status)
+	return err
 }
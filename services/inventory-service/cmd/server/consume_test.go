@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/segmentio/kafka-go"
+
+	"github.com/redstone/inventory-service/internal/redstone"
+)
+
+// failingPublisher fails every publish.
+type failingPublisher struct{ redstone.Publisher }
+
+func (failingPublisher) Write(context.Context, string, any) error {
+	return errors.New("broker down")
+}
+
+// newTestApp returns an App on a test database with stock A: 10 and B: 5
+// that publishes to a MemoryBroker.
+func newTestApp(t *testing.T) (*App, *redstone.MemoryBroker) {
+	t.Helper()
+	db := testDB(t)
+	exec(t, db, `insert into stock(sku,on_hand,reserved) values ('A',10,0),('B',5,0)`)
+	b := redstone.NewMemoryBroker(1)
+	return &App{
+		cfg:      Config{TopicOrders: "redstone.orders", TopicInventory: "redstone.inventory"},
+		log:      redstone.NewLogger("test"),
+		db:       db,
+		producer: b.Producer("redstone.inventory"),
+	}, b
+}
+
+func base(eventID string) redstone.BaseEvent {
+	return redstone.BaseEvent{EventID: eventID, OccurredAt: time.Now().UTC(), CorrelationID: "c-" + eventID}
+}
+
+// orderMessage returns ev as the inventory consumer receives it.
+func orderMessage(t *testing.T, b *redstone.MemoryBroker, key string, ev any) kafka.Message {
+	t.Helper()
+	if err := b.Producer("redstone.orders").Write(context.Background(), key, ev); err != nil {
+		t.Fatal(err)
+	}
+	msgs := b.Messages("redstone.orders")
+	return msgs[len(msgs)-1]
+}
+
+func processed(t *testing.T, db *pgxpool.Pool, eventID string) bool {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(context.Background(), `select count(*) from processed_events where event_id=$1`, eventID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n == 1
+}
+
+// published lists the inventory events published so far as type:order_id,
+// with the reason of failures.
+func published(b *redstone.MemoryBroker) []string {
+	out := []string{}
+	for _, m := range b.Messages("redstone.inventory") {
+		md := redstone.MetadataOf(m)
+		s := md.EventType + ":" + md.Key
+		if md.EventType == redstone.EventInventoryFailed {
+			var ev redstone.InventoryFailed
+			if redstone.Decode(m, &ev) == nil {
+				s += ":" + ev.Reason
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func orderCreated(eventID, orderID string, items ...redstone.OrderItem) redstone.OrderCreated {
+	return redstone.NewOrderCreated(base(eventID), orderID, "u1", items, "INR")
+}
+
+func item(sku string, qty int) redstone.OrderItem {
+	return redstone.OrderItem{SKU: sku, Qty: qty, UnitPrice: 100}
+}
+
+// An order's reservation and its processed_events row are committed
+// together; a redelivery changes nothing.
+func TestOrderCreatedReserves(t *testing.T) {
+	a, b := newTestApp(t)
+	ctx := context.Background()
+	m := orderMessage(t, b, "o1", orderCreated("e1", "o1", item("A", 3), item("B", 2), item("A", 1)))
+	for i := 0; i < 2; i++ {
+		if err := a.handleOrderEvent(ctx, m); err != nil {
+			t.Fatalf("delivery %d: %v", i+1, err)
+		}
+	}
+	if _, reserved := stockOf(t, a.db, "A"); reserved != 4 {
+		t.Errorf("A reserved %d, want 4", reserved)
+	}
+	if _, reserved := stockOf(t, a.db, "B"); reserved != 2 {
+		t.Errorf("B reserved %d, want 2", reserved)
+	}
+	if got := fmt.Sprint(reservationsOf(t, a.db, "o1")); got != "[A:4:RESERVED B:2:RESERVED]" {
+		t.Errorf("reservations %s", got)
+	}
+	if !processed(t, a.db, "e1") {
+		t.Error("e1 not marked processed")
+	}
+	if got := fmt.Sprint(published(b)); got != "[InventoryReserved:o1]" {
+		t.Errorf("published %s, want one result", got)
+	}
+}
+
+// If the result cannot be published, neither the reservation nor the
+// processed_events row is kept, so the redelivery reserves once.
+func TestOrderCreatedPublishFailureRollsBack(t *testing.T) {
+	a, b := newTestApp(t)
+	ctx := context.Background()
+	m := orderMessage(t, b, "o1", orderCreated("e1", "o1", item("A", 3)))
+	producer := a.producer
+	a.producer = failingPublisher{}
+	err := a.handleOrderEvent(ctx, m)
+	if err == nil || !redstone.IsRetryable(err) {
+		t.Fatalf("got %v, want a retryable error", err)
+	}
+	if _, reserved := stockOf(t, a.db, "A"); reserved != 0 {
+		t.Errorf("A reserved %d after rollback", reserved)
+	}
+	if got := reservationsOf(t, a.db, "o1"); len(got) != 0 {
+		t.Errorf("reservations %v after rollback", got)
+	}
+	if processed(t, a.db, "e1") {
+		t.Error("e1 marked processed after rollback")
+	}
+
+	a.producer = producer
+	if err := a.handleOrderEvent(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, reserved := stockOf(t, a.db, "A"); reserved != 3 || !processed(t, a.db, "e1") {
+		t.Errorf("A reserved %d after redelivery, processed %v", reserved, processed(t, a.db, "e1"))
+	}
+}
+
+// A rejection rolls back the savepoint, undoing the lines reserved before
+// the failing one, but keeps the processed_events row.
+func TestOrderCreatedRejected(t *testing.T) {
+	a, b := newTestApp(t)
+	ctx := context.Background()
+	for _, m := range []kafka.Message{
+		orderMessage(t, b, "o1", orderCreated("e1", "o1", item("A", 3), item("B", 6))),
+		orderMessage(t, b, "o2", orderCreated("e2", "o2", item("A", 1), item("Z", 1))),
+	} {
+		if err := a.handleOrderEvent(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, reserved := stockOf(t, a.db, "A"); reserved != 0 {
+		t.Errorf("A reserved %d after rejections", reserved)
+	}
+	for _, order := range []string{"o1", "o2"} {
+		if got := reservationsOf(t, a.db, order); len(got) != 0 {
+			t.Errorf("%s reservations %v", order, got)
+		}
+	}
+	if !processed(t, a.db, "e1") || !processed(t, a.db, "e2") {
+		t.Error("rejected events not marked processed")
+	}
+	if got := fmt.Sprint(published(b)); got != "[InventoryFailed:o1:insufficient stock for B InventoryFailed:o2:sku not found: Z]" {
+		t.Errorf("published %s", got)
+	}
+}
+
+// An OrderCreated replayed after its dedupe row was forgotten re-emits the
+// result while the stock is held, and is rejected, without a trace, once
+// the order is settled.
+func TestOrderCreatedReplayed(t *testing.T) {
+	a, b := newTestApp(t)
+	ctx := context.Background()
+	created := orderMessage(t, b, "o1", orderCreated("e1", "o1", item("A", 3)))
+	forget := func() { exec(t, a.db, `delete from processed_events where event_id='e1'`) }
+	if err := a.handleOrderEvent(ctx, created); err != nil {
+		t.Fatal(err)
+	}
+
+	forget()
+	if err := a.handleOrderEvent(ctx, created); err != nil {
+		t.Fatal(err)
+	}
+	if _, reserved := stockOf(t, a.db, "A"); reserved != 3 {
+		t.Errorf("A reserved %d after replay, want 3", reserved)
+	}
+	msgs := b.Messages("redstone.inventory")
+	if len(msgs) != 2 || redstone.MetadataOf(msgs[0]).EventID != redstone.MetadataOf(msgs[1]).EventID {
+		t.Fatalf("published %v, want the original result twice", published(b))
+	}
+
+	if err := a.handleOrderEvent(ctx, orderMessage(t, b, "o1", redstone.NewOrderConfirmed(base("e2"), "o1"))); err != nil {
+		t.Fatal(err)
+	}
+	if onHand, reserved := stockOf(t, a.db, "A"); onHand != 7 || reserved != 0 {
+		t.Fatalf("A %d/%d after confirmation, want 7/0", onHand, reserved)
+	}
+	forget()
+	err := a.handleOrderEvent(ctx, created)
+	if !errors.Is(err, errReservationSettled) || redstone.IsRetryable(err) {
+		t.Fatalf("got %v, want a permanent errReservationSettled", err)
+	}
+	if processed(t, a.db, "e1") {
+		t.Error("settled replay marked processed")
+	}
+	if onHand, reserved := stockOf(t, a.db, "A"); onHand != 7 || reserved != 0 {
+		t.Errorf("A %d/%d after settled replay", onHand, reserved)
+	}
+	if got := fmt.Sprint(reservationsOf(t, a.db, "o1")); got != "[A:3:COMPLETED]" {
+		t.Errorf("reservations %s", got)
+	}
+	if n := len(b.Messages("redstone.inventory")); n != 2 {
+		t.Errorf("%d results published, want no more", n)
+	}
+}
+
+func TestOrderCancelledReleases(t *testing.T) {
+	a, b := newTestApp(t)
+	ctx := context.Background()
+	cancelled := orderMessage(t, b, "o1", redstone.NewOrderCancelled(base("e2"), "o1", "payment failed"))
+	for _, m := range []kafka.Message{
+		orderMessage(t, b, "o1", orderCreated("e1", "o1", item("A", 3), item("B", 1))),
+		cancelled,
+		cancelled,
+	} {
+		if err := a.handleOrderEvent(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for sku, want := range map[string]int64{"A": 10, "B": 5} {
+		if onHand, reserved := stockOf(t, a.db, sku); onHand != want || reserved != 0 {
+			t.Errorf("%s %d/%d, want %d/0", sku, onHand, reserved, want)
+		}
+	}
+	if got := fmt.Sprint(reservationsOf(t, a.db, "o1")); got != "[A:3:CANCELLED B:1:CANCELLED]" {
+		t.Errorf("reservations %s", got)
+	}
+	if !processed(t, a.db, "e2") {
+		t.Error("e2 not marked processed")
+	}
+}
+
+func TestOrderEventWithoutID(t *testing.T) {
+	a, _ := newTestApp(t)
+	err := a.handleOrderEvent(context.Background(), kafka.Message{Key: []byte("o1"), Value: []byte(`{"event_type":"OrderCreated"}`)})
+	if err == nil || redstone.IsRetryable(err) {
+		t.Fatalf("got %v, want a permanent error", err)
+	}
+}
@@ -4,11 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/exaring/otelpgx"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -20,10 +26,20 @@ type Config struct {
 	ServiceName   string
 	HTTPPort      string
 	DatabaseURL   string
-	KafkaBrokers  []string
+	Kafka         redstone.KafkaConfig
 	TopicOrders   string
 	TopicInventory string
 	GroupID       string
+	RetryDelays   []time.Duration
+	Workers       int
+	TracesExporter string
+	Validation    redstone.ValidationMode
+	EventFormat   redstone.EventFormat
+	Codec         redstone.Codec
+	OTLPEndpoint  string
+	ProcessedRetention time.Duration
+	ProcessedPurgeInterval time.Duration
+	AdminToken    string
 }
 
 func env(key, def string) string {
@@ -41,30 +57,109 @@ func parseCSV(s string) []string {
 	return out
 }
 
+func parseDurations(s string) ([]time.Duration, error) {
+	var out []time.Duration
+	for _, p := range parseCSV(s) {
+		d, err := time.ParseDuration(p)
+		if err != nil { return nil, err }
+		out = append(out, d)
+	}
+	return out, nil
+}
+
 func main() {
 	cfg := Config{
 		ServiceName: env("SERVICE_NAME","inventory-service"),
 		HTTPPort: env("HTTP_PORT","8082"),
 		DatabaseURL: env("DATABASE_URL",""),
-		KafkaBrokers: parseCSV(env("KAFKA_BROKERS","localhost:9092")),
 		TopicOrders: env("KAFKA_TOPIC_ORDERS","redstone.orders"),
 		TopicInventory: env("KAFKA_TOPIC_INVENTORY","redstone.inventory"),
 		GroupID: env("KAFKA_GROUP_ID","inventory-service"),
+		TracesExporter: env("OTEL_TRACES_EXPORTER","otlp"),
+		OTLPEndpoint: env("OTEL_EXPORTER_OTLP_ENDPOINT",""),
+		AdminToken: env("ADMIN_TOKEN",""),
 	}
 
 	log := redstone.NewLogger(cfg.ServiceName)
+	level, err := redstone.ParseLevel(env("LOG_LEVEL","info"))
+	if err != nil {
+		log.Error("invalid LOG_LEVEL", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	log.SetLevel(level)
+	// Libraries logging through log/slog end up in the service log.
+	slog.SetDefault(slog.New(log.Handler()))
+	delays, err := parseDurations(env("KAFKA_RETRY_DELAYS","5s,1m,10m"))
+	if err != nil {
+		log.Error("invalid KAFKA_RETRY_DELAYS", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	cfg.RetryDelays = delays
+	if cfg.Kafka, err = redstone.LoadKafkaConfig(env); err != nil {
+		log.Error("invalid kafka config", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.Validation, err = redstone.ParseValidationMode(env("SCHEMA_VALIDATION","warn")); err != nil {
+		log.Error("invalid SCHEMA_VALIDATION", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.EventFormat, err = redstone.ParseEventFormat(env("EVENT_FORMAT","redstone")); err != nil {
+		log.Error("invalid EVENT_FORMAT", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.Codec, err = redstone.ParseCodec(env("EVENT_CODEC","json")); err != nil {
+		log.Error("invalid EVENT_CODEC", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if err := redstone.CheckCodec(cfg.EventFormat, cfg.Codec); err != nil {
+		log.Error("invalid EVENT_CODEC", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	// Must outlive the orders topic retention so every event Kafka can still
+	// re-deliver is remembered.
+	if cfg.ProcessedRetention, err = time.ParseDuration(env("PROCESSED_EVENTS_RETENTION","336h")); err != nil {
+		log.Error("invalid PROCESSED_EVENTS_RETENTION", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.ProcessedPurgeInterval, err = time.ParseDuration(env("PROCESSED_EVENTS_PURGE_INTERVAL","1h")); err != nil {
+		log.Error("invalid PROCESSED_EVENTS_PURGE_INTERVAL", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.Workers, err = strconv.Atoi(env("KAFKA_CONSUMER_WORKERS","8")); err != nil || cfg.Workers < 1 {
+		log.Error("invalid KAFKA_CONSUMER_WORKERS", map[string]any{"value": env("KAFKA_CONSUMER_WORKERS","8")})
+		os.Exit(1)
+	}
 	if cfg.DatabaseURL == "" {
 		log.Error("DATABASE_URL is required", nil)
 		os.Exit(1)
 	}
 
-	ctx := context.Background()
-	db, err := pgxpool.New(ctx, cfg.DatabaseURL)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownTracing, err := redstone.InitTracing(ctx, redstone.TracingConfig{
+		ServiceName: cfg.ServiceName,
+		Exporter:    cfg.TracesExporter,
+		Endpoint:    cfg.OTLPEndpoint,
+	})
+	if err != nil {
+		log.Error("tracing init failed", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	poolCfg, err := pgxpool.ParseConfig(cfg.DatabaseURL)
+	if err != nil {
+		log.Error("invalid DATABASE_URL", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	poolCfg.ConnConfig.Tracer = otelpgx.NewTracer()
+	db, err := pgxpool.NewWithConfig(ctx, poolCfg)
 	if err != nil {
 		log.Error("db connect failed", map[string]any{"err": err.Error()})
 		os.Exit(1)
 	}
 	defer db.Close()
+	redstone.RegisterDBPool(func() redstone.PoolStats { return db.Stat() })
 
 	if err := migrate(ctx, db); err != nil {
 		log.Error("migration failed", map[string]any{"err": err.Error()})
@@ -75,37 +170,79 @@ func main() {
 		os.Exit(1)
 	}
 
-	producer := redstone.NewProducer(cfg.KafkaBrokers, cfg.TopicInventory)
+	validator := redstone.NewValidator(cfg.Validation, log)
+	producer := redstone.NewProducer(cfg.Kafka, cfg.TopicInventory)
+	producer.SetValidator(validator)
+	producer.SetFormat(cfg.EventFormat, "/redstone/"+cfg.ServiceName)
+	producer.SetCodec(cfg.Codec)
 	defer producer.Close()
 
-	consumer := redstone.NewConsumer(cfg.KafkaBrokers, cfg.TopicOrders, cfg.GroupID)
+	consumer := redstone.NewRetryingConsumer(cfg.Kafka, cfg.TopicOrders, cfg.GroupID, cfg.RetryDelays)
+	consumer.SetWorkers(cfg.Workers)
+	consumer.SetValidator(validator)
 	defer consumer.Close()
+	if err := redstone.EnsureTopics(ctx, cfg.Kafka, append(consumer.Topics(), producer.Topic())...); err != nil {
+		log.Error("topic check failed", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
 
 	app := &App{cfg: cfg, log: log, db: db, producer: producer, consumer: consumer}
 
-	go app.consumeOrdersLoop(ctx)
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() { defer wg.Done(); f() }()
+	}
+	app.checkRetention(ctx)
+	run(func() { consumer.Run(ctx, log, app.handleOrderEvent) })
+	run(func() { app.purgeProcessedLoop(ctx) })
 
 	r := chi.NewRouter()
+	r.Use(redstone.TraceRoutes)
+	r.Use(redstone.MeasureHTTP)
 	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200); w.Write([]byte("ok")) })
+	r.Get("/readyz", redstone.ReadyHandler(map[string]redstone.Check{
+		"postgres": db.Ping,
+		"kafka_inventory": producer.Check,
+		"consumer_orders": consumer.Check,
+	}))
+	r.Handle("/metrics", redstone.MetricsHandler())
 	r.Get("/v1/stock/{sku}", app.getStockHandler)
+	if cfg.AdminToken != "" {
+		r.Route("/admin", app.adminRoutes)
+	}
 
 	srv := &http.Server{
 		Addr: ":" + cfg.HTTPPort,
-		Handler: r,
+		Handler: redstone.TraceHTTP(cfg.ServiceName, r),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
-	log.Info("http server starting", map[string]any{"port": cfg.HTTPPort})
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Error("http server error", map[string]any{"err": err.Error()})
+	go func() {
+		log.Info("http server starting", map[string]any{"port": cfg.HTTPPort})
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("http server error", map[string]any{"err": err.Error()})
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info("shutting down", nil)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Error("http shutdown failed", map[string]any{"err": err.Error()})
 	}
+	// Loops return once their in-flight message is handled and committed;
+	// deferred closes then release Kafka, the DB pool and the exporter.
+	wg.Wait()
 }
 
 type App struct {
 	cfg Config
 	log *redstone.Logger
 	db *pgxpool.Pool
-	producer *redstone.Producer
-	consumer *redstone.Consumer
+	producer redstone.Publisher
+	consumer redstone.Subscriber
 }
 
 func (a *App) getStockHandler(w http.ResponseWriter, r *http.Request) {
@@ -21,10 +21,23 @@ func migrate(ctx context.Context, db *pgxpool.Pool) error {
 			status text not null,
 			created_at timestamptz not null
 		)`,
+		// Redelivered OrderCreated events used to reserve an order twice. Drop
+		// the duplicate rows, and the stock they still hold, so the unique
+		// index can be built.
+		`with dup as (
+			delete from reservations r using reservations keep
+			where r.order_id = keep.order_id and r.sku = keep.sku and r.id > keep.id
+			returning r.sku, r.qty, r.status
+		)
+		update stock s set reserved = s.reserved - d.qty
+		from (select sku, sum(qty) as qty from dup where status = 'RESERVED' group by sku) d
+		where s.sku = d.sku`,
+		`create unique index if not exists reservations_order_sku_key on reservations(order_id, sku)`,
 		`create table if not exists processed_events(
 			event_id text primary key,
 			processed_at timestamptz not null
 		)`,
+		`create index if not exists processed_events_processed_at_idx on processed_events(processed_at)`,
 	}
 	for _, s := range stmts {
 		if _, err := db.Exec(ctx, s); err != nil {
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testDB returns a pool on a fresh, migrated schema of the Postgres
+// database at TEST_DATABASE_URL. The test is skipped when it is unset.
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	admin, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("inventory_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(ctx, "create schema "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = admin.Exec(ctx, "drop schema "+schema+" cascade")
+		admin.Close(ctx)
+	})
+
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema
+	db, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	if err := migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func exec(t *testing.T, db *pgxpool.Pool, sql string, args ...any) {
+	t.Helper()
+	if _, err := db.Exec(context.Background(), sql, args...); err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+}
+
+// stockOf returns the on-hand and reserved quantities of sku.
+func stockOf(t *testing.T, db *pgxpool.Pool, sku string) (onHand, reserved int64) {
+	t.Helper()
+	if err := db.QueryRow(context.Background(), `select on_hand,reserved from stock where sku=$1`, sku).Scan(&onHand, &reserved); err != nil {
+		t.Fatalf("stock %s: %v", sku, err)
+	}
+	return onHand, reserved
+}
+
+// reservationsOf lists the reservations of an order as sku:qty:status.
+func reservationsOf(t *testing.T, db *pgxpool.Pool, orderID string) []string {
+	t.Helper()
+	rows, err := db.Query(context.Background(), `select sku, qty, status from reservations where order_id=$1 order by sku, id`, orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var sku, status string
+		var qty int64
+		if err := rows.Scan(&sku, &qty, &status); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, fmt.Sprintf("%s:%d:%s", sku, qty, status))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMigrateIdempotent(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := migrate(ctx, db); err != nil {
+			t.Fatalf("migration %d: %v", i+2, err)
+		}
+		if err := seed(ctx, db); err != nil {
+			t.Fatalf("seed %d: %v", i+1, err)
+		}
+	}
+	if onHand, reserved := stockOf(t, db, "SKU-RED-1"); onHand != 100 || reserved != 0 {
+		t.Fatalf("SKU-RED-1 %d/%d after seeding twice", onHand, reserved)
+	}
+}
+
+// Databases from before the unique index may hold an order's reservation
+// twice. Migrating keeps the first row, gives back the stock the others
+// held, and builds the index; migrating again changes nothing.
+func TestMigrateDedupesReservations(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	exec(t, db, `drop index reservations_order_sku_key`)
+	exec(t, db, `insert into stock(sku,on_hand,reserved) values ('A',10,6),('B',8,0)`)
+	exec(t, db, `insert into reservations(order_id,sku,qty,status,created_at) values
+		('o1','A',2,'RESERVED',now()),
+		('o1','A',2,'RESERVED',now()),
+		('o2','B',1,'COMPLETED',now()),
+		('o2','B',1,'COMPLETED',now()),
+		('o3','A',2,'RESERVED',now())`)
+	var firstID int64
+	if err := db.QueryRow(ctx, `select min(id) from reservations where order_id='o1'`).Scan(&firstID); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := migrate(ctx, db); err != nil {
+			t.Fatalf("migration %d: %v", i+1, err)
+		}
+		// Only the duplicate RESERVED row held stock.
+		if _, reserved := stockOf(t, db, "A"); reserved != 4 {
+			t.Fatalf("migration %d: A reserved %d, want 4", i+1, reserved)
+		}
+		if onHand, reserved := stockOf(t, db, "B"); onHand != 8 || reserved != 0 {
+			t.Fatalf("migration %d: B %d/%d, want 8/0", i+1, onHand, reserved)
+		}
+		for order, want := range map[string]string{"o1": "[A:2:RESERVED]", "o2": "[B:1:COMPLETED]", "o3": "[A:2:RESERVED]"} {
+			if got := fmt.Sprint(reservationsOf(t, db, order)); got != want {
+				t.Fatalf("migration %d: %s reservations %s, want %s", i+1, order, got, want)
+			}
+		}
+	}
+	var kept int64
+	if err := db.QueryRow(ctx, `select id from reservations where order_id='o1'`).Scan(&kept); err != nil || kept != firstID {
+		t.Fatalf("kept reservation %d (%v), want the first, %d", kept, err, firstID)
+	}
+
+	_, err := db.Exec(ctx, `insert into reservations(order_id,sku,qty,status,created_at) values ('o1','A',2,'RESERVED',now())`)
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+		t.Fatalf("duplicate reservation: got %v, want a unique violation", err)
+	}
+}
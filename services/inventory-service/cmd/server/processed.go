@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// checkRetention warns when processed events would be purged while Kafka
+// can still re-deliver the events they guard against.
+func (a *App) checkRetention(ctx context.Context) {
+	rc, ok := a.consumer.(interface {
+		TopicRetention(context.Context) (time.Duration, error)
+	})
+	if !ok {
+		return
+	}
+	topicRetention, err := rc.TopicRetention(ctx)
+	if err != nil {
+		a.log.Error("topic retention lookup failed", map[string]any{"err": err.Error(), "topic": a.cfg.TopicOrders})
+		return
+	}
+	if topicRetention < 0 || topicRetention >= a.cfg.ProcessedRetention {
+		a.log.Error("processed_events retention does not exceed topic retention; redelivered events may be reprocessed", map[string]any{
+			"topic":               a.cfg.TopicOrders,
+			"topic_retention":     topicRetention.String(),
+			"processed_retention": a.cfg.ProcessedRetention.String(),
+		})
+	}
+}
+
+func (a *App) purgeProcessedLoop(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.ProcessedPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.purgeProcessed(ctx)
+		}
+	}
+}
+
+// purgeProcessed deletes processed events older than the retention window in
+// small batches so it never holds long locks.
+func (a *App) purgeProcessed(ctx context.Context) {
+	cutoff := time.Now().Add(-a.cfg.ProcessedRetention)
+	var total int64
+	for {
+		tag, err := a.db.Exec(ctx, `delete from processed_events where event_id in (
+			select event_id from processed_events where processed_at < $1 limit 5000)`, cutoff)
+		if err != nil {
+			a.log.Error("processed_events purge failed", map[string]any{"err": err.Error()})
+			return
+		}
+		total += tag.RowsAffected()
+		if tag.RowsAffected() == 0 {
+			break
+		}
+	}
+	if total > 0 {
+		a.log.Info("processed_events purged", map[string]any{"rows": total, "cutoff": cutoff.UTC().Format(time.RFC3339)})
+	}
+}
+
+// adminRoutes mounts the processed_events admin endpoints behind
+// requireAdmin.
+func (a *App) adminRoutes(r chi.Router) {
+	r.Use(a.requireAdmin)
+	r.Get("/processed-events/{eventID}", a.getProcessedEventHandler)
+	r.Delete("/processed-events/{eventID}", a.forgetProcessedEventHandler)
+}
+
+// requireAdmin only admits requests carrying the configured admin token,
+// compared in constant time.
+func (a *App) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.AdminToken)) != 1 {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *App) getProcessedEventHandler(w http.ResponseWriter, r *http.Request) {
+	eventID := chi.URLParam(r, "eventID")
+	var processedAt time.Time
+	err := a.db.QueryRow(r.Context(), `select processed_at from processed_events where event_id=$1`, eventID).Scan(&processedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "not found", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"event_id": eventID, "processed_at": processedAt})
+}
+
+// forgetProcessedEventHandler removes the dedupe record of one event so the
+// next delivery of it (e.g. via replay) is processed again.
+func (a *App) forgetProcessedEventHandler(w http.ResponseWriter, r *http.Request) {
+	eventID := chi.URLParam(r, "eventID")
+	tag, err := a.db.Exec(r.Context(), `delete from processed_events where event_id=$1`, eventID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "not found", 404)
+		return
+	}
+	a.log.Info("processed event forgotten", map[string]any{"event_id": eventID, "remote_addr": r.RemoteAddr})
+	w.WriteHeader(204)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/redstone/inventory-service/internal/redstone"
+)
+
+// adminServer serves the admin routes of a as main mounts them.
+func adminServer(t *testing.T, a *App) *httptest.Server {
+	t.Helper()
+	r := chi.NewRouter()
+	r.Route("/admin", a.adminRoutes)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func adminRequest(t *testing.T, srv *httptest.Server, method, path, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestRequireAdmin(t *testing.T) {
+	a := &App{cfg: Config{AdminToken: "s3cret"}, log: redstone.NewLogger("test")}
+	srv := httptest.NewServer(a.requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})))
+	defer srv.Close()
+	for token, want := range map[string]int{"": 401, "wrong": 401, "s3cre": 401, "s3cret2": 401, "s3cret": 204} {
+		if got := adminRequest(t, srv, "GET", "/", token).StatusCode; got != want {
+			t.Errorf("token %q: status %d, want %d", token, got, want)
+		}
+	}
+	// The token must be sent as a bearer token.
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Authorization", "Basic s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("basic auth: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestProcessedEventAdmin(t *testing.T) {
+	db := testDB(t)
+	a := &App{cfg: Config{AdminToken: "s3cret"}, log: redstone.NewLogger("test"), db: db}
+	at := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	exec(t, db, `insert into processed_events(event_id,processed_at) values ('e1',$1)`, at)
+	srv := adminServer(t, a)
+
+	if got := adminRequest(t, srv, "GET", "/admin/processed-events/e1", "").StatusCode; got != 401 {
+		t.Fatalf("without a token: status %d, want 401", got)
+	}
+	resp := adminRequest(t, srv, "GET", "/admin/processed-events/e1", "s3cret")
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var body struct {
+		EventID     string    `json:"event_id"`
+		ProcessedAt time.Time `json:"processed_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.EventID != "e1" || !body.ProcessedAt.Equal(at) {
+		t.Errorf("got %+v", body)
+	}
+	if got := adminRequest(t, srv, "GET", "/admin/processed-events/e2", "s3cret").StatusCode; got != 404 {
+		t.Errorf("unknown event: status %d, want 404", got)
+	}
+
+	if got := adminRequest(t, srv, "DELETE", "/admin/processed-events/e1", "wrong").StatusCode; got != 401 {
+		t.Fatalf("delete with a wrong token: status %d, want 401", got)
+	}
+	if !processed(t, db, "e1") {
+		t.Fatal("unauthorized delete forgot e1")
+	}
+	if got := adminRequest(t, srv, "DELETE", "/admin/processed-events/e1", "s3cret").StatusCode; got != 204 {
+		t.Fatalf("delete: status %d, want 204", got)
+	}
+	if processed(t, db, "e1") {
+		t.Error("e1 still processed after delete")
+	}
+	for _, method := range []string{"DELETE", "GET"} {
+		if got := adminRequest(t, srv, method, "/admin/processed-events/e1", "s3cret").StatusCode; got != 404 {
+			t.Errorf("%s after delete: status %d, want 404", method, got)
+		}
+	}
+}
+
+// insertProcessed records n events processed at the given age.
+func insertProcessed(t *testing.T, a *App, prefix string, n int, age time.Duration) {
+	t.Helper()
+	exec(t, a.db, `insert into processed_events(event_id,processed_at)
+		select $1::text || g, now() - make_interval(secs => $2) from generate_series(1, $3) g`,
+		prefix, age.Seconds(), n)
+}
+
+func countProcessed(t *testing.T, a *App) int {
+	t.Helper()
+	var n int
+	if err := a.db.QueryRow(context.Background(), `select count(*) from processed_events`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Purging removes every event past the retention, over several batches,
+// and keeps the recent ones.
+func TestPurgeProcessed(t *testing.T) {
+	a := &App{cfg: Config{ProcessedRetention: time.Hour}, log: redstone.NewLogger("test"), db: testDB(t)}
+	insertProcessed(t, a, "old-", 12000, 2*time.Hour)
+	insertProcessed(t, a, "new-", 10, time.Minute)
+	a.purgeProcessed(context.Background())
+	if n := countProcessed(t, a); n != 10 {
+		t.Fatalf("%d events left, want the 10 recent ones", n)
+	}
+	if !processed(t, a.db, "new-1") || processed(t, a.db, "old-1") {
+		t.Fatal("purged the wrong events")
+	}
+}
+
+func TestPurgeProcessedLoop(t *testing.T) {
+	a := &App{
+		cfg: Config{ProcessedRetention: time.Hour, ProcessedPurgeInterval: 20 * time.Millisecond},
+		log: redstone.NewLogger("test"),
+		db:  testDB(t),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.purgeProcessedLoop(ctx)
+	}()
+	defer func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("purge loop did not stop on cancel")
+		}
+	}()
+
+	insertProcessed(t, a, "new-", 3, time.Minute)
+	// Events that age out while the loop runs are purged on a later tick.
+	for round := 0; round < 2; round++ {
+		insertProcessed(t, a, fmt.Sprintf("old-%d-", round), 5, 2*time.Hour)
+		deadline := time.Now().Add(5 * time.Second)
+		for countProcessed(t, a) != 3 {
+			if time.Now().After(deadline) {
+				t.Fatalf("round %d: %d events left, want 3", round+1, countProcessed(t, a))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
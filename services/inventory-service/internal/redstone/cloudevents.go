@@ -0,0 +1,193 @@
+package redstone
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// EventFormat is how a Producer lays out events on the wire.
+type EventFormat string
+
+const (
+	// FormatRedstone is the Redstone JSON envelope: the event struct as is.
+	FormatRedstone EventFormat = "redstone"
+	// FormatCloudEventsStructured is a CloudEvents 1.0 JSON document with
+	// the event fields under data.
+	FormatCloudEventsStructured EventFormat = "cloudevents-structured"
+	// FormatCloudEventsBinary carries CloudEvents attributes in ce_ headers
+	// and the event fields as the message value.
+	FormatCloudEventsBinary EventFormat = "cloudevents-binary"
+)
+
+func ParseEventFormat(s string) (EventFormat, error) {
+	switch f := EventFormat(strings.ToLower(s)); f {
+	case FormatRedstone, FormatCloudEventsStructured, FormatCloudEventsBinary:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown event format %q", s)
+}
+
+// SetFormat makes p publish in format. source is the CloudEvents source
+// attribute, e.g. /redstone/order-service. Redstone headers are written in
+// every format, so header-based filtering keeps working.
+func (p *Producer) SetFormat(format EventFormat, source string) {
+	p.format, p.source = format, source
+}
+
+const (
+	cloudEventsSpec        = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+	headerContentType      = "content-type"
+	ceHeaderPrefix         = "ce_"
+)
+
+// envelopeAttrs maps Redstone envelope fields to CloudEvents attributes.
+// The last three are extensions.
+var envelopeAttrs = []struct{ field, attr string }{
+	{"event_id", "id"},
+	{"event_type", "type"},
+	{"occurred_at", "time"},
+	{"correlation_id", "correlationid"},
+	{"causation_id", "causationid"},
+	{"schema_version", "schemaversion"},
+}
+
+// toCloudEvent re-lays the Redstone JSON payload in format, moving the
+// envelope fields into attributes and the rest into data.
+func toCloudEvent(format EventFormat, source, key string, payload []byte, headers []kafka.Header) ([]byte, []kafka.Header, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, nil, err
+	}
+	attrs := map[string]json.RawMessage{
+		"specversion":     mustJSON(cloudEventsSpec),
+		"source":          mustJSON(source),
+		"datacontenttype": mustJSON("application/json"),
+	}
+	if key != "" {
+		attrs["subject"] = mustJSON(key)
+	}
+	for _, ea := range envelopeAttrs {
+		if v, ok := data[ea.field]; ok {
+			attrs[ea.attr] = v
+			delete(data, ea.field)
+		}
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if format == FormatCloudEventsStructured {
+		attrs["data"] = body
+		doc, err := json.Marshal(attrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		headers = append(headers, kafka.Header{Key: headerContentType, Value: []byte(cloudEventsContentType)})
+		return doc, headers, nil
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := attrs[name]
+		if name == "datacontenttype" {
+			name = headerContentType
+		} else {
+			name = ceHeaderPrefix + name
+		}
+		headers = append(headers, kafka.Header{Key: name, Value: []byte(attrString(v))})
+	}
+	return body, headers, nil
+}
+
+// fromCloudEvent returns m in the Redstone JSON envelope if it is a
+// CloudEvent in either mode, and m unchanged otherwise.
+func fromCloudEvent(m kafka.Message) (kafka.Message, error) {
+	var structured, binary bool
+	for _, h := range m.Headers {
+		switch {
+		case h.Key == headerContentType && strings.HasPrefix(string(h.Value), cloudEventsContentType):
+			structured = true
+		case h.Key == ceHeaderPrefix+"specversion":
+			binary = true
+		}
+	}
+	if !structured && !binary {
+		return m, nil
+	}
+
+	attrs := map[string]json.RawMessage{}
+	var body []byte
+	if structured {
+		if err := json.Unmarshal(m.Value, &attrs); err != nil {
+			return m, fmt.Errorf("cloudevent: %w", err)
+		}
+		body = attrs["data"]
+	} else {
+		for _, h := range m.Headers {
+			if name, ok := strings.CutPrefix(h.Key, ceHeaderPrefix); ok {
+				attrs[name] = mustJSON(string(h.Value))
+			}
+		}
+		body = m.Value
+	}
+
+	data := map[string]json.RawMessage{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &data); err != nil {
+			return m, fmt.Errorf("cloudevent data: %w", err)
+		}
+	}
+	for _, ea := range envelopeAttrs {
+		v, ok := attrs[ea.attr]
+		if !ok {
+			continue
+		}
+		if ea.field == "schema_version" {
+			// A string in binary mode.
+			n, err := strconv.Atoi(attrString(v))
+			if err != nil {
+				return m, fmt.Errorf("cloudevent schemaversion: %w", err)
+			}
+			v = mustJSON(n)
+		}
+		data[ea.field] = v
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return m, err
+	}
+
+	headers := make([]kafka.Header, 0, len(m.Headers))
+	for _, h := range m.Headers {
+		if h.Key != headerContentType && !strings.HasPrefix(h.Key, ceHeaderPrefix) {
+			headers = append(headers, h)
+		}
+	}
+	m.Value, m.Headers = value, headers
+	return m, nil
+}
+
+// attrString returns a JSON attribute value in its header form.
+func attrString(v json.RawMessage) string {
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		return s
+	}
+	return string(v)
+}
+
+func mustJSON(v any) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
@@ -0,0 +1,207 @@
+package redstone
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// Transports a Producer and Consumer can run on.
+const (
+	TransportKafka = "kafka"
+	TransportNATS  = "nats"
+	TransportRedis = "redis"
+)
+
+// KafkaConfig is the connection and producer tuning shared by every
+// Producer and Consumer of a service.
+type KafkaConfig struct {
+	// Transport selects the broker, TransportKafka unless set. The other
+	// transports take the topic, TLS and declared-topic settings below and
+	// ignore the Kafka-only ones.
+	Transport string
+	// NATSURL is the server list for TransportNATS.
+	NATSURL string
+	// RedisURL is the server for TransportRedis, and RedisMaxLen the
+	// approximate length streams are trimmed to, 0 for no limit.
+	RedisURL    string
+	RedisMaxLen int64
+
+	Brokers []string
+
+	Compression  kafka.Compression
+	BatchSize    int
+	BatchTimeout time.Duration
+	RequiredAcks kafka.RequiredAcks
+
+	// TLS, when non-nil, encrypts broker connections.
+	TLS *tls.Config
+	// SASL, when non-nil, authenticates broker connections.
+	SASL sasl.Mechanism
+
+	// Declared settings of the service's topics, checked by EnsureTopics.
+	// Zero partitions or retention skips that check; negative retention
+	// means forever.
+	TopicPartitions  int
+	TopicReplication int
+	TopicRetention   time.Duration
+	CreateTopics     bool
+}
+
+// LoadKafkaConfig reads KafkaConfig from the environment through env, the
+// service's own lookup with defaults:
+//
+//	REDSTONE_TRANSPORT     kafka, nats or redis (kafka)
+//	NATS_URL               NATS servers for the nats transport (nats://localhost:4222)
+//	REDIS_URL              Redis server for the redis transport (redis://localhost:6379/0)
+//	REDIS_STREAM_MAXLEN    entries kept per stream unless KAFKA_TOPIC_RETENTION is set (1000000)
+//	KAFKA_BROKERS          comma-separated host:port (localhost:9092)
+//	KAFKA_COMPRESSION      none, gzip, snappy, lz4 or zstd (none)
+//	KAFKA_BATCH_SIZE       messages per produce request (100)
+//	KAFKA_BATCH_TIMEOUT    max wait to fill a batch (50ms)
+//	KAFKA_REQUIRED_ACKS    none, one or all (all)
+//	KAFKA_TLS_ENABLED      true to use TLS; implied by any KAFKA_TLS_*_FILE
+//	KAFKA_TLS_CA_FILE      PEM CA bundle to verify brokers with
+//	KAFKA_TLS_CERT_FILE    PEM client certificate, with KAFKA_TLS_KEY_FILE
+//	KAFKA_SASL_MECHANISM   PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512
+//	KAFKA_SASL_USERNAME, KAFKA_SASL_PASSWORD
+//	KAFKA_TOPIC_PARTITIONS  partitions per topic, 0 to skip the check (0)
+//	KAFKA_TOPIC_RETENTION   minimum retention, -1 for forever (unchecked)
+//	KAFKA_TOPIC_REPLICATION replicas of created topics, -1 for the broker default (-1)
+//	KAFKA_CREATE_TOPICS     true to create missing topics at startup (false)
+func LoadKafkaConfig(env func(key, def string) string) (KafkaConfig, error) {
+	cfg := KafkaConfig{RequiredAcks: kafka.RequireAll}
+	switch cfg.Transport = strings.ToLower(env("REDSTONE_TRANSPORT", TransportKafka)); cfg.Transport {
+	case TransportKafka, TransportNATS, TransportRedis:
+	default:
+		return cfg, fmt.Errorf("REDSTONE_TRANSPORT: unknown transport %q", cfg.Transport)
+	}
+	cfg.NATSURL = env("NATS_URL", "nats://localhost:4222")
+	cfg.RedisURL = env("REDIS_URL", "redis://localhost:6379/0")
+	for _, b := range strings.Split(env("KAFKA_BROKERS", "localhost:9092"), ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			cfg.Brokers = append(cfg.Brokers, b)
+		}
+	}
+
+	if err := cfg.Compression.UnmarshalText([]byte(env("KAFKA_COMPRESSION", "none"))); err != nil {
+		return cfg, fmt.Errorf("KAFKA_COMPRESSION: %w", err)
+	}
+	if err := cfg.RequiredAcks.UnmarshalText([]byte(env("KAFKA_REQUIRED_ACKS", "all"))); err != nil {
+		return cfg, fmt.Errorf("KAFKA_REQUIRED_ACKS: %w", err)
+	}
+	var err error
+	if cfg.RedisMaxLen, err = strconv.ParseInt(env("REDIS_STREAM_MAXLEN", "1000000"), 10, 64); err != nil || cfg.RedisMaxLen < 0 {
+		return cfg, fmt.Errorf("REDIS_STREAM_MAXLEN: must be a non-negative integer")
+	}
+	if cfg.BatchSize, err = strconv.Atoi(env("KAFKA_BATCH_SIZE", "100")); err != nil || cfg.BatchSize < 1 {
+		return cfg, fmt.Errorf("KAFKA_BATCH_SIZE: must be a positive integer")
+	}
+	if cfg.BatchTimeout, err = time.ParseDuration(env("KAFKA_BATCH_TIMEOUT", "50ms")); err != nil {
+		return cfg, fmt.Errorf("KAFKA_BATCH_TIMEOUT: %w", err)
+	}
+
+	if cfg.TopicPartitions, err = strconv.Atoi(env("KAFKA_TOPIC_PARTITIONS", "0")); err != nil || cfg.TopicPartitions < 0 {
+		return cfg, fmt.Errorf("KAFKA_TOPIC_PARTITIONS: must be a non-negative integer")
+	}
+	if cfg.TopicReplication, err = strconv.Atoi(env("KAFKA_TOPIC_REPLICATION", "-1")); err != nil || cfg.TopicReplication == 0 || cfg.TopicReplication < -1 {
+		return cfg, fmt.Errorf("KAFKA_TOPIC_REPLICATION: must be -1 or a positive integer")
+	}
+	if r := env("KAFKA_TOPIC_RETENTION", ""); r == "-1" {
+		cfg.TopicRetention = -1
+	} else if r != "" {
+		if cfg.TopicRetention, err = time.ParseDuration(r); err != nil || cfg.TopicRetention <= 0 {
+			return cfg, fmt.Errorf("KAFKA_TOPIC_RETENTION: must be -1 or a positive duration")
+		}
+	}
+	if cfg.CreateTopics, err = strconv.ParseBool(env("KAFKA_CREATE_TOPICS", "false")); err != nil {
+		return cfg, fmt.Errorf("KAFKA_CREATE_TOPICS: %w", err)
+	}
+
+	caFile, certFile, keyFile := env("KAFKA_TLS_CA_FILE", ""), env("KAFKA_TLS_CERT_FILE", ""), env("KAFKA_TLS_KEY_FILE", "")
+	tlsEnabled, err := strconv.ParseBool(env("KAFKA_TLS_ENABLED", "false"))
+	if err != nil {
+		return cfg, fmt.Errorf("KAFKA_TLS_ENABLED: %w", err)
+	}
+	if tlsEnabled || caFile != "" || certFile != "" || keyFile != "" {
+		if cfg.TLS, err = loadTLS(caFile, certFile, keyFile); err != nil {
+			return cfg, err
+		}
+	}
+
+	mechanism := env("KAFKA_SASL_MECHANISM", "")
+	if mechanism != "" {
+		user, pass := env("KAFKA_SASL_USERNAME", ""), env("KAFKA_SASL_PASSWORD", "")
+		if cfg.SASL, err = saslMechanism(mechanism, user, pass); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+func loadTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("KAFKA_TLS_CA_FILE: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("KAFKA_TLS_CA_FILE: no certificates in %s", caFile)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("KAFKA_TLS_CERT_FILE: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func saslMechanism(name, user, pass string) (sasl.Mechanism, error) {
+	if user == "" || pass == "" {
+		return nil, fmt.Errorf("KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD are required for %s", name)
+	}
+	switch strings.ToUpper(name) {
+	case "PLAIN":
+		return plain.Mechanism{Username: user, Password: pass}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, user, pass)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, user, pass)
+	default:
+		return nil, fmt.Errorf("KAFKA_SASL_MECHANISM: unsupported mechanism %q", name)
+	}
+}
+
+func (c KafkaConfig) isKafka() bool {
+	return c.Transport == "" || c.Transport == TransportKafka
+}
+
+func (c KafkaConfig) transport() *kafka.Transport {
+	return &kafka.Transport{TLS: c.TLS, SASL: c.SASL}
+}
+
+func (c KafkaConfig) dialer() *kafka.Dialer {
+	return &kafka.Dialer{
+		Timeout:       10 * time.Second,
+		DualStack:     true,
+		TLS:           c.TLS,
+		SASLMechanism: c.SASL,
+	}
+}
@@ -0,0 +1,146 @@
+package redstone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Check reports whether one dependency is usable.
+type Check func(ctx context.Context) error
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadyHandler runs all checks concurrently and answers 200 only if every
+// one passes, with a JSON breakdown per dependency either way.
+func ReadyHandler(checks map[string]Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		results := make(map[string]checkResult, len(checks))
+		ready := true
+		for name, check := range checks {
+			wg.Add(1)
+			go func(name string, check Check) {
+				defer wg.Done()
+				res := checkResult{Status: "ok"}
+				if err := check(ctx); err != nil {
+					res = checkResult{Status: "error", Error: err.Error()}
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				results[name] = res
+				if res.Status != "ok" {
+					ready = false
+				}
+			}(name, check)
+		}
+		wg.Wait()
+
+		status, code := "ok", http.StatusOK
+		if !ready {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": results})
+	}
+}
+
+// checker is implemented by the writers and readers of other transports.
+type checker interface {
+	check(ctx context.Context) error
+}
+
+// Check verifies the brokers answer metadata requests for the producer's
+// topic.
+func (p *Producer) Check(ctx context.Context) error {
+	if c, ok := p.w.(checker); ok {
+		return c.check(ctx)
+	}
+	w, ok := p.w.(*kafka.Writer)
+	if !ok {
+		return nil
+	}
+	return checkTopic(ctx, &kafka.Client{Addr: w.Addr, Transport: w.Transport}, p.topic)
+}
+
+// Check verifies broker metadata for the consumer's topic and that this
+// reader is a member of its group, so a replica dropped from the group goes
+// not-ready. A member without partitions, as when there are more replicas
+// than partitions, is still ready, and so is every member while the group
+// rebalances.
+func (c *Consumer) Check(ctx context.Context) error {
+	if _, ok := c.r.(*memoryReader); ok {
+		return nil
+	}
+	if ch, ok := c.r.(checker); ok {
+		return ch.check(ctx)
+	}
+	cfg := c.r.Config()
+	client := c.client()
+	if err := checkTopic(ctx, client, cfg.Topic); err != nil {
+		return err
+	}
+	if cfg.GroupID == "" || cfg.Dialer == nil {
+		return nil
+	}
+	resp, err := client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{cfg.GroupID}})
+	if err != nil {
+		return fmt.Errorf("describe group %s: %w", cfg.GroupID, err)
+	}
+	return checkMember(resp, cfg.GroupID, cfg.Dialer.ClientID)
+}
+
+// checkMember finds the member with clientID in the description of group.
+func checkMember(resp *kafka.DescribeGroupsResponse, group, clientID string) error {
+	for _, g := range resp.Groups {
+		if g.GroupID != group {
+			continue
+		}
+		if g.Error != nil {
+			return fmt.Errorf("group %s: %w", group, g.Error)
+		}
+		switch g.GroupState {
+		case "PreparingRebalance", "CompletingRebalance":
+			return nil
+		}
+		for _, m := range g.Members {
+			if m.ClientID == clientID {
+				return nil
+			}
+		}
+		return fmt.Errorf("not a member of group %s (%s)", group, g.GroupState)
+	}
+	return fmt.Errorf("group %s not described", group)
+}
+
+func checkTopic(ctx context.Context, client *kafka.Client, topic string) error {
+	resp, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return fmt.Errorf("broker metadata: %w", err)
+	}
+	if len(resp.Brokers) == 0 {
+		return fmt.Errorf("no brokers available")
+	}
+	for _, t := range resp.Topics {
+		if t.Name == topic {
+			if t.Error != nil {
+				return fmt.Errorf("topic %s: %w", topic, t.Error)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("topic %s not found", topic)
+}
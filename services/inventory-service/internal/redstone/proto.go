@@ -0,0 +1,314 @@
+package redstone
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf wire encoding of the events, matching
+// schemas/events/v2/events.proto field for field. Zero values are omitted,
+// as proto3 does.
+
+type protoMarshaler interface {
+	appendProto(b []byte) []byte
+}
+
+type protoUnmarshaler interface {
+	unmarshalProto(b []byte) error
+}
+
+// newProtoEvent returns a pointer to a zero event of eventType.
+func newProtoEvent(eventType string) (protoUnmarshaler, error) {
+	switch eventType {
+	case EventOrderCreated:
+		return new(OrderCreated), nil
+	case EventInventoryReserved:
+		return new(InventoryReserved), nil
+	case EventInventoryFailed:
+		return new(InventoryFailed), nil
+	case EventPaymentCaptured:
+		return new(PaymentCaptured), nil
+	case EventPaymentFailed:
+		return new(PaymentFailed), nil
+	case EventOrderConfirmed:
+		return new(OrderConfirmed), nil
+	case EventOrderCancelled:
+		return new(OrderCancelled), nil
+	}
+	return nil, fmt.Errorf("no protobuf message for event type %q", eventType)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// walkProto calls f for every varint and length-delimited field of b,
+// skipping other wire types so unknown fields from newer producers are
+// ignored.
+func walkProto(b []byte, f func(num protowire.Number, v []byte, x uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var err error
+		switch typ {
+		case protowire.VarintType:
+			var x uint64
+			if x, n = protowire.ConsumeVarint(b); n >= 0 {
+				err = f(num, nil, x)
+			}
+		case protowire.BytesType:
+			var v []byte
+			if v, n = protowire.ConsumeBytes(b); n >= 0 {
+				err = f(num, v, 0)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func (e BaseEvent) appendProto(b []byte) []byte {
+	b = appendString(b, 1, e.EventID)
+	b = appendString(b, 2, e.EventType)
+	b = appendInt(b, 3, int64(e.SchemaVersion))
+	if !e.OccurredAt.IsZero() {
+		var ts []byte
+		ts = appendInt(ts, 1, e.OccurredAt.Unix())
+		ts = appendInt(ts, 2, int64(e.OccurredAt.Nanosecond()))
+		b = appendMessage(b, 4, ts)
+	}
+	b = appendString(b, 5, e.CorrelationID)
+	return appendString(b, 6, e.CausationID)
+}
+
+func (e *BaseEvent) unmarshalProto(b []byte) error {
+	return walkProto(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			e.EventID = string(v)
+		case 2:
+			e.EventType = string(v)
+		case 3:
+			e.SchemaVersion = int(int32(x))
+		case 4:
+			var sec, nsec int64
+			err := walkProto(v, func(num protowire.Number, _ []byte, x uint64) error {
+				switch num {
+				case 1:
+					sec = int64(x)
+				case 2:
+					nsec = int64(int32(x))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			e.OccurredAt = time.Unix(sec, nsec).UTC()
+		case 5:
+			e.CorrelationID = string(v)
+		case 6:
+			e.CausationID = string(v)
+		}
+		return nil
+	})
+}
+
+func (it OrderItem) appendProto(b []byte) []byte {
+	b = appendString(b, 1, it.SKU)
+	b = appendInt(b, 2, int64(it.Qty))
+	return appendInt(b, 3, it.UnitPrice)
+}
+
+func (it *OrderItem) unmarshalProto(b []byte) error {
+	return walkProto(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			it.SKU = string(v)
+		case 2:
+			it.Qty = int(int32(x))
+		case 3:
+			it.UnitPrice = int64(x)
+		}
+		return nil
+	})
+}
+
+func (e OrderCreated) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, e.BaseEvent.appendProto(nil))
+	b = appendString(b, 2, e.OrderID)
+	b = appendString(b, 3, e.UserID)
+	for _, it := range e.Items {
+		b = appendMessage(b, 4, it.appendProto(nil))
+	}
+	return appendString(b, 5, e.Currency)
+}
+
+func (e *OrderCreated) unmarshalProto(b []byte) error {
+	return walkProto(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			return e.BaseEvent.unmarshalProto(v)
+		case 2:
+			e.OrderID = string(v)
+		case 3:
+			e.UserID = string(v)
+		case 4:
+			var it OrderItem
+			if err := it.unmarshalProto(v); err != nil {
+				return err
+			}
+			e.Items = append(e.Items, it)
+		case 5:
+			e.Currency = string(v)
+		}
+		return nil
+	})
+}
+
+func (e InventoryReserved) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, e.BaseEvent.appendProto(nil))
+	b = appendString(b, 2, e.OrderID)
+	return appendInt(b, 3, e.Amount)
+}
+
+func (e *InventoryReserved) unmarshalProto(b []byte) error {
+	return walkProto(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			return e.BaseEvent.unmarshalProto(v)
+		case 2:
+			e.OrderID = string(v)
+		case 3:
+			e.Amount = int64(x)
+		}
+		return nil
+	})
+}
+
+func (e InventoryFailed) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, e.BaseEvent.appendProto(nil))
+	b = appendString(b, 2, e.OrderID)
+	return appendString(b, 3, e.Reason)
+}
+
+func (e *InventoryFailed) unmarshalProto(b []byte) error {
+	return walkProto(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			return e.BaseEvent.unmarshalProto(v)
+		case 2:
+			e.OrderID = string(v)
+		case 3:
+			e.Reason = string(v)
+		}
+		return nil
+	})
+}
+
+func (e PaymentCaptured) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, e.BaseEvent.appendProto(nil))
+	b = appendString(b, 2, e.OrderID)
+	return appendInt(b, 3, e.Amount)
+}
+
+func (e *PaymentCaptured) unmarshalProto(b []byte) error {
+	return walkProto(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			return e.BaseEvent.unmarshalProto(v)
+		case 2:
+			e.OrderID = string(v)
+		case 3:
+			e.Amount = int64(x)
+		}
+		return nil
+	})
+}
+
+func (e PaymentFailed) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, e.BaseEvent.appendProto(nil))
+	b = appendString(b, 2, e.OrderID)
+	return appendString(b, 3, e.Reason)
+}
+
+func (e *PaymentFailed) unmarshalProto(b []byte) error {
+	return walkProto(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			return e.BaseEvent.unmarshalProto(v)
+		case 2:
+			e.OrderID = string(v)
+		case 3:
+			e.Reason = string(v)
+		}
+		return nil
+	})
+}
+
+func (e OrderConfirmed) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, e.BaseEvent.appendProto(nil))
+	return appendString(b, 2, e.OrderID)
+}
+
+func (e *OrderConfirmed) unmarshalProto(b []byte) error {
+	return walkProto(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			return e.BaseEvent.unmarshalProto(v)
+		case 2:
+			e.OrderID = string(v)
+		}
+		return nil
+	})
+}
+
+func (e OrderCancelled) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, e.BaseEvent.appendProto(nil))
+	b = appendString(b, 2, e.OrderID)
+	return appendString(b, 3, e.Reason)
+}
+
+func (e *OrderCancelled) unmarshalProto(b []byte) error {
+	return walkProto(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			return e.BaseEvent.unmarshalProto(v)
+		case 2:
+			e.OrderID = string(v)
+		case 3:
+			e.Reason = string(v)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,416 @@
+package redstone
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// Redis Streams transport. Each topic is a stream of the same name whose
+// entries hold the key, the value and one h:<name> field per header; a
+// consumer group is a Redis consumer group. A Commit XACKs exactly the
+// committed entries: taken-over entries are fetched after newer ones, so
+// acking every entry up to an ID could ack one still being handled. Entries
+// a dead member left pending are taken over with XAUTOCLAIM once idle for
+// redisClaimIdle; a live member keeps re-claiming what it still holds so
+// they are not. Producers trim streams by age to KafkaConfig.TopicRetention
+// when it is set, and otherwise to KafkaConfig.RedisMaxLen entries.
+//
+// Like JetStream, a group has no partitions, so events of one key are only
+// handled in order while the group has a single member.
+
+const (
+	redisClaimIdle   = time.Minute
+	redisBlock       = time.Second
+	redisFetchCount  = 64
+	redisHeaderField = "h:"
+)
+
+func redisClient(cfg KafkaConfig) (*redis.Client, error) {
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("REDIS_URL: %w", err)
+	}
+	if cfg.TLS != nil {
+		opts.TLSConfig = cfg.TLS
+	}
+	return redis.NewClient(opts), nil
+}
+
+// redisOffset maps an entry ID, <ms>-<seq>, to an increasing int64.
+func redisOffset(id string) (int64, error) {
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, fmt.Errorf("bad stream id %q", id)
+	}
+	m, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad stream id %q", id)
+	}
+	s, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil || s >= 1<<22 {
+		return 0, fmt.Errorf("bad stream id %q", id)
+	}
+	return m<<22 | s, nil
+}
+
+// redisWriter appends to the stream of one topic.
+type redisWriter struct {
+	rdb       *redis.Client
+	topic     string
+	maxLen    int64
+	retention time.Duration
+	err       error
+}
+
+func newRedisProducer(cfg KafkaConfig, topic string) *Producer {
+	w := &redisWriter{topic: topic, maxLen: cfg.RedisMaxLen, retention: cfg.TopicRetention}
+	w.rdb, w.err = redisClient(cfg)
+	return &Producer{w: w, topic: topic}
+}
+
+func (w *redisWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	_, err := w.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, m := range msgs {
+			values := []any{"key", m.Key, "value", m.Value}
+			for _, h := range m.Headers {
+				values = append(values, redisHeaderField+h.Key, h.Value)
+			}
+			args := &redis.XAddArgs{Stream: w.topic, Values: values, Approx: true}
+			if w.retention > 0 {
+				args.MinID = strconv.FormatInt(time.Now().Add(-w.retention).UnixMilli(), 10)
+			} else if w.maxLen > 0 {
+				args.MaxLen = w.maxLen
+			}
+			p.XAdd(ctx, args)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("xadd %s: %w", w.topic, err)
+	}
+	return nil
+}
+
+func (w *redisWriter) Close() error {
+	if w.rdb == nil {
+		return nil
+	}
+	return w.rdb.Close()
+}
+
+func (w *redisWriter) check(ctx context.Context) error {
+	if w.err != nil {
+		return w.err
+	}
+	return redisCheck(ctx, w.rdb, w.topic)
+}
+
+func redisCheck(ctx context.Context, rdb *redis.Client, topic string) error {
+	typ, err := rdb.Type(ctx, topic).Result()
+	if err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	if typ != "stream" && typ != "none" {
+		return fmt.Errorf("key %s is a %s, not a stream", topic, typ)
+	}
+	return nil
+}
+
+// redisReader reads one topic as a member of a consumer group.
+type redisReader struct {
+	rdb     *redis.Client
+	topic   string
+	group   string
+	name    string
+	trimAge time.Duration
+	err     error
+	log     *Logger
+
+	mu        sync.Mutex
+	started   bool
+	buf       []redis.XMessage
+	lastClaim time.Time
+	pending   map[int64]string
+	done      chan struct{}
+}
+
+func newRedisConsumer(cfg KafkaConfig, topic, groupID string) *Consumer {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	r := &redisReader{
+		topic:   topic,
+		group:   groupID,
+		name:    fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b)),
+		trimAge: cfg.TopicRetention,
+		log:     NewLogger(groupID),
+		pending: make(map[int64]string),
+		done:    make(chan struct{}),
+	}
+	r.rdb, r.err = redisClient(cfg)
+	return &Consumer{r: r}
+}
+
+// start creates the group on first use, so a Redis outage is retried by
+// the fetch loop.
+func (r *redisReader) start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil || r.started {
+		return r.err
+	}
+	err := r.rdb.XGroupCreateMkStream(ctx, r.topic, r.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("group %s on %s: %w", r.group, r.topic, err)
+	}
+	r.started = true
+	go r.keepClaimed()
+	return nil
+}
+
+// keepClaimed re-claims the entries r holds so their idle time never
+// reaches redisClaimIdle while they wait for a retry delay or a slow
+// handler.
+func (r *redisReader) keepClaimed() {
+	t := time.NewTicker(redisClaimIdle / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-t.C:
+		}
+		r.mu.Lock()
+		ids := make([]string, 0, len(r.pending)+len(r.buf))
+		for _, id := range r.pending {
+			ids = append(ids, id)
+		}
+		for _, x := range r.buf {
+			ids = append(ids, x.ID)
+		}
+		r.mu.Unlock()
+		if len(ids) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), redisClaimIdle/3)
+		_ = r.rdb.XClaimJustID(ctx, &redis.XClaimArgs{Stream: r.topic, Group: r.group, Consumer: r.name, Messages: ids}).Err()
+		cancel()
+	}
+}
+
+func (r *redisReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if err := r.start(ctx); err != nil {
+		return kafka.Message{}, err
+	}
+	for {
+		r.mu.Lock()
+		empty := len(r.buf) == 0
+		r.mu.Unlock()
+		if empty {
+			if err := r.fill(ctx); err != nil {
+				return kafka.Message{}, err
+			}
+			continue
+		}
+		r.mu.Lock()
+		x := r.buf[0]
+		r.buf = r.buf[1:]
+		r.mu.Unlock()
+		m, err := r.message(x)
+		if err != nil {
+			// Unreadable entry; drop it rather than block the group.
+			r.mu.Lock()
+			log := r.log
+			r.mu.Unlock()
+			log.WarnContext(withEventFields(ctx, m), "dropped unreadable stream entry", map[string]any{
+				"topic": r.topic, "group": r.group, "id": x.ID, "err": err.Error(),
+			})
+			_ = r.rdb.XAck(ctx, r.topic, r.group, x.ID).Err()
+			continue
+		}
+		r.mu.Lock()
+		r.pending[m.Offset] = x.ID
+		r.mu.Unlock()
+		return m, nil
+	}
+}
+
+// fill takes over entries idle in other members, at most every
+// redisClaimIdle, and otherwise waits up to redisBlock for new entries.
+// Only FetchMessage calls it.
+func (r *redisReader) fill(ctx context.Context) error {
+	var buf []redis.XMessage
+	defer func() {
+		r.mu.Lock()
+		r.buf = append(r.buf, buf...)
+		r.mu.Unlock()
+	}()
+	if time.Since(r.lastClaim) >= redisClaimIdle {
+		start := "0-0"
+		for {
+			msgs, next, err := r.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   r.topic,
+				Group:    r.group,
+				Consumer: r.name,
+				MinIdle:  redisClaimIdle,
+				Start:    start,
+				Count:    redisFetchCount,
+			}).Result()
+			if err != nil {
+				return fmt.Errorf("xautoclaim %s: %w", r.topic, err)
+			}
+			buf = append(buf, msgs...)
+			if next == "0-0" || next == "" {
+				break
+			}
+			start = next
+		}
+		r.lastClaim = time.Now()
+		if len(buf) > 0 {
+			return nil
+		}
+	}
+
+	streams, err := r.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    r.group,
+		Consumer: r.name,
+		Streams:  []string{r.topic, ">"},
+		Count:    redisFetchCount,
+		Block:    redisBlock,
+	}).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return nil
+	case err != nil:
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("xreadgroup %s: %w", r.topic, err)
+	}
+	for _, s := range streams {
+		buf = append(buf, s.Messages...)
+	}
+	return nil
+}
+
+func (r *redisReader) message(x redis.XMessage) (kafka.Message, error) {
+	m := kafka.Message{Topic: r.topic}
+	for k, v := range x.Values {
+		s, _ := v.(string)
+		switch {
+		case k == "key":
+			m.Key = []byte(s)
+		case k == "value":
+			m.Value = []byte(s)
+		case strings.HasPrefix(k, redisHeaderField):
+			m.Headers = append(m.Headers, kafka.Header{Key: strings.TrimPrefix(k, redisHeaderField), Value: []byte(s)})
+		}
+	}
+	// On error m still carries the key and headers, for logging.
+	off, err := redisOffset(x.ID)
+	if err != nil {
+		return m, err
+	}
+	m.Offset, m.Time = off, time.UnixMilli(off>>22)
+	return m, nil
+}
+
+// setLogger makes the reader log through the logger of the consumer's Run.
+func (r *redisReader) setLogger(log *Logger) {
+	r.mu.Lock()
+	r.log = log
+	r.mu.Unlock()
+}
+
+// CommitMessages acks the delivered entries in msgs.
+func (r *redisReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	var ids []string
+	for _, m := range msgs {
+		if id, ok := r.pending[m.Offset]; ok {
+			ids = append(ids, id)
+			delete(r.pending, m.Offset)
+		}
+	}
+	r.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	return r.rdb.XAck(ctx, r.topic, r.group, ids...).Err()
+}
+
+func (r *redisReader) Config() kafka.ReaderConfig {
+	return kafka.ReaderConfig{Topic: r.topic, GroupID: r.group}
+}
+
+// Close leaves uncommitted entries pending; another member claims them
+// after redisClaimIdle.
+func (r *redisReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	close(r.done)
+	if r.rdb == nil {
+		return nil
+	}
+	return r.rdb.Close()
+}
+
+func (r *redisReader) check(ctx context.Context) error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := redisCheck(ctx, r.rdb, r.topic); err != nil {
+		return err
+	}
+	groups, err := r.rdb.XInfoGroups(ctx, r.topic).Result()
+	if err != nil {
+		return fmt.Errorf("groups of %s: %w", r.topic, err)
+	}
+	for _, g := range groups {
+		if g.Name == r.group {
+			return nil
+		}
+	}
+	return fmt.Errorf("group %s not found on %s", r.group, r.topic)
+}
+
+// retention is the MINID trimming producers apply, or forever when they
+// only trim by length.
+func (r *redisReader) retention(ctx context.Context) (time.Duration, error) {
+	if r.trimAge > 0 {
+		return r.trimAge, nil
+	}
+	return -1, nil
+}
+
+// ensureRedisStreams is EnsureTopics for Redis: streams and groups are
+// created on first use and trimmed by producers, so it only checks that the
+// server answers and no topic name is taken by another key type.
+func ensureRedisStreams(ctx context.Context, cfg KafkaConfig, topics []string) error {
+	rdb, err := redisClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer rdb.Close()
+	var errs []error
+	for _, t := range topics {
+		if err := redisCheck(ctx, rdb, t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,177 @@
+package redstone
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "redstone"
+
+type TracingConfig struct {
+	ServiceName string
+	// Exporter is "otlp" or "none".
+	Exporter string
+	// Endpoint is the OTLP/HTTP collector URL, e.g. http://jaeger:4318.
+	Endpoint string
+	// SpanExporter, when set, replaces Exporter; tests pass an in-memory
+	// exporter here.
+	SpanExporter sdktrace.SpanExporter
+}
+
+// InitTracing installs the global tracer provider and the W3C trace-context
+// propagator. The returned function flushes pending spans and must be called
+// before exit.
+func InitTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exp := cfg.SpanExporter
+	if exp == nil {
+		switch cfg.Exporter {
+		case "", "none":
+			return func(context.Context) error { return nil }, nil
+		case "otlp":
+			var opts []otlptracehttp.Option
+			if cfg.Endpoint != "" {
+				opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+			}
+			var err error
+			if exp, err = otlptracehttp.New(ctx, opts...); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown traces exporter %q", cfg.Exporter)
+		}
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+func tracer() trace.Tracer { return otel.Tracer(tracerName) }
+
+// TraceHTTP wraps h so every request gets a server span.
+func TraceHTTP(service string, h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, service)
+}
+
+// TraceRoutes is chi middleware that renames the request span after the
+// matched route pattern, keeping span names low-cardinality.
+func TraceRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if rc := chi.RouteContext(r.Context()); rc != nil && rc.RoutePattern() != "" {
+			trace.SpanFromContext(r.Context()).SetName(r.Method + " " + rc.RoutePattern())
+		}
+	})
+}
+
+// headerCarrier adapts Kafka headers to the OpenTelemetry propagator.
+type headerCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (c headerCarrier) Get(key string) string {
+	for _, h := range *c.headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c headerCarrier) Set(key, value string) {
+	for i, h := range *c.headers {
+		if h.Key == key {
+			(*c.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.headers = append(*c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.headers))
+	for _, h := range *c.headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// MessageContext returns ctx carrying the trace context of m, so spans and
+// events started while handling m join the same trace.
+func MessageContext(ctx context.Context, m kafka.Message) context.Context {
+	headers := m.Headers
+	return otel.GetTextMapPropagator().Extract(ctx, headerCarrier{&headers})
+}
+
+// TraceParent returns the W3C traceparent of the span in ctx, or "" when ctx
+// carries no span. It is used to persist trace context across the outbox.
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier["traceparent"]
+}
+
+// ContextWithTraceParent is the inverse of TraceParent.
+func ContextWithTraceParent(ctx context.Context, traceParent string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier{"traceparent": traceParent})
+}
+
+func startPublishSpan(ctx context.Context, topic, key string, base BaseEvent) (context.Context, trace.Span) {
+	return tracer().Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingDestinationName(topic),
+			semconv.MessagingKafkaMessageKey(key),
+			attribute.String("redstone.event_type", base.EventType),
+			attribute.String("redstone.event_id", base.EventID),
+		),
+	)
+}
+
+func startProcessSpan(ctx context.Context, m kafka.Message) (context.Context, trace.Span) {
+	md := MetadataOf(m)
+	return tracer().Start(MessageContext(ctx, m), m.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingDestinationName(m.Topic),
+			semconv.MessagingKafkaMessageKey(md.Key),
+			semconv.MessagingDestinationPartitionID(strconv.Itoa(m.Partition)),
+			semconv.MessagingKafkaMessageOffset(int(m.Offset)),
+			attribute.String("redstone.event_type", md.EventType),
+			attribute.String("redstone.event_id", md.EventID),
+		),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
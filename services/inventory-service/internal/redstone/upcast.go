@@ -0,0 +1,107 @@
+package redstone
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Upcaster rewrites the decoded payload of one event type from one schema
+// version to the next. It must not touch schema_version.
+type Upcaster func(payload map[string]any) error
+
+type upcastKey struct {
+	eventType string
+	from      int
+}
+
+var (
+	upcastMu  sync.RWMutex
+	upcasters = map[upcastKey]Upcaster{}
+)
+
+// RegisterUpcaster installs up to turn eventType payloads of version from
+// into version from+1. Event types without an upcaster for a version keep
+// their shape across it.
+func RegisterUpcaster(eventType string, from int, up Upcaster) {
+	upcastMu.Lock()
+	defer upcastMu.Unlock()
+	upcasters[upcastKey{eventType, from}] = up
+}
+
+func init() {
+	// v2: OrderCreated carries its currency; every v1 order was in INR.
+	RegisterUpcaster(EventOrderCreated, 1, func(p map[string]any) error {
+		if _, ok := p["currency"]; !ok {
+			p["currency"] = "INR"
+		}
+		return nil
+	})
+}
+
+// versionOf is the schema version of an envelope; events from before
+// versioning have none and are version 1.
+func versionOf(base BaseEvent) int {
+	if base.SchemaVersion == 0 {
+		return 1
+	}
+	return base.SchemaVersion
+}
+
+// Upcast returns payload rewritten to SchemaVersion. Payloads already at, or
+// newer than, SchemaVersion are returned unchanged; fields a newer producer
+// added are ignored when decoding.
+func Upcast(payload []byte) ([]byte, error) {
+	var p map[string]any
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("upcast: %w", err)
+	}
+	if p == nil {
+		// JSON null decodes without error.
+		return nil, fmt.Errorf("upcast: payload is not a JSON object")
+	}
+	version := 1
+	if n, ok := p["schema_version"].(json.Number); ok {
+		v, err := strconv.Atoi(n.String())
+		if err != nil {
+			return nil, fmt.Errorf("upcast: schema_version %q: %w", n, err)
+		}
+		version = v
+	}
+	if version >= SchemaVersion {
+		return payload, nil
+	}
+
+	et, _ := p["event_type"].(string)
+	upcastMu.RLock()
+	defer upcastMu.RUnlock()
+	for v := version; v < SchemaVersion; v++ {
+		if up, ok := upcasters[upcastKey{et, v}]; ok {
+			if err := up(p); err != nil {
+				return nil, fmt.Errorf("upcast %s v%d: %w", et, v, err)
+			}
+		}
+	}
+	p["schema_version"] = SchemaVersion
+	return json.Marshal(p)
+}
+
+// upcastMessage returns m with its payload and schema_version header at
+// SchemaVersion.
+func upcastMessage(m kafka.Message) (kafka.Message, error) {
+	out, err := Upcast(m.Value)
+	if err != nil || bytes.Equal(out, m.Value) {
+		return m, err
+	}
+	m.Value = out
+	headers := append([]kafka.Header(nil), m.Headers...)
+	headerCarrier{&headers}.Set(HeaderSchemaVersion, strconv.Itoa(SchemaVersion))
+	m.Headers = headers
+	return m, nil
+}
@@ -0,0 +1,147 @@
+// Command redstone-archive copies the saga topics to compressed, hourly
+// NDJSON files so events outlive Kafka retention. Offsets are committed only
+// after the files holding them are synced and listed in the manifest; a
+// crash re-archives the uncommitted tail, which redstone-replay skips.
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/redstone/notification-service/internal/archive"
+	"github.com/redstone/notification-service/internal/redstone"
+)
+
+type Config struct {
+	ServiceName   string
+	Dir           string
+	Topics        []string
+	GroupID       string
+	FlushInterval time.Duration
+	RetainYears   int
+	Kafka         redstone.KafkaConfig
+}
+
+func env(key, def string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func main() {
+	cfg := Config{
+		ServiceName: env("SERVICE_NAME", "redstone-archive"),
+		Dir:         env("ARCHIVE_DIR", "./archive"),
+		GroupID:     env("KAFKA_GROUP_ID", "redstone-archive"),
+	}
+	for _, t := range strings.Split(env("ARCHIVE_TOPICS", "redstone.orders,redstone.inventory,redstone.payments"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			cfg.Topics = append(cfg.Topics, t)
+		}
+	}
+
+	log := redstone.NewLogger(cfg.ServiceName)
+	level, err := redstone.ParseLevel(env("LOG_LEVEL", "info"))
+	if err != nil {
+		log.Error("invalid LOG_LEVEL", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	log.SetLevel(level)
+	// Libraries logging through log/slog end up in the service log.
+	slog.SetDefault(slog.New(log.Handler()))
+	if cfg.Kafka, err = redstone.LoadKafkaConfig(env); err != nil {
+		log.Error("invalid kafka config", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.FlushInterval, err = time.ParseDuration(env("ARCHIVE_FLUSH_INTERVAL", "1m")); err != nil || cfg.FlushInterval <= 0 {
+		log.Error("invalid ARCHIVE_FLUSH_INTERVAL", map[string]any{"value": env("ARCHIVE_FLUSH_INTERVAL", "1m")})
+		os.Exit(1)
+	}
+	if cfg.RetainYears, err = strconv.Atoi(env("ARCHIVE_RETENTION_YEARS", "7")); err != nil || cfg.RetainYears < 1 {
+		log.Error("invalid ARCHIVE_RETENTION_YEARS", map[string]any{"value": env("ARCHIVE_RETENTION_YEARS", "7")})
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := redstone.EnsureTopics(ctx, cfg.Kafka, cfg.Topics...); err != nil {
+		log.Error("topic check failed", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+
+	w, err := archive.NewWriter(cfg.Dir, cfg.RetainYears)
+	if err != nil {
+		log.Error("archive open failed", map[string]any{"err": err.Error(), "dir": cfg.Dir})
+		os.Exit(1)
+	}
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	for _, t := range cfg.Topics {
+		c := redstone.NewConsumer(cfg.Kafka, t, cfg.GroupID)
+		defer c.Close()
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			if err := archiveTopic(ctx, c, w.NewBatch(), cfg.FlushInterval); err != nil {
+				log.Error("archiving stopped", map[string]any{"topic": topic, "err": err.Error()})
+				stop()
+			}
+		}(t)
+	}
+	log.Info("archiving", map[string]any{"topics": cfg.Topics, "dir": cfg.Dir})
+	wg.Wait()
+	log.Info("shutting down", nil)
+}
+
+// archiveTopic adds messages from c to b and flushes and commits every
+// interval. On cancellation the open files are flushed and committed too.
+func archiveTopic(ctx context.Context, c *redstone.Consumer, b *archive.Batch, interval time.Duration) error {
+	flush := func() error {
+		commits, err := b.Flush()
+		if err != nil {
+			return err
+		}
+		for _, m := range commits {
+			// Not ctx: the files are on disk, their offsets should be too.
+			if err := c.Commit(context.Background(), m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	deadline := time.Now().Add(interval)
+	for {
+		fctx, cancel := context.WithDeadline(ctx, deadline)
+		m, err := c.Fetch(fctx)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return flush()
+		case errors.Is(err, context.DeadlineExceeded):
+		case err != nil:
+			return err
+		default:
+			if err := b.Add(m); err != nil {
+				return err
+			}
+		}
+		if !time.Now().Before(deadline) {
+			if err := flush(); err != nil {
+				return err
+			}
+			deadline = time.Now().Add(interval)
+		}
+	}
+}
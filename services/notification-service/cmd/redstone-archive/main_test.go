@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/redstone/notification-service/internal/archive"
+	"github.com/redstone/notification-service/internal/redstone"
+)
+
+// archived returns the number of messages listed in the manifest of dir.
+func archived(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := archive.ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range entries {
+		n += e.Count
+	}
+	return n
+}
+
+// Consumed messages end up in hourly files, and their offsets are committed
+// once the files are in the manifest.
+func TestArchiveTopic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := redstone.NewMemoryBroker(2)
+	p := b.Producer("redstone.orders")
+	start := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		m := kafka.Message{Key: []byte(fmt.Sprint("ord_", i)), Value: []byte(`{}`), Time: start.Add(time.Duration(i) * 20 * time.Minute)}
+		if err := p.WriteMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	w, err := archive.NewWriter(dir, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	c := b.Consumer("redstone.orders", "redstone-archive")
+	actx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- archiveTopic(actx, c, w.NewBatch(), 20*time.Millisecond) }()
+	for archived(t, dir) < 6 {
+		if ctx.Err() != nil {
+			t.Fatalf("archived %d of 6 messages", archived(t, dir))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	entries, err := archive.ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hours := map[string]bool{}
+	for _, e := range entries {
+		if e.Topic != "redstone.orders" || e.FirstTime.Truncate(time.Hour) != e.LastTime.Truncate(time.Hour) {
+			t.Errorf("entry %+v spans hours", e)
+		}
+		hours[e.FirstTime.Format("15")] = true
+	}
+	if len(hours) != 3 {
+		t.Errorf("files for hours %v, want 10, 11 and 12", hours)
+	}
+
+	// Everything archived is committed: a new member of the group only
+	// sees what is written afterwards.
+	if err := p.WriteMessage(ctx, kafka.Message{Key: []byte("ord_new"), Value: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := b.Consumer("redstone.orders", "redstone-archive").Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Key) != "ord_new" {
+		t.Fatalf("fetched %s at %d/%d, want only the new message", m.Key, m.Partition, m.Offset)
+	}
+}
@@ -0,0 +1,271 @@
+// Command redstone-replay re-feeds events after an incident. It reads a
+// range of a topic, keeps the messages matching the filters and either
+// prints them as NDJSON or republishes them to a target topic.
+//
+//	redstone-replay -topic redstone.orders.inventory-service.dlq -target redstone.orders -dry-run
+//	redstone-replay -topic redstone.payments -from-time 2024-05-01T10:00:00Z -order-id ord_123
+//
+// With -archive it reads the files written by redstone-archive instead of
+// Kafka. Kafka connection settings come from the same KAFKA_* environment as
+// the services. Republished messages keep their event IDs, so consumers that
+// already handled an event skip it.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/redstone/notification-service/internal/archive"
+	"github.com/redstone/notification-service/internal/redstone"
+)
+
+func env(key, def string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// filter keeps messages whose event type, key (order ID) and correlation ID
+// are in the given sets; an empty set matches anything.
+type filter struct {
+	eventTypes, orderIDs, correlationIDs map[string]bool
+}
+
+func set(csv string) map[string]bool {
+	out := map[string]bool{}
+	for _, v := range strings.Split(csv, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out[v] = true
+		}
+	}
+	return out
+}
+
+func (f filter) match(m kafka.Message) bool {
+	md := redstone.MetadataOf(m)
+	in := func(s map[string]bool, v string) bool { return len(s) == 0 || s[v] }
+	return in(f.eventTypes, md.EventType) && in(f.orderIDs, md.Key) && in(f.correlationIDs, md.CorrelationID)
+}
+
+func parseTime(name, s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		log.Fatalf("-%s: %v", name, err)
+	}
+	return t
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("redstone-replay: ")
+	var (
+		topic         = flag.String("topic", "", "topic to read (required unless -archive is set)")
+		archiveDir    = flag.String("archive", "", "read the archive in this directory instead of Kafka")
+		partition     = flag.Int("partition", -1, "read only this partition")
+		fromOffset    = flag.Int64("from-offset", -1, "first offset to read in each partition")
+		toOffset      = flag.Int64("to-offset", -1, "last offset to read in each partition")
+		fromTime      = flag.String("from-time", "", "read messages at or after this RFC 3339 time")
+		toTime        = flag.String("to-time", "", "stop at messages after this RFC 3339 time")
+		eventType     = flag.String("event-type", "", "comma-separated event types to keep")
+		orderID       = flag.String("order-id", "", "comma-separated order IDs (message keys) to keep")
+		correlationID = flag.String("correlation-id", "", "comma-separated correlation IDs to keep")
+		target        = flag.String("target", "", "republish matching messages to this topic instead of printing them")
+		dryRun        = flag.Bool("dry-run", false, "print what would be republished without writing anything")
+	)
+	flag.Parse()
+	if *topic == "" && *archiveDir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	since, until := parseTime("from-time", *fromTime), parseTime("to-time", *toTime)
+	f := filter{set(*eventType), set(*orderID), set(*correlationID)}
+
+	cfg, err := redstone.LoadKafkaConfig(env)
+	if err != nil {
+		log.Fatalf("invalid kafka config: %v", err)
+	}
+	// Messages are written one at a time; don't wait to fill batches.
+	cfg.BatchTimeout = time.Millisecond
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var producer *redstone.Producer
+	if *target != "" && !*dryRun {
+		producer = redstone.NewProducer(cfg, *target)
+		defer producer.Close()
+	}
+	out := json.NewEncoder(os.Stdout)
+	emit := func(m kafka.Message) error {
+		if producer != nil {
+			return producer.WriteMessage(ctx, redstone.Replayed(m))
+		}
+		return out.Encode(redstone.RecordOf(m))
+	}
+
+	var read, matched int
+	if *archiveDir != "" {
+		read, matched, err = replayArchive(*archiveDir, *topic, *partition, *fromOffset, *toOffset, since, until, f, emit)
+		if err != nil {
+			log.Fatalf("%v (read %d, matched %d)", err, read, matched)
+		}
+	}
+
+	var ranges []redstone.PartitionRange
+	if *archiveDir == "" {
+		if ranges, err = redstone.TopicOffsets(ctx, cfg, *topic, since); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, r := range ranges {
+		if *partition >= 0 && r.Partition != *partition {
+			continue
+		}
+		start, end := max(r.First, *fromOffset), r.End
+		if *toOffset >= 0 {
+			end = min(end, *toOffset+1)
+		}
+		if start >= end {
+			continue
+		}
+		c, err := redstone.NewPartitionConsumer(cfg, *topic, r.Partition, start)
+		if err != nil {
+			log.Fatalf("partition %d: %v", r.Partition, err)
+		}
+		lastStable := func(ctx context.Context) (int64, error) {
+			return redstone.LastStableOffset(ctx, cfg, *topic, r.Partition)
+		}
+		n, k, err := replayPartition(ctx, c, lastStable, start, end, until, f, emit)
+		c.Close()
+		read, matched = read+n, matched+k
+		if err != nil {
+			log.Fatalf("partition %d: %v (read %d, matched %d)", r.Partition, err, read, matched)
+		}
+	}
+
+	switch {
+	case producer != nil:
+		log.Printf("read %d, republished %d to %s", read, matched, *target)
+	case *dryRun && *target != "":
+		log.Printf("read %d, would republish %d to %s (dry run)", read, matched, *target)
+	default:
+		log.Printf("read %d, matched %d", read, matched)
+	}
+}
+
+// replayArchive passes the archived messages in range that match f to emit.
+// Files are read in offset order per partition, and offsets already seen,
+// e.g. archived twice after a crash, are skipped.
+func replayArchive(dir, topic string, partition int, fromOffset, toOffset int64, since, until time.Time, f filter, emit func(kafka.Message) error) (read, matched int, err error) {
+	entries, err := archive.ReadManifest(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	type topicPartition struct {
+		topic     string
+		partition int
+	}
+	next := map[topicPartition]int64{}
+	for _, e := range entries {
+		switch {
+		case topic != "" && e.Topic != topic,
+			partition >= 0 && e.Partition != partition,
+			toOffset >= 0 && e.FirstOffset > toOffset,
+			e.LastOffset < fromOffset,
+			!since.IsZero() && e.LastTime.Before(since),
+			!until.IsZero() && e.FirstTime.After(until):
+			continue
+		}
+		tp := topicPartition{e.Topic, e.Partition}
+		err := archive.ReadFile(dir, e, func(r redstone.Record) error {
+			m := r.Message()
+			if seen, ok := next[tp]; ok && m.Offset < seen {
+				return nil
+			}
+			next[tp] = m.Offset + 1
+			if m.Offset < fromOffset || (toOffset >= 0 && m.Offset > toOffset) ||
+				(!since.IsZero() && m.Time.Before(since)) || (!until.IsZero() && m.Time.After(until)) {
+				return nil
+			}
+			read++
+			if !f.match(m) {
+				return nil
+			}
+			if err := emit(m); err != nil {
+				return err
+			}
+			matched++
+			return nil
+		})
+		if err != nil {
+			return read, matched, err
+		}
+	}
+	return read, matched, nil
+}
+
+// idleTimeout is how long a partition may send nothing before replay checks
+// whether it has reached the end.
+var idleTimeout = 5 * time.Second
+
+// fetcher is the part of a partition consumer replayPartition reads with.
+type fetcher interface {
+	Fetch(context.Context) (kafka.Message, error)
+}
+
+// replayPartition passes the messages in [start, end) of one partition that
+// match f to emit, stopping early at the first message after until. When c
+// sends nothing for idleTimeout the partition is done only if lastStable
+// reports its committed messages reach end, leaving transaction markers or
+// aborted records, which c skips; otherwise the replay is incomplete.
+func replayPartition(ctx context.Context, c fetcher, lastStable func(context.Context) (int64, error), start, end int64, until time.Time, f filter, emit func(kafka.Message) error) (read, matched int, err error) {
+	next := start
+	for {
+		fctx, cancel := context.WithTimeout(ctx, idleTimeout)
+		m, err := c.Fetch(fctx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+				stable, err := lastStable(ctx)
+				if err != nil {
+					return read, matched, fmt.Errorf("idle at offset %d before end %d: %w", next, end, err)
+				}
+				if stable < end {
+					return read, matched, fmt.Errorf("idle at offset %d before end %d: committed messages end at %d, a transaction is still open", next, end, stable)
+				}
+				return read, matched, nil
+			}
+			return read, matched, err
+		}
+		next = m.Offset + 1
+		if !until.IsZero() && m.Time.After(until) {
+			return read, matched, nil
+		}
+		read++
+		if f.match(m) {
+			if err := emit(m); err != nil {
+				return read, matched, err
+			}
+			matched++
+		}
+		if m.Offset >= end-1 {
+			return read, matched, nil
+		}
+	}
+}
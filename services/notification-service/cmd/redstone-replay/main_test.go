@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/redstone/notification-service/internal/archive"
+	"github.com/redstone/notification-service/internal/redstone"
+)
+
+var start = time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+
+// sourceMessages returns the messages of one partition, 20 minutes apart,
+// alternating OrderCreated and OrderCancelled.
+func sourceMessages(n int) []kafka.Message {
+	var out []kafka.Message
+	for i := 0; i < n; i++ {
+		typ := "OrderCreated"
+		if i%2 == 1 {
+			typ = "OrderCancelled"
+		}
+		out = append(out, kafka.Message{
+			Topic:  "redstone.orders",
+			Offset: int64(i),
+			Time:   start.Add(time.Duration(i) * 20 * time.Minute),
+			Key:    []byte(fmt.Sprint("ord_", i)),
+			Value:  []byte(fmt.Sprintf(`{"event_type":%q,"event_id":"e%d"}`, typ, i)),
+			Headers: []kafka.Header{
+				{Key: redstone.HeaderEventID, Value: []byte(fmt.Sprint("e", i))},
+				{Key: redstone.HeaderEventType, Value: []byte(typ)},
+			},
+		})
+	}
+	return out
+}
+
+// writeArchive archives each batch of msgs with its own writer, as
+// consecutive runs of redstone-archive would.
+func writeArchive(t *testing.T, dir string, batches ...[]kafka.Message) {
+	t.Helper()
+	for _, msgs := range batches {
+		w, err := archive.NewWriter(dir, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := w.NewBatch()
+		for _, m := range msgs {
+			if err := b.Add(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+	}
+}
+
+// republish replays dir into a fresh broker the way -archive -target does
+// and returns what landed on the target topic.
+func republish(t *testing.T, dir string, fromOffset, toOffset int64, since, until time.Time, f filter) []kafka.Message {
+	t.Helper()
+	b := redstone.NewMemoryBroker(1)
+	p := b.Producer("redstone.orders.replayed")
+	_, matched, err := replayArchive(dir, "redstone.orders", -1, fromOffset, toOffset, since, until, f, func(m kafka.Message) error {
+		return p.WriteMessage(context.Background(), redstone.Replayed(m))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := b.Messages("redstone.orders.replayed")
+	if len(got) != matched {
+		t.Fatalf("matched %d, republished %d", matched, len(got))
+	}
+	return got
+}
+
+// Archived messages come back with their keys, values and headers, each
+// once and in offset order, even when a crash archived some of them twice.
+func TestReplayArchive(t *testing.T) {
+	dir := t.TempDir()
+	msgs := sourceMessages(6)
+	// The first run archived 0-3 but died before committing 2 and 3; the
+	// next run archived them again.
+	writeArchive(t, dir, msgs[:4], msgs[2:])
+
+	got := republish(t, dir, -1, -1, time.Time{}, time.Time{}, filter{})
+	if len(got) != len(msgs) {
+		t.Fatalf("republished %d messages, want %d", len(got), len(msgs))
+	}
+	for i, m := range got {
+		want := msgs[i]
+		if string(m.Key) != string(want.Key) || string(m.Value) != string(want.Value) || !reflect.DeepEqual(m.Headers, want.Headers) {
+			t.Errorf("message %d: %s %s %v, want %s %s %v", i, m.Key, m.Value, m.Headers, want.Key, want.Value, want.Headers)
+		}
+	}
+}
+
+func TestReplayArchiveFilters(t *testing.T) {
+	dir := t.TempDir()
+	writeArchive(t, dir, sourceMessages(6))
+	keys := func(msgs []kafka.Message) string {
+		var out []string
+		for _, m := range msgs {
+			out = append(out, string(m.Key))
+		}
+		return fmt.Sprint(out)
+	}
+	for _, c := range []struct {
+		name                 string
+		fromOffset, toOffset int64
+		since, until         time.Time
+		f                    filter
+		want                 string
+	}{
+		{"offsets", 1, 3, time.Time{}, time.Time{}, filter{}, "[ord_1 ord_2 ord_3]"},
+		{"times", -1, -1, start.Add(40 * time.Minute), start.Add(80 * time.Minute), filter{}, "[ord_2 ord_3 ord_4]"},
+		{"event type", -1, -1, time.Time{}, time.Time{}, filter{eventTypes: set("OrderCancelled")}, "[ord_1 ord_3 ord_5]"},
+		{"order id", -1, -1, time.Time{}, time.Time{}, filter{orderIDs: set("ord_0,ord_4")}, "[ord_0 ord_4]"},
+	} {
+		if got := keys(republish(t, dir, c.fromOffset, c.toOffset, c.since, c.until, c.f)); got != c.want {
+			t.Errorf("%s: republished %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+// fakeFetcher sends msgs, then blocks until the fetch times out, as a
+// partition with nothing more to read does.
+type fakeFetcher struct{ msgs []kafka.Message }
+
+func (f *fakeFetcher) Fetch(ctx context.Context) (kafka.Message, error) {
+	if len(f.msgs) == 0 {
+		<-ctx.Done()
+		return kafka.Message{}, ctx.Err()
+	}
+	m := f.msgs[0]
+	f.msgs = f.msgs[1:]
+	return m, nil
+}
+
+// A partition that goes idle before end is finished only when its
+// committed messages reach end.
+func TestReplayPartitionIdle(t *testing.T) {
+	defer func(d time.Duration) { idleTimeout = d }(idleTimeout)
+	idleTimeout = 20 * time.Millisecond
+	stableAt := func(o int64, err error) func(context.Context) (int64, error) {
+		return func(context.Context) (int64, error) { return o, err }
+	}
+	// Offsets 0-3 hold messages, 4 a commit marker; the partition ends at 5.
+	for _, c := range []struct {
+		name   string
+		stable func(context.Context) (int64, error)
+		err    string
+	}{
+		{"committed", stableAt(5, nil), ""},
+		{"open transaction", stableAt(4, nil), "idle at offset 4 before end 5: committed messages end at 4"},
+		{"lookup failed", stableAt(0, fmt.Errorf("broker down")), "idle at offset 4 before end 5: broker down"},
+	} {
+		read, matched, err := replayPartition(context.Background(), &fakeFetcher{sourceMessages(4)}, c.stable, 0, 5, time.Time{}, filter{}, func(kafka.Message) error { return nil })
+		if read != 4 || matched != 4 {
+			t.Errorf("%s: read %d, matched %d, want 4", c.name, read, matched)
+		}
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.err != "" && (err == nil || !strings.HasPrefix(err.Error(), c.err)):
+			t.Errorf("%s: got %v, want %s", c.name, err, c.err)
+		}
+	}
+
+	// Reaching end needs no lookup.
+	noLookup := stableAt(0, fmt.Errorf("looked up"))
+	if read, _, err := replayPartition(context.Background(), &fakeFetcher{sourceMessages(4)}, noLookup, 0, 4, time.Time{}, filter{}, func(kafka.Message) error { return nil }); err != nil || read != 4 {
+		t.Errorf("read %d, %v", read, err)
+	}
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/segmentio/kafka-go"
 
 	"github.com/redstone/notification-service/internal/redstone"
 )
@@ -17,12 +21,16 @@ import (
 type Config struct {
 	ServiceName string
 	HTTPPort string
-	KafkaBrokers []string
+	Kafka redstone.KafkaConfig
 	GroupID string
+	RetryDelays []time.Duration
 	TopicOrders string
 	TopicInventory string
 	TopicPayments string
 	TopicNotifications string
+	TracesExporter string
+	Validation redstone.ValidationMode
+	OTLPEndpoint string
 }
 
 func env(key, def string) string {
@@ -31,66 +39,132 @@ func env(key, def string) string {
 	return v
 }
 
-func parseCSV(s string) []string {
-	var out []string
+func parseDurations(s string) ([]time.Duration, error) {
+	var out []time.Duration
 	for _, p := range strings.Split(s, ",") {
-		p = strings.TrimSpace(p)
-		if p != "" { out = append(out, p) }
+		if p = strings.TrimSpace(p); p == "" { continue }
+		d, err := time.ParseDuration(p)
+		if err != nil { return nil, err }
+		out = append(out, d)
 	}
-	return out
+	return out, nil
 }
 
 func main() {
 	cfg := Config{
 		ServiceName: env("SERVICE_NAME","notification-service"),
 		HTTPPort: env("HTTP_PORT","8084"),
-		KafkaBrokers: parseCSV(env("KAFKA_BROKERS","localhost:9092")),
 		GroupID: env("KAFKA_GROUP_ID","notification-service"),
 		TopicOrders: env("KAFKA_TOPIC_ORDERS","redstone.orders"),
 		TopicInventory: env("KAFKA_TOPIC_INVENTORY","redstone.inventory"),
 		TopicPayments: env("KAFKA_TOPIC_PAYMENTS","redstone.payments"),
 		TopicNotifications: env("KAFKA_TOPIC_NOTIFICATIONS","redstone.notifications"),
+		TracesExporter: env("OTEL_TRACES_EXPORTER","otlp"),
+		OTLPEndpoint: env("OTEL_EXPORTER_OTLP_ENDPOINT",""),
 	}
 	log := redstone.NewLogger(cfg.ServiceName)
+	level, err := redstone.ParseLevel(env("LOG_LEVEL","info"))
+	if err != nil {
+		log.Error("invalid LOG_LEVEL", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	log.SetLevel(level)
+	// Libraries logging through log/slog end up in the service log.
+	slog.SetDefault(slog.New(log.Handler()))
+	kafkaCfg, err := redstone.LoadKafkaConfig(env)
+	if err != nil {
+		log.Error("invalid kafka config", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	cfg.Kafka = kafkaCfg
+	if cfg.RetryDelays, err = parseDurations(env("KAFKA_RETRY_DELAYS","5s,1m,10m")); err != nil {
+		log.Error("invalid KAFKA_RETRY_DELAYS", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.Validation, err = redstone.ParseValidationMode(env("SCHEMA_VALIDATION","warn")); err != nil {
+		log.Error("invalid SCHEMA_VALIDATION", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
 
-	orders := redstone.NewConsumer(cfg.KafkaBrokers, cfg.TopicOrders, cfg.GroupID+"-orders")
-	inv := redstone.NewConsumer(cfg.KafkaBrokers, cfg.TopicInventory, cfg.GroupID+"-inventory")
-	pay := redstone.NewConsumer(cfg.KafkaBrokers, cfg.TopicPayments, cfg.GroupID+"-payments")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownTracing, err := redstone.InitTracing(ctx, redstone.TracingConfig{
+		ServiceName: cfg.ServiceName,
+		Exporter:    cfg.TracesExporter,
+		Endpoint:    cfg.OTLPEndpoint,
+	})
+	if err != nil {
+		log.Error("tracing init failed", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	validator := redstone.NewValidator(cfg.Validation, log)
+	orders := redstone.NewRetryingConsumer(cfg.Kafka, cfg.TopicOrders, cfg.GroupID+"-orders", cfg.RetryDelays)
+	inv := redstone.NewRetryingConsumer(cfg.Kafka, cfg.TopicInventory, cfg.GroupID+"-inventory", cfg.RetryDelays)
+	pay := redstone.NewRetryingConsumer(cfg.Kafka, cfg.TopicPayments, cfg.GroupID+"-payments", cfg.RetryDelays)
+	var topics []string
+	for _, c := range []*redstone.Consumer{orders, inv, pay} {
+		c.SetValidator(validator)
+		topics = append(topics, c.Topics()...)
+	}
 	defer orders.Close(); defer inv.Close(); defer pay.Close()
+	if err := redstone.EnsureTopics(ctx, cfg.Kafka, topics...); err != nil {
+		log.Error("topic check failed", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
 
-	ctx := context.Background()
-	go consume(ctx, log, "orders", orders)
-	go consume(ctx, log, "inventory", inv)
-	go consume(ctx, log, "payments", pay)
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() { defer wg.Done(); f() }()
+	}
+	run(func() { orders.Run(ctx, log, notify(log, "orders")) })
+	run(func() { inv.Run(ctx, log, notify(log, "inventory")) })
+	run(func() { pay.Run(ctx, log, notify(log, "payments")) })
 
 	r := chi.NewRouter()
+	r.Use(redstone.TraceRoutes)
+	r.Use(redstone.MeasureHTTP)
 	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200); w.Write([]byte("ok")) })
+	r.Get("/readyz", redstone.ReadyHandler(map[string]redstone.Check{
+		"consumer_orders": orders.Check,
+		"consumer_inventory": inv.Check,
+		"consumer_payments": pay.Check,
+	}))
+	r.Handle("/metrics", redstone.MetricsHandler())
 
 	srv := &http.Server{
 		Addr: ":" + cfg.HTTPPort,
-		Handler: r,
+		Handler: redstone.TraceHTTP(cfg.ServiceName, r),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
-	log.Info("http server starting", map[string]any{"port": cfg.HTTPPort})
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Error("http server error", map[string]any{"err": err.Error()})
+	go func() {
+		log.Info("http server starting", map[string]any{"port": cfg.HTTPPort})
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("http server error", map[string]any{"err": err.Error()})
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info("shutting down", nil)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Error("http shutdown failed", map[string]any{"err": err.Error()})
 	}
+	// Loops return once their in-flight message is handled and committed;
+	// deferred closes then release the Kafka clients and the exporter.
+	wg.Wait()
 }
 
-func consume(ctx context.Context, log *redstone.Logger, stream string, c *redstone.Consumer) {
-	for {
-		m, err := c.Fetch(ctx)
-		if err != nil {
-			log.Error("consume fetch failed", map[string]any{"err": err.Error(), "stream": stream})
-			time.Sleep(500 * time.Millisecond)
-			continue
-		}
-		var envelope map[string]any
-		if json.Unmarshal(m.Value, &envelope) == nil {
-			et, _ := envelope["event_type"].(string)
-			oid, _ := envelope["order_id"].(string)
-			log.Info("notify", map[string]any{"stream": stream, "event_type": et, "order_id": oid})
-		}
-		_ = c.Commit(ctx, m)
+func notify(log *redstone.Logger, stream string) redstone.Handler {
+	return func(ctx context.Context, m kafka.Message) error {
+		// Messages are keyed by order ID, so nothing needs decoding here
+		md := redstone.MetadataOf(m)
+		// order_id, event_id, correlation_id and trace_id come with ctx
+		log.InfoContext(ctx, "notify", map[string]any{"stream": stream, "event_type": md.EventType, "causation_id": md.CausationID})
+		return nil
 	}
 }
@@ -0,0 +1,307 @@
+// Package archive keeps consumed events beyond Kafka retention as
+// gzip-compressed NDJSON files of redstone.Record, one per topic partition
+// and hour:
+//
+//	<dir>/<topic>/2006/01/02/15/p<partition>-<first offset>-<last offset>.ndjson.gz
+//
+// Every finished file is appended to <dir>/manifest.ndjson with its offsets,
+// time span, checksum and retention date. Files are never modified or
+// deleted by the archiver.
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/redstone/notification-service/internal/redstone"
+)
+
+const ManifestName = "manifest.ndjson"
+
+// Entry describes one archived file in the manifest.
+type Entry struct {
+	File        string    `json:"file"`
+	Topic       string    `json:"topic"`
+	Partition   int       `json:"partition"`
+	FirstOffset int64     `json:"first_offset"`
+	LastOffset  int64     `json:"last_offset"`
+	Count       int       `json:"count"`
+	FirstTime   time.Time `json:"first_time"`
+	LastTime    time.Time `json:"last_time"`
+	Bytes       int64     `json:"bytes"`
+	SHA256      string    `json:"sha256"`
+	ArchivedAt  time.Time `json:"archived_at"`
+	RetainUntil time.Time `json:"retain_until"`
+}
+
+// Writer appends archive files and their manifest entries under one root.
+// It is safe for concurrent use by one Batch per topic.
+type Writer struct {
+	dir         string
+	retainYears int
+
+	mu       sync.Mutex
+	manifest *os.File
+}
+
+// NewWriter opens the archive rooted at dir, creating it if needed. Entries
+// are marked to be kept for retainYears after their last event.
+func NewWriter(dir string, retainYears int) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, ManifestName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{dir: dir, retainYears: retainYears, manifest: f}, nil
+}
+
+func (w *Writer) Close() error { return w.manifest.Close() }
+
+func (w *Writer) record(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.manifest.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return w.manifest.Sync()
+}
+
+type segmentKey struct {
+	partition int
+	hour      time.Time
+}
+
+// segment is one archive file being written.
+type segment struct {
+	f     *os.File
+	gz    *gzip.Writer
+	sum   hashWriter
+	enc   *json.Encoder
+	entry Entry
+}
+
+// hashWriter checksums and counts what goes to the file.
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	hw.n += int64(n)
+	return n, err
+}
+
+// Batch collects the messages of one topic into open files until Flush.
+type Batch struct {
+	w        *Writer
+	segments map[segmentKey]*segment
+	last     map[int]kafka.Message
+}
+
+func (w *Writer) NewBatch() *Batch {
+	return &Batch{w: w, segments: map[segmentKey]*segment{}, last: map[int]kafka.Message{}}
+}
+
+// Len returns the number of messages added since the last Flush.
+func (b *Batch) Len() int {
+	n := 0
+	for _, s := range b.segments {
+		n += s.entry.Count
+	}
+	return n
+}
+
+// Add writes m to the file of its partition and hour.
+func (b *Batch) Add(m kafka.Message) error {
+	t := m.Time.UTC()
+	key := segmentKey{m.Partition, t.Truncate(time.Hour)}
+	s, ok := b.segments[key]
+	if !ok {
+		var err error
+		if s, err = b.open(m.Topic, key); err != nil {
+			return err
+		}
+		s.entry.FirstOffset, s.entry.FirstTime = m.Offset, t
+		b.segments[key] = s
+	}
+	if err := s.enc.Encode(redstone.RecordOf(m)); err != nil {
+		return err
+	}
+	s.entry.LastOffset, s.entry.LastTime = m.Offset, t
+	s.entry.Count++
+	b.last[m.Partition] = m
+	return nil
+}
+
+func (b *Batch) open(topic string, key segmentKey) (*segment, error) {
+	dir := filepath.Join(b.w.dir, topic, key.hour.Format("2006/01/02/15"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, fmt.Sprintf("p%d-*.tmp", key.partition))
+	if err != nil {
+		return nil, err
+	}
+	s := &segment{f: f, entry: Entry{Topic: topic, Partition: key.partition}}
+	s.sum = hashWriter{w: f, h: sha256.New()}
+	s.gz = gzip.NewWriter(&s.sum)
+	s.enc = json.NewEncoder(s.gz)
+	return s, nil
+}
+
+// Flush finishes every open file, durably renames it to its final name and
+// records it in the manifest. It returns the last message added per
+// partition, which the caller may then commit.
+func (b *Batch) Flush() ([]kafka.Message, error) {
+	keys := make([]segmentKey, 0, len(b.segments))
+	for k := range b.segments {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].partition != keys[j].partition {
+			return keys[i].partition < keys[j].partition
+		}
+		return keys[i].hour.Before(keys[j].hour)
+	})
+	for _, k := range keys {
+		if err := b.finish(b.segments[k]); err != nil {
+			return nil, err
+		}
+		delete(b.segments, k)
+	}
+
+	commits := make([]kafka.Message, 0, len(b.last))
+	for _, m := range b.last {
+		commits = append(commits, m)
+	}
+	b.last = map[int]kafka.Message{}
+	return commits, nil
+}
+
+func (b *Batch) finish(s *segment) error {
+	err := s.gz.Close()
+	if err == nil {
+		err = s.f.Sync()
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	e := &s.entry
+	name := fmt.Sprintf("p%d-%d-%d.ndjson.gz", e.Partition, e.FirstOffset, e.LastOffset)
+	final := filepath.Join(filepath.Dir(s.f.Name()), name)
+	if err := os.Rename(s.f.Name(), final); err != nil {
+		return err
+	}
+	if e.File, err = filepath.Rel(b.w.dir, final); err != nil {
+		return err
+	}
+	e.File = filepath.ToSlash(e.File)
+	e.Bytes = s.sum.n
+	e.SHA256 = hex.EncodeToString(s.sum.h.Sum(nil))
+	e.ArchivedAt = time.Now().UTC()
+	e.RetainUntil = e.LastTime.AddDate(b.w.retainYears, 0, 0)
+	return b.w.record(*e)
+}
+
+// ReadManifest returns the entries of the archive rooted at dir, ordered by
+// topic, partition and offset.
+func ReadManifest(dir string) ([]Entry, error) {
+	f, err := os.Open(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []Entry
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", ManifestName, line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		if a.Partition != b.Partition {
+			return a.Partition < b.Partition
+		}
+		return a.FirstOffset < b.FirstOffset
+	})
+	return entries, nil
+}
+
+var ErrChecksum = errors.New("archive file checksum mismatch")
+
+// ReadFile verifies the checksum of e's file, then passes its records to fn
+// in order.
+func ReadFile(dir string, e Entry, fn func(redstone.Record) error) error {
+	path := filepath.Join(dir, filepath.FromSlash(e.File))
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != e.SHA256 {
+		return fmt.Errorf("%s: %w", e.File, ErrChecksum)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", e.File, err)
+	}
+	dec := json.NewDecoder(gz)
+	for {
+		var r redstone.Record
+		if err := dec.Decode(&r); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", e.File, err)
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+}
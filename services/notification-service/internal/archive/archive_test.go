@@ -0,0 +1,254 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/redstone/notification-service/internal/redstone"
+)
+
+var hour = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+// messages returns the test messages of topic t: partition 0 spans two
+// hours, partition 1 one, and one value is not JSON.
+func messages() []kafka.Message {
+	msg := func(p int, off int64, at time.Time, value string) kafka.Message {
+		return kafka.Message{
+			Topic:     "t",
+			Partition: p,
+			Offset:    off,
+			Time:      at,
+			Key:       []byte(fmt.Sprint("ord_", off)),
+			Value:     []byte(value),
+			Headers:   []kafka.Header{{Key: "event_id", Value: []byte(fmt.Sprint("e", p, off))}},
+		}
+	}
+	return []kafka.Message{
+		msg(0, 0, hour.Add(10*time.Minute), `{"event_type":"OrderCreated"}`),
+		msg(1, 4, hour.Add(20*time.Minute), `{"event_type":"OrderCreated"}`),
+		msg(0, 1, hour.Add(59*time.Minute), "\x0a\x02pb"),
+		// Times are archived in UTC whatever the zone they come in.
+		msg(0, 2, hour.Add(time.Hour).In(time.FixedZone("IST", 5*3600+1800)), `{"event_type":"OrderCancelled"}`),
+		msg(1, 5, hour.Add(30*time.Minute), `{"event_type":"OrderCancelled"}`),
+	}
+}
+
+func write(t *testing.T, dir string, msgs []kafka.Message) []kafka.Message {
+	t.Helper()
+	w, err := NewWriter(dir, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	b := w.NewBatch()
+	for _, m := range msgs {
+		if err := b.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.Len() != len(msgs) {
+		t.Fatalf("batch holds %d messages, want %d", b.Len(), len(msgs))
+	}
+	commits, err := b.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("batch holds %d messages after flush", b.Len())
+	}
+	return commits
+}
+
+func TestWriteManifest(t *testing.T) {
+	dir := t.TempDir()
+	commits := write(t, dir, messages())
+
+	last := map[int]int64{}
+	for _, m := range commits {
+		last[m.Partition] = m.Offset
+	}
+	if fmt.Sprint(last) != "map[0:2 1:5]" {
+		t.Errorf("commits %v, want the last offset of each partition", last)
+	}
+
+	entries, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		file          string
+		first, last   int64
+		count         int
+		firstT, lastT time.Time
+	}{
+		{"t/2024/05/01/10/p0-0-1.ndjson.gz", 0, 1, 2, hour.Add(10 * time.Minute), hour.Add(59 * time.Minute)},
+		{"t/2024/05/01/11/p0-2-2.ndjson.gz", 2, 2, 1, hour.Add(time.Hour), hour.Add(time.Hour)},
+		{"t/2024/05/01/10/p1-4-5.ndjson.gz", 4, 5, 2, hour.Add(20 * time.Minute), hour.Add(30 * time.Minute)},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("%d manifest entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, e := range entries {
+		w := want[i]
+		if e.File != w.file || e.Topic != "t" || e.FirstOffset != w.first || e.LastOffset != w.last || e.Count != w.count {
+			t.Errorf("entry %d: %+v, want %+v", i, e, w)
+		}
+		if !e.FirstTime.Equal(w.firstT) || !e.LastTime.Equal(w.lastT) {
+			t.Errorf("entry %d: times %v..%v, want %v..%v", i, e.FirstTime, e.LastTime, w.firstT, w.lastT)
+		}
+		if !e.RetainUntil.Equal(w.lastT.AddDate(7, 0, 0)) {
+			t.Errorf("entry %d: retain until %v", i, e.RetainUntil)
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, e.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(b)
+		if e.SHA256 != hex.EncodeToString(sum[:]) || e.Bytes != int64(len(b)) {
+			t.Errorf("entry %d: sha256 %s, %d bytes; file has %x, %d bytes", i, e.SHA256, e.Bytes, sum, len(b))
+		}
+	}
+
+	// Only finished files are left behind.
+	var files []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if fmt.Sprint(files) != "[manifest.ndjson t/2024/05/01/10/p0-0-1.ndjson.gz t/2024/05/01/10/p1-4-5.ndjson.gz t/2024/05/01/11/p0-2-2.ndjson.gz]" {
+		t.Errorf("files %v", files)
+	}
+}
+
+// The files are plain gzip NDJSON, one record per line, readable without
+// this package.
+func TestFileContents(t *testing.T) {
+	dir := t.TempDir()
+	msgs := messages()
+	write(t, dir, msgs)
+
+	f, err := os.Open(filepath.Join(dir, "t/2024/05/01/10/p0-0-1.ndjson.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []map[string]any
+	sc := bufio.NewScanner(gz)
+	for sc.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("%d lines, want 2", len(lines))
+	}
+	if v, ok := lines[0]["value"].(map[string]any); !ok || v["event_type"] != "OrderCreated" || lines[0]["key"] != "ord_0" || lines[0]["time"] != "2024-05-01T10:10:00Z" {
+		t.Errorf("line 1: %v", lines[0])
+	}
+	if lines[1]["value_base64"] != "CgJwYg==" || lines[1]["value"] != nil {
+		t.Errorf("line 2: %v, want the protobuf value base64-encoded", lines[1])
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	msgs := messages()
+	write(t, dir, msgs)
+	entries, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []kafka.Message
+	for _, e := range entries {
+		if err := ReadFile(dir, e, func(r redstone.Record) error {
+			got = append(got, r.Message())
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// In manifest order: partition 0 by hour, then partition 1.
+	want := []kafka.Message{msgs[0], msgs[2], msgs[3], msgs[1], msgs[4]}
+	if len(got) != len(want) {
+		t.Fatalf("read %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		w := want[i]
+		w.Time = w.Time.UTC()
+		if !reflect.DeepEqual(got[i], w) {
+			t.Errorf("message %d:\n got %+v\nwant %+v", i, got[i], w)
+		}
+	}
+}
+
+func TestReadFileChecksum(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, messages())
+	entries, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := entries[0]
+	path := filepath.Join(dir, e.File)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	err = ReadFile(dir, e, func(redstone.Record) error { called = true; return nil })
+	if !errors.Is(err, ErrChecksum) {
+		t.Fatalf("got %v, want ErrChecksum", err)
+	}
+	if called {
+		t.Fatal("records of a corrupt file were passed on")
+	}
+}
+
+// A second writer on the same directory appends to the manifest.
+func TestWriterAppends(t *testing.T) {
+	dir := t.TempDir()
+	msgs := messages()
+	write(t, dir, msgs[:2])
+	write(t, dir, msgs[2:])
+	entries, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, e := range entries {
+		files = append(files, e.File)
+	}
+	if fmt.Sprint(files) != "[t/2024/05/01/10/p0-0-0.ndjson.gz t/2024/05/01/10/p0-1-1.ndjson.gz t/2024/05/01/11/p0-2-2.ndjson.gz t/2024/05/01/10/p1-4-4.ndjson.gz t/2024/05/01/10/p1-5-5.ndjson.gz]" {
+		t.Errorf("manifest files %v", files)
+	}
+}
@@ -0,0 +1,205 @@
+package redstone
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// jsonValue decodes b keeping numbers exact, for comparing documents
+// regardless of key order.
+func jsonValue(t *testing.T, b []byte) any {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	return v
+}
+
+func headerMap(hs []kafka.Header) map[string]string {
+	out := map[string]string{}
+	for _, h := range hs {
+		out[h.Key] = string(h.Value)
+	}
+	return out
+}
+
+// Every event goes to a CloudEvent in both modes and back to the identical
+// Redstone envelope, keeping the Redstone headers.
+func TestCloudEventRoundTrip(t *testing.T) {
+	for _, ev := range sampleEvents() {
+		base, _ := baseOf(ev)
+		payload := []byte(mustMarshal(t, ev))
+		for _, format := range []EventFormat{FormatCloudEventsStructured, FormatCloudEventsBinary} {
+			name := fmt.Sprintf("%s %s", base.EventType, format)
+			value, headers, err := toCloudEvent(format, "/redstone/test", "o1", payload, eventHeaders(base))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			m, err := fromCloudEvent(kafka.Message{Key: []byte("o1"), Value: value, Headers: headers})
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !reflect.DeepEqual(jsonValue(t, m.Value), jsonValue(t, payload)) {
+				t.Errorf("%s: got\n%s\nwant\n%s", name, m.Value, payload)
+			}
+			if !reflect.DeepEqual(m.Headers, eventHeaders(base)) {
+				t.Errorf("%s: headers %v, want only the Redstone headers", name, m.Headers)
+			}
+			var back struct {
+				SchemaVersion json.RawMessage `json:"schema_version"`
+			}
+			if err := json.Unmarshal(m.Value, &back); err != nil || string(back.SchemaVersion) != fmt.Sprint(SchemaVersion) {
+				t.Errorf("%s: schema_version %s, want the number %d", name, back.SchemaVersion, SchemaVersion)
+			}
+		}
+	}
+}
+
+func TestToCloudEventStructured(t *testing.T) {
+	ev := sampleEvents()[0]
+	base, _ := baseOf(ev)
+	value, headers, err := toCloudEvent(FormatCloudEventsStructured, "/redstone/order-service", "o1", []byte(mustMarshal(t, ev)), eventHeaders(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(value, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for attr, want := range map[string]string{
+		"specversion":     `"1.0"`,
+		"source":          `"/redstone/order-service"`,
+		"subject":         `"o1"`,
+		"datacontenttype": `"application/json"`,
+		"id":              `"e1"`,
+		"type":            `"OrderCreated"`,
+		"time":            `"2024-05-06T07:08:09.123456789Z"`,
+		"correlationid":   `"c1"`,
+		"causationid":     `"e0"`,
+		"schemaversion":   fmt.Sprint(SchemaVersion),
+	} {
+		if got := string(doc[attr]); got != want {
+			t.Errorf("%s = %s, want %s", attr, got, want)
+		}
+	}
+	var data map[string]any
+	if err := json.Unmarshal(doc["data"], &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["order_id"] != "o1" || data["event_id"] != nil || data["schema_version"] != nil {
+		t.Errorf("data %v, want the event fields without the envelope", data)
+	}
+	if h := headerMap(headers); h[headerContentType] != cloudEventsContentType || h[HeaderEventID] != "e1" {
+		t.Errorf("headers %v", h)
+	}
+}
+
+func TestToCloudEventBinary(t *testing.T) {
+	ev := sampleEvents()[0]
+	base, _ := baseOf(ev)
+	value, headers, err := toCloudEvent(FormatCloudEventsBinary, "/redstone/order-service", "o1", []byte(mustMarshal(t, ev)), eventHeaders(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := headerMap(headers)
+	for key, want := range map[string]string{
+		"ce_specversion":   "1.0",
+		"ce_source":        "/redstone/order-service",
+		"ce_subject":       "o1",
+		"ce_id":            "e1",
+		"ce_type":          "OrderCreated",
+		"ce_time":          "2024-05-06T07:08:09.123456789Z",
+		"ce_correlationid": "c1",
+		"ce_causationid":   "e0",
+		// Header values are strings, the version included.
+		"ce_schemaversion":  fmt.Sprint(SchemaVersion),
+		headerContentType:   "application/json",
+		HeaderEventType:     "OrderCreated",
+		HeaderSchemaVersion: fmt.Sprint(SchemaVersion),
+	} {
+		if h[key] != want {
+			t.Errorf("header %s = %q, want %q", key, h[key], want)
+		}
+	}
+	if _, ok := h["ce_datacontenttype"]; ok {
+		t.Error("datacontenttype sent as ce_ header, want content-type")
+	}
+	var data map[string]any
+	if err := json.Unmarshal(value, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["order_id"] != "o1" || data["event_type"] != nil {
+		t.Errorf("value %v, want the event fields without the envelope", data)
+	}
+}
+
+// Without a subject the CloudEvent has no subject attribute.
+func TestToCloudEventNoKey(t *testing.T) {
+	value, _, err := toCloudEvent(FormatCloudEventsStructured, "/s", "", []byte(`{"event_id":"e1"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(value), "subject") {
+		t.Errorf("got %s", value)
+	}
+}
+
+// Messages that are not CloudEvents, JSON or protobuf, are not touched.
+func TestFromCloudEventPassesRedstoneThrough(t *testing.T) {
+	ev := sampleEvents()[1]
+	base, _ := baseOf(ev)
+	for _, contentType := range []string{"application/json", "application/x-protobuf"} {
+		in := kafka.Message{
+			Topic:   "redstone.inventory",
+			Key:     []byte("o1"),
+			Value:   []byte(mustMarshal(t, ev)),
+			Headers: append(eventHeaders(base), kafka.Header{Key: headerContentType, Value: []byte(contentType)}),
+		}
+		want := in
+		want.Headers = append([]kafka.Header(nil), in.Headers...)
+		got, err := fromCloudEvent(in)
+		if err != nil {
+			t.Fatalf("%s: %v", contentType, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", contentType, got, want)
+		}
+	}
+	// No headers at all, e.g. events written before formats existed.
+	in := kafka.Message{Value: []byte(`{"event_id":"e1"}`)}
+	if got, err := fromCloudEvent(in); err != nil || !reflect.DeepEqual(got, in) {
+		t.Errorf("got %+v, %v", got, err)
+	}
+}
+
+func TestFromCloudEventErrors(t *testing.T) {
+	ce := func(value string, headers ...string) kafka.Message {
+		m := kafka.Message{Value: []byte(value)}
+		for i := 0; i < len(headers); i += 2 {
+			m.Headers = append(m.Headers, kafka.Header{Key: headers[i], Value: []byte(headers[i+1])})
+		}
+		return m
+	}
+	for _, c := range []struct {
+		m   kafka.Message
+		err string
+	}{
+		{ce(`not json`, headerContentType, cloudEventsContentType), "cloudevent:"},
+		{ce(`{"specversion":"1.0","data":[1]}`, headerContentType, cloudEventsContentType), "cloudevent data"},
+		{ce(`{}`, "ce_specversion", "1.0", "ce_schemaversion", "two"), "cloudevent schemaversion"},
+		{ce(`"x"`, "ce_specversion", "1.0"), "cloudevent data"},
+	} {
+		if _, err := fromCloudEvent(c.m); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s %v: got %v, want an error about %s", c.m.Value, c.m.Headers, err, c.err)
+		}
+	}
+}
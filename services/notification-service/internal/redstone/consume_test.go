@@ -0,0 +1,194 @@
+package redstone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func headerValues(m kafka.Message, key string) []string {
+	var out []string
+	for _, h := range m.Headers {
+		if h.Key == key {
+			out = append(out, string(h.Value))
+		}
+	}
+	return out
+}
+
+// attempt is one call of a handler.
+type attempt struct {
+	m  kafka.Message
+	at time.Time
+}
+
+// runRetrying runs a retrying consumer of topic t on b with h until stop is
+// called, recording every call.
+func runRetrying(b *MemoryBroker, delays []time.Duration, h func(n int) error) (calls func() []attempt, stop func()) {
+	var mu sync.Mutex
+	var seen []attempt
+	c := b.RetryingConsumer("t", "g", delays)
+	stop = runWorkers(c, 1, func(_ context.Context, m kafka.Message) error {
+		mu.Lock()
+		seen = append(seen, attempt{m, time.Now()})
+		n := len(seen)
+		mu.Unlock()
+		return h(n)
+	})
+	return func() []attempt {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]attempt(nil), seen...)
+	}, stop
+}
+
+func waitMessages(t *testing.T, ctx context.Context, b *MemoryBroker, topic string, n int) []kafka.Message {
+	t.Helper()
+	waitFor(t, ctx, fmt.Sprintf("%d messages on %s", n, topic), func() bool { return len(b.Messages(topic)) >= n })
+	return b.Messages(topic)
+}
+
+// A retryable failure moves through every tier, each after its delay, and
+// then to the dead-letter topic with the failure recorded in headers.
+func TestRetryTiersThenDeadLetter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := NewMemoryBroker(1)
+	delays := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond}
+	m := kafka.Message{Key: []byte("o1"), Value: []byte("{}"), Headers: []kafka.Header{{Key: "h", Value: []byte("v")}}}
+	if err := b.Producer("t").WriteMessage(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	calls, stop := runRetrying(b, delays, func(n int) error {
+		return Retryable(fmt.Errorf("db down %d", n))
+	})
+	defer stop()
+	dlq := waitMessages(t, ctx, b, DeadLetterTopic("t", "g"), 1)
+
+	got := calls()
+	wantTopics := []string{"t", RetryTopic("t", "g", delays[0]), RetryTopic("t", "g", delays[1])}
+	if len(got) != len(wantTopics) {
+		t.Fatalf("handled %d times, want %d", len(got), len(wantTopics))
+	}
+	for i, a := range got {
+		if a.m.Topic != wantTopics[i] {
+			t.Errorf("attempt %d on %s, want %s", i, a.m.Topic, wantTopics[i])
+		}
+		// Handlers see the normalized envelope on every hop.
+		if string(a.m.Key) != "o1" || string(a.m.Value) != string(got[0].m.Value) || fmt.Sprint(headerValues(a.m, "h")) != "[v]" {
+			t.Errorf("attempt %d: %+v", i, a.m)
+		}
+		if i == 0 {
+			continue
+		}
+		if wait := a.at.Sub(got[i-1].at); wait < delays[i-1] {
+			t.Errorf("attempt %d after %v, want at least %v", i, wait, delays[i-1])
+		}
+		if v := headerValues(a.m, headerRetryAttempt); fmt.Sprint(v) != fmt.Sprintf("[%d]", i) {
+			t.Errorf("attempt %d: retry attempt %v", i, v)
+		}
+		if v := headerValues(a.m, headerOriginalTopic); fmt.Sprint(v) != "[t]" {
+			t.Errorf("attempt %d: original topic %v", i, v)
+		}
+		if v := headerValues(a.m, headerError); fmt.Sprint(v) != fmt.Sprintf("[db down %d]", i) {
+			t.Errorf("attempt %d: error %v", i, v)
+		}
+		if len(headerValues(a.m, headerRetryNotBefore)) != 1 {
+			t.Errorf("attempt %d: no single not-before header", i)
+		}
+	}
+
+	d := dlq[0]
+	for key, want := range map[string]string{
+		headerOriginalTopic:  "[t]",
+		headerRetryAttempt:   "[2]",
+		headerError:          "[db down 3]",
+		headerRetryNotBefore: "[]",
+		"h":                  "[v]",
+	} {
+		if got := fmt.Sprint(headerValues(d, key)); got != want {
+			t.Errorf("dead letter %s = %s, want %s", key, got, want)
+		}
+	}
+	if string(d.Key) != "o1" || string(d.Value) != string(got[0].m.Value) {
+		t.Errorf("dead letter %+v", d)
+	}
+}
+
+// A permanent failure skips the retry tiers.
+func TestPermanentFailureDeadLetters(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := NewMemoryBroker(1)
+	delays := []time.Duration{time.Millisecond, time.Millisecond}
+	writeKeyed(t, ctx, b.Producer("t"), "o1")
+
+	calls, stop := runRetrying(b, delays, func(int) error { return errors.New("bad event") })
+	defer stop()
+	d := waitMessages(t, ctx, b, DeadLetterTopic("t", "g"), 1)[0]
+	if n := len(calls()); n != 1 {
+		t.Fatalf("handled %d times, want 1", n)
+	}
+	for _, d := range delays {
+		if n := len(b.Messages(RetryTopic("t", "g", d))); n != 0 {
+			t.Errorf("%d messages on retry tier %v", n, d)
+		}
+	}
+	if fmt.Sprint(headerValues(d, headerRetryAttempt)) != "[0]" || fmt.Sprint(headerValues(d, headerError)) != "[bad event]" {
+		t.Errorf("dead letter headers %v", d.Headers)
+	}
+	waitFor(t, ctx, "source committed", func() bool { return committedOffset(b, "t", "g", 0) == 1 })
+}
+
+// A message that succeeds on a retry tier is committed there and never
+// reaches the dead-letter topic.
+func TestRetrySucceeds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := NewMemoryBroker(1)
+	delays := []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}
+	writeKeyed(t, ctx, b.Producer("t"), "o1")
+
+	_, stop := runRetrying(b, delays, func(n int) error {
+		if n == 1 {
+			return Retryable(errors.New("db down"))
+		}
+		return nil
+	})
+	defer stop()
+	tier := RetryTopic("t", "g", delays[0])
+	waitFor(t, ctx, "retry committed", func() bool { return committedOffset(b, tier, "g", 0) == 1 })
+	if n := committedOffset(b, "t", "g", 0); n != 1 {
+		t.Errorf("source committed %d, want 1", n)
+	}
+	if n := len(b.Messages(DeadLetterTopic("t", "g"))); n != 0 {
+		t.Errorf("%d dead letters", n)
+	}
+}
+
+func TestWaitNotBefore(t *testing.T) {
+	at := func(d time.Duration) kafka.Message {
+		return kafka.Message{Headers: []kafka.Header{{Key: headerRetryNotBefore, Value: []byte(fmt.Sprint(time.Now().Add(d).UnixMilli()))}}}
+	}
+	start := time.Now()
+	if !waitNotBefore(context.Background(), at(80*time.Millisecond)) {
+		t.Fatal("wait interrupted")
+	}
+	if waited := time.Since(start); waited < 70*time.Millisecond {
+		t.Fatalf("waited %v, want about 80ms", waited)
+	}
+	if !waitNotBefore(context.Background(), at(-time.Hour)) || !waitNotBefore(context.Background(), kafka.Message{}) {
+		t.Fatal("due message held back")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if waitNotBefore(ctx, at(time.Hour)) {
+		t.Fatal("wait not interrupted by cancellation")
+	}
+}
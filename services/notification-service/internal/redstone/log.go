@@ -1,36 +1,215 @@
 package redstone
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"sync"
 	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Logger writes one JSON object per line to stdout. Entries below the
+// minimum level, Info unless set, are dropped. The *Context methods also add
+// the fields attached to ctx with WithLogFields and the trace ID.
 type Logger struct {
 	Service string
+
+	level slog.LevelVar
+	mu    sync.Mutex
+	out   io.Writer
 }
 
 func NewLogger(service string) *Logger {
-	return &Logger{Service: service}
+	return &Logger{Service: service, out: os.Stdout}
+}
+
+// ParseLevel reads a minimum level: debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+// SetLevel drops entries below l from then on.
+func (l *Logger) SetLevel(level slog.Level) { l.level.Set(level) }
+
+func (l *Logger) Debug(msg string, fields map[string]any) {
+	l.emit(context.Background(), slog.LevelDebug, msg, fields)
 }
 
 func (l *Logger) Info(msg string, fields map[string]any) {
-	l.emit("INFO", msg, fields)
+	l.emit(context.Background(), slog.LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields map[string]any) {
+	l.emit(context.Background(), slog.LevelWarn, msg, fields)
 }
 
 func (l *Logger) Error(msg string, fields map[string]any) {
-	l.emit("ERROR", msg, fields)
+	l.emit(context.Background(), slog.LevelError, msg, fields)
+}
+
+func (l *Logger) DebugContext(ctx context.Context, msg string, fields map[string]any) {
+	l.emit(ctx, slog.LevelDebug, msg, fields)
+}
+
+func (l *Logger) InfoContext(ctx context.Context, msg string, fields map[string]any) {
+	l.emit(ctx, slog.LevelInfo, msg, fields)
+}
+
+func (l *Logger) WarnContext(ctx context.Context, msg string, fields map[string]any) {
+	l.emit(ctx, slog.LevelWarn, msg, fields)
+}
+
+func (l *Logger) ErrorContext(ctx context.Context, msg string, fields map[string]any) {
+	l.emit(ctx, slog.LevelError, msg, fields)
+}
+
+func (l *Logger) enabled(level slog.Level) bool {
+	return level >= l.level.Level()
+}
+
+func (l *Logger) emit(ctx context.Context, level slog.Level, msg string, fields map[string]any) {
+	if l.enabled(level) {
+		l.write(ctx, level, msg, fields, time.Now())
+	}
+}
+
+// write builds the entry from ctx's fields, then fields, then the standard
+// keys, so explicit fields override context ones; fields is not modified.
+func (l *Logger) write(ctx context.Context, level slog.Level, msg string, fields map[string]any, t time.Time) {
+	ctxFields, _ := ctx.Value(logFieldsKey{}).(map[string]any)
+	entry := make(map[string]any, len(ctxFields)+len(fields)+5)
+	for k, v := range ctxFields {
+		entry[k] = v
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		entry["trace_id"] = sc.TraceID().String()
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["level"] = level.String()
+	entry["msg"] = msg
+	entry["service"] = l.Service
+	entry["ts"] = t.UTC().Format(time.RFC3339Nano)
+	b, _ := json.Marshal(entry)
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := l.out
+	if out == nil {
+		out = os.Stdout
+	}
+	_, _ = out.Write(b)
+}
+
+type logFieldsKey struct{}
+
+// WithLogFields returns a copy of ctx whose fields, merged over those
+// already attached, are added to every entry logged with it.
+func WithLogFields(ctx context.Context, fields map[string]any) context.Context {
+	prev, _ := ctx.Value(logFieldsKey{}).(map[string]any)
+	merged := make(map[string]any, len(prev)+len(fields))
+	for k, v := range prev {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, logFieldsKey{}, merged)
+}
+
+// withEventFields attaches the identifiers of the event in m.
+func withEventFields(ctx context.Context, m kafka.Message) context.Context {
+	md := MetadataOf(m)
+	fields := make(map[string]any, 3)
+	for k, v := range map[string]string{"correlation_id": md.CorrelationID, "order_id": md.Key, "event_id": md.EventID} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	return WithLogFields(ctx, fields)
+}
+
+// Handler returns a slog.Handler that logs through l, for libraries that
+// use log/slog. Attributes become fields; groups prefix their keys with
+// "group.".
+func (l *Logger) Handler() slog.Handler {
+	return &slogHandler{l: l}
+}
+
+type slogHandler struct {
+	l      *Logger
+	attrs  map[string]any
+	prefix string
+}
+
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.l.enabled(level)
+}
+
+func (h *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	fields := make(map[string]any, len(h.attrs)+r.NumAttrs())
+	for k, v := range h.attrs {
+		fields[k] = v
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(fields, h.prefix, a)
+		return true
+	})
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	h.l.write(ctx, r.Level, r.Message, fields, t)
+	return nil
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := &slogHandler{l: h.l, prefix: h.prefix, attrs: make(map[string]any, len(h.attrs)+len(attrs))}
+	for k, v := range h.attrs {
+		out.attrs[k] = v
+	}
+	for _, a := range attrs {
+		addAttr(out.attrs, h.prefix, a)
+	}
+	return out
 }
 
-func (l *Logger) emit(level, msg string, fields map[string]any) {
-	if fields == nil {
-		fields = map[string]any{}
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &slogHandler{l: h.l, attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+func addAttr(fields map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			addAttr(fields, prefix, ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	switch x := v.Any().(type) {
+	case error:
+		fields[prefix+a.Key] = x.Error()
+	case time.Duration:
+		fields[prefix+a.Key] = x.String()
+	default:
+		fields[prefix+a.Key] = x
 	}
-	fields["level"] = level
-	fields["msg"] = msg
-	fields["service"] = l.Service
-	fields["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
-	b, _ := json.Marshal(fields)
-	log.New(os.Stdout, "", 0).Println(string(b))
 }
@@ -0,0 +1,241 @@
+package redstone
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// MemoryBroker is an in-process stand-in for Kafka, for tests and local
+// runs. Topics are created on first use with a fixed partition count,
+// messages are partitioned by key like the Kafka producer, and each consumer
+// group divides a topic's partitions between its members and resumes from
+// its committed offsets.
+type MemoryBroker struct {
+	mu         sync.Mutex
+	partitions int
+	topics     map[string][][]kafka.Message
+	groups     map[groupTopic]*memoryGroup
+	// changed is closed and replaced whenever a fetch could make progress.
+	changed chan struct{}
+}
+
+type groupTopic struct {
+	group, topic string
+}
+
+type memoryGroup struct {
+	committed  []int64
+	members    []*memoryReader
+	generation int
+}
+
+// NewMemoryBroker returns an empty broker whose topics have partitions
+// partitions each.
+func NewMemoryBroker(partitions int) *MemoryBroker {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &MemoryBroker{
+		partitions: partitions,
+		topics:     make(map[string][][]kafka.Message),
+		groups:     make(map[groupTopic]*memoryGroup),
+		changed:    make(chan struct{}),
+	}
+}
+
+// Producer returns a producer publishing to topic on b.
+func (b *MemoryBroker) Producer(topic string) *Producer {
+	return &Producer{w: &memoryWriter{b: b, topic: topic}, topic: topic}
+}
+
+// Consumer returns a consumer reading topic on b as a member of groupID.
+func (b *MemoryBroker) Consumer(topic, groupID string) *Consumer {
+	r := &memoryReader{b: b, topic: topic, group: groupID}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.group(topic, groupID)
+	g.members = append(g.members, r)
+	g.generation++
+	b.broadcast()
+	return &Consumer{r: r}
+}
+
+// RetryingConsumer is NewRetryingConsumer on b.
+func (b *MemoryBroker) RetryingConsumer(topic, groupID string, delays []time.Duration) *Consumer {
+	return withRetries(topic, groupID, delays,
+		func(t string) *Consumer { return b.Consumer(t, groupID) },
+		b.Producer)
+}
+
+// Messages returns a copy of every message published to topic, partition by
+// partition.
+func (b *MemoryBroker) Messages(topic string) []kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []kafka.Message
+	for _, p := range b.topics[topic] {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// topic returns the partitions of name, creating it if needed. b.mu must be
+// held.
+func (b *MemoryBroker) topic(name string) [][]kafka.Message {
+	t, ok := b.topics[name]
+	if !ok {
+		t = make([][]kafka.Message, b.partitions)
+		b.topics[name] = t
+	}
+	return t
+}
+
+// group returns the state of groupID on topic. b.mu must be held.
+func (b *MemoryBroker) group(topic, groupID string) *memoryGroup {
+	k := groupTopic{groupID, topic}
+	g, ok := b.groups[k]
+	if !ok {
+		g = &memoryGroup{committed: make([]int64, b.partitions)}
+		b.groups[k] = g
+	}
+	return g
+}
+
+// broadcast wakes all waiting fetches. b.mu must be held.
+func (b *MemoryBroker) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+type memoryWriter struct {
+	b        *MemoryBroker
+	topic    string
+	balancer kafka.Hash
+}
+
+func (w *memoryWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w.b.mu.Lock()
+	defer w.b.mu.Unlock()
+	t := w.b.topic(w.topic)
+	partitions := make([]int, len(t))
+	for i := range partitions {
+		partitions[i] = i
+	}
+	for _, m := range msgs {
+		p := w.balancer.Balance(m, partitions...)
+		m.Topic = w.topic
+		m.Partition = p
+		m.Offset = int64(len(t[p]))
+		if m.Time.IsZero() {
+			m.Time = time.Now()
+		}
+		t[p] = append(t[p], m)
+	}
+	w.b.broadcast()
+	return nil
+}
+
+func (w *memoryWriter) Close() error { return nil }
+
+type memoryReader struct {
+	b            *MemoryBroker
+	topic, group string
+
+	// Guarded by b.mu.
+	generation int
+	next       map[int]int64
+	cursor     int
+	closed     bool
+}
+
+// FetchMessage returns the next message of a partition assigned to r,
+// blocking until one is available or ctx is done. Partitions are assigned
+// round-robin over the group's members; any change of membership restarts
+// every member from the committed offsets, like a Kafka rebalance.
+func (r *memoryReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		r.b.mu.Lock()
+		if r.closed {
+			r.b.mu.Unlock()
+			return kafka.Message{}, io.EOF
+		}
+		g := r.b.group(r.topic, r.group)
+		if r.generation != g.generation {
+			r.generation = g.generation
+			r.next = make(map[int]int64)
+			for p := range g.committed {
+				if memberFor(g, p) == r {
+					r.next[p] = g.committed[p]
+				}
+			}
+		}
+		t := r.b.topic(r.topic)
+		for i := 0; i < len(t); i++ {
+			p := (r.cursor + i) % len(t)
+			off, ok := r.next[p]
+			if !ok || off >= int64(len(t[p])) {
+				continue
+			}
+			m := t[p][off]
+			m.HighWaterMark = int64(len(t[p]))
+			r.next[p] = off + 1
+			r.cursor = p + 1
+			r.b.mu.Unlock()
+			return m, nil
+		}
+		changed := r.b.changed
+		r.b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func memberFor(g *memoryGroup, partition int) *memoryReader {
+	return g.members[partition%len(g.members)]
+}
+
+func (r *memoryReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.b.mu.Lock()
+	defer r.b.mu.Unlock()
+	g := r.b.group(r.topic, r.group)
+	for _, m := range msgs {
+		if m.Offset+1 > g.committed[m.Partition] {
+			g.committed[m.Partition] = m.Offset + 1
+		}
+	}
+	return nil
+}
+
+func (r *memoryReader) Config() kafka.ReaderConfig {
+	return kafka.ReaderConfig{Topic: r.topic, GroupID: r.group}
+}
+
+func (r *memoryReader) Close() error {
+	r.b.mu.Lock()
+	defer r.b.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	g := r.b.group(r.topic, r.group)
+	for i, m := range g.members {
+		if m == r {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.generation++
+	r.b.broadcast()
+	return nil
+}
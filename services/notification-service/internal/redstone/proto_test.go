@@ -0,0 +1,166 @@
+package redstone
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoSchema compiles the checked-in events.proto, the contract proto.go
+// encodes by hand.
+func protoSchema(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	c := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			ImportPaths: []string{filepath.Join("..", "..", "..", "..", "schemas", "events", "v2")},
+		}),
+	}
+	files, err := c.Compile(context.Background(), "events.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files[0]
+}
+
+// sampleEvents has one event of every type with every field set.
+func sampleEvents() []any {
+	base := BaseEvent{
+		EventID:       "e1",
+		SchemaVersion: SchemaVersion,
+		OccurredAt:    time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC),
+		CorrelationID: "c1",
+		CausationID:   "e0",
+	}
+	return []any{
+		NewOrderCreated(base, "o1", "u1", []OrderItem{{SKU: "A", Qty: 2, UnitPrice: 150}, {SKU: "B", Qty: 1, UnitPrice: 9_000_000_000}}, "USD"),
+		NewInventoryReserved(base, "o1", 9_000_000_300),
+		NewInventoryFailed(base, "o1", "out of stock"),
+		NewPaymentCaptured(base, "o1", 300),
+		NewPaymentFailed(base, "o1", "declined"),
+		NewOrderConfirmed(base, "o1"),
+		NewOrderCancelled(base, "o1", "declined"),
+	}
+}
+
+// The hand-written encoding must be exactly what events.proto describes:
+// the descriptor decodes it with no unknown fields and the same values as
+// the JSON form, and what a protobuf library encodes decodes back the same.
+func TestProtoMatchesSchema(t *testing.T) {
+	fd := protoSchema(t)
+	for _, ev := range sampleEvents() {
+		base, _ := baseOf(ev)
+		t.Run(base.EventType, func(t *testing.T) {
+			md := fd.Messages().ByName(protoreflect.Name(base.EventType))
+			if md == nil {
+				t.Fatalf("%s missing from events.proto", base.EventType)
+			}
+			b, err := ProtobufCodec.Marshal(ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := dynamicpb.NewMessage(md)
+			if err := proto.Unmarshal(b, msg); err != nil {
+				t.Fatal(err)
+			}
+			assertNoUnknown(t, msg)
+
+			pj, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jj, err := json.Marshal(ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, want := flatJSON(t, pj), flatJSON(t, jj)
+			if g, w := mustMarshal(t, got), mustMarshal(t, want); g != w {
+				t.Fatalf("events.proto reads\n%s\nwant\n%s", g, w)
+			}
+
+			lib, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			back, err := newProtoEvent(base.EventType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ProtobufCodec.Unmarshal(lib, back); err != nil {
+				t.Fatal(err)
+			}
+			if g := mustMarshal(t, back); g != string(jj) {
+				t.Fatalf("decoded\n%s\nwant\n%s", g, jj)
+			}
+		})
+	}
+}
+
+func assertNoUnknown(t *testing.T, m protoreflect.Message) {
+	t.Helper()
+	if len(m.GetUnknown()) > 0 {
+		t.Fatalf("%s: fields unknown to events.proto", m.Descriptor().FullName())
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			for i := 0; i < v.List().Len(); i++ {
+				assertNoUnknown(t, v.List().Get(i).Message())
+			}
+		case fd.Message() != nil && !fd.IsMap():
+			assertNoUnknown(t, v.Message())
+		}
+		return true
+	})
+}
+
+// flatJSON decodes a JSON event, lifts the protobuf envelope to the top
+// level like the JSON form and writes numbers as strings, since protojson
+// quotes int64.
+func flatJSON(t *testing.T, b []byte) any {
+	t.Helper()
+	var v map[string]any
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if env, ok := v["envelope"].(map[string]any); ok {
+		delete(v, "envelope")
+		for k, x := range env {
+			v[k] = x
+		}
+	}
+	return numbersAsStrings(v)
+}
+
+func numbersAsStrings(v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, e := range x {
+			x[k] = numbersAsStrings(e)
+		}
+	case []any:
+		for i, e := range x {
+			x[i] = numbersAsStrings(e)
+		}
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return v
+}
+
+func mustMarshal(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
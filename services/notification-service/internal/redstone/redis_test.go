@@ -0,0 +1,177 @@
+package redstone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// redisStart is the clock of the Redis redisConfig starts.
+var redisStart = time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+// redisConfig starts an in-process Redis at a fixed clock.
+func redisConfig(t *testing.T) (KafkaConfig, *miniredis.Miniredis) {
+	t.Helper()
+	s := miniredis.RunT(t)
+	s.SetTime(redisStart)
+	return KafkaConfig{Transport: TransportRedis, RedisURL: "redis://" + s.Addr()}, s
+}
+
+func writeKeys(t *testing.T, ctx context.Context, cfg KafkaConfig, topic string, keys ...string) {
+	t.Helper()
+	p := NewProducer(cfg, topic)
+	defer p.Close()
+	for _, k := range keys {
+		m := kafka.Message{Key: []byte(k), Value: []byte("v" + k), Headers: []kafka.Header{{Key: "h", Value: []byte(k)}}}
+		if err := p.WriteMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// pendingIDs lists the group's entries delivered but not acked.
+func pendingIDs(t *testing.T, ctx context.Context, s *miniredis.Miniredis, topic, group string) []string {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rdb.Close()
+	ps, err := rdb.XPendingExt(ctx, &redis.XPendingExtArgs{Stream: topic, Group: group, Start: "-", End: "+", Count: 100}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, p := range ps {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func TestRedisRoundTrip(t *testing.T) {
+	cfg, s := redisConfig(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	writeKeys(t, ctx, cfg, "t", "a", "b")
+
+	c := NewConsumer(cfg, "t", "g")
+	defer c.Close()
+	for _, k := range []string{"a", "b"} {
+		m, err := c.Fetch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Key) != k || string(m.Value) != "v"+k || len(m.Headers) != 1 || string(m.Headers[0].Value) != k {
+			t.Fatalf("got %+v", m)
+		}
+		if err := c.Commit(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids := pendingIDs(t, ctx, s, "t", "g"); len(ids) != 0 {
+		t.Fatalf("pending after commit: %v", ids)
+	}
+}
+
+// An entry taken over from a dead member is fetched after newer ones;
+// committing those must not ack it while it is still being handled.
+func TestRedisCommitAcksOnlyCommitted(t *testing.T) {
+	cfg, s := redisConfig(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	writeKeys(t, ctx, cfg, "t", "a")
+
+	dead := NewConsumer(cfg, "t", "g")
+	claimed, err := dead.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	c := NewConsumer(cfg, "t", "g")
+	defer c.Close()
+	// Not idle long enough to take over yet, so the new entry comes first.
+	writeKeys(t, ctx, cfg, "t", "b")
+	newer, err := c.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(newer.Key) != "b" {
+		t.Fatalf("got %q, want b", newer.Key)
+	}
+	s.SetTime(redisStart.Add(2 * redisClaimIdle))
+	c.r.(*redisReader).lastClaim = time.Time{}
+	m, err := c.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Offset != claimed.Offset {
+		t.Fatalf("took over offset %d, want %d", m.Offset, claimed.Offset)
+	}
+	if err := c.Commit(ctx, newer); err != nil {
+		t.Fatal(err)
+	}
+	ids := pendingIDs(t, ctx, s, "t", "g")
+	if len(ids) != 1 {
+		t.Fatalf("pending %v, want the taken-over entry only", ids)
+	}
+	if err := c.Commit(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pendingIDs(t, ctx, s, "t", "g"); len(ids) != 0 {
+		t.Fatalf("pending after commit: %v", ids)
+	}
+}
+
+// An entry whose ID cannot be an offset is dropped with a log line.
+// An entry whose ID is no offset is acked and logged, with the event's
+// identifiers, through the consumer's logger.
+func TestRedisDropsUnreadableEntry(t *testing.T) {
+	cfg, s := redisConfig(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := s.XAdd("t", "1-4194304", []string{"key", "x", "value", "x", redisHeaderField + HeaderEventID, "e1"}); err != nil {
+		t.Fatal(err)
+	}
+	p := NewProducer(cfg, "t")
+	defer p.Close()
+	if err := p.Write(ctx, "a", sampleEvents()[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	l, buf := testLogger()
+	c := NewConsumer(cfg, "t", "g")
+	defer c.Close()
+	var got []string
+	runCtx, stop := context.WithCancel(ctx)
+	c.Run(runCtx, l, func(_ context.Context, m kafka.Message) error {
+		got = append(got, string(m.Key))
+		stop()
+		return nil
+	})
+	if fmt.Sprint(got) != "[a]" {
+		t.Fatalf("handled %v, want [a]", got)
+	}
+	var dropped []map[string]any
+	for _, e := range buf.entries(t) {
+		if e["msg"] == "dropped unreadable stream entry" {
+			dropped = append(dropped, e)
+		}
+	}
+	if len(dropped) != 1 {
+		t.Fatalf("logged %v", msgs(buf.entries(t)))
+	}
+	e := dropped[0]
+	if e["level"] != "WARN" || e["id"] != "1-4194304" || e["topic"] != "t" || e["order_id"] != "x" || e["event_id"] != "e1" || e["err"] == nil {
+		t.Errorf("entry %v", e)
+	}
+	for _, id := range pendingIDs(t, ctx, s, "t", "g") {
+		if id == "1-4194304" {
+			t.Fatal("unreadable entry left pending")
+		}
+	}
+
+}
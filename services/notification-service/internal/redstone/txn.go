@@ -0,0 +1,597 @@
+package redstone
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+)
+
+// Exactly-once processing. A consumer in this mode handles each message in
+// a Kafka transaction: whatever its handler publishes through the
+// transactional producers, retry and dead-letter copies included, is
+// produced together with the consumer offset commit, and consumers read
+// with read_committed isolation, so a crash between publishing and
+// committing leaves neither visible. kafka-go has no transactional writer,
+// so batches are produced directly with the producer session stamped in;
+// they are not compressed.
+
+var errTxnKafkaOnly = errors.New("exactly-once processing needs the kafka transport")
+
+// txnTimeout is how long the coordinator lets a transaction stay open
+// before aborting it, e.g. after the process died.
+const txnTimeout = time.Minute
+
+// txnKey carries the *txnBatch of the message being handled.
+type txnKey struct{}
+
+// txnBatch collects the messages published while one message is handled.
+type txnBatch struct {
+	msgs []kafka.Message
+}
+
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+// transactor runs the transactions of one consumer. A transactional ID has
+// at most one open transaction, so messages are handled one at a time, on
+// the source topic and the retry tiers alike.
+type transactor struct {
+	mu     sync.Mutex
+	client *kafka.Client
+	id     string
+
+	// producer session, producerID -1 until initialized.
+	producerID int
+	epoch      int
+	seq        map[topicPartition]int32
+
+	partitions map[string][]int
+}
+
+// txnWriter buffers messages written while a message is handled in a
+// transaction and writes through the wrapped writer otherwise.
+type txnWriter struct {
+	w     *kafka.Writer
+	topic string
+	t     *transactor
+}
+
+// SetExactlyOnce makes Run handle every message in a Kafka transaction with
+// the given transactional ID, which must be unique per running instance and
+// stable across its restarts so a restarted instance fences its old self.
+// Writes of the outputs, and of the consumer's retry tiers and dead-letter
+// topic, join the transaction of the message being handled; writes outside
+// a handler are published immediately. Messages are handled one at a time
+// whatever SetWorkers says.
+func (c *Consumer) SetExactlyOnce(transactionalID string, outputs ...*Producer) error {
+	if transactionalID == "" {
+		return errors.New("exactly-once processing needs a transactional ID")
+	}
+	t := &transactor{client: c.client(), id: transactionalID, producerID: -1}
+	consumers := []*Consumer{c}
+	for _, s := range c.stages {
+		consumers = append(consumers, s.consumer)
+	}
+	for _, sc := range consumers {
+		kr, ok := sc.r.(*kafka.Reader)
+		if !ok {
+			return errTxnKafkaOnly
+		}
+		// The reader has only just started joining; its replacement joins
+		// the same group.
+		cfg := kr.Config()
+		if err := kr.Close(); err != nil {
+			return err
+		}
+		sc.r = newTxnReader(cfg)
+	}
+	producers := append([]*Producer{c.dlq}, outputs...)
+	for _, s := range c.stages {
+		producers = append(producers, s.producer)
+	}
+	for _, p := range producers {
+		if p == nil {
+			continue
+		}
+		w, ok := p.w.(*kafka.Writer)
+		if !ok {
+			return errTxnKafkaOnly
+		}
+		p.w = &txnWriter{w: w, topic: p.topic, t: t}
+	}
+	c.txn = t
+	for _, s := range c.stages {
+		s.consumer.txn = t
+	}
+	return nil
+}
+
+func (w *txnWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	b, ok := ctx.Value(txnKey{}).(*txnBatch)
+	if !ok {
+		return w.w.WriteMessages(ctx, msgs...)
+	}
+	for _, m := range msgs {
+		m.Topic = w.topic
+		b.msgs = append(b.msgs, m)
+	}
+	return nil
+}
+
+func (w *txnWriter) Close() error { return w.w.Close() }
+
+func (w *txnWriter) check(ctx context.Context) error {
+	return checkTopic(ctx, &kafka.Client{Addr: w.w.Addr, Transport: w.w.Transport}, w.topic)
+}
+
+// consumeInTransactions is consume for a consumer in exactly-once mode.
+// A message whose transaction cannot be committed is retried until it is,
+// or left uncommitted if ctx is cancelled first.
+func (c *Consumer) consumeInTransactions(ctx context.Context, log *Logger, src *Consumer, h Handler, next int, delayed bool) {
+	work := context.WithoutCancel(ctx)
+	for {
+		m, ok := c.fetch(ctx, log, src, delayed)
+		if !ok {
+			return
+		}
+		c.txn.mu.Lock()
+		b := &txnBatch{}
+		// A failed handler's output is dropped; only its reroute is kept.
+		th := func(ctx context.Context, m kafka.Message) error {
+			err := h(ctx, m)
+			if err != nil {
+				b.msgs = nil
+			}
+			return err
+		}
+		ok = c.handle(ctx, context.WithValue(work, txnKey{}, b), log, m, th, next)
+		for ok {
+			err := c.txn.run(work, src.r.(*txnReader), m, b.msgs)
+			if err == nil {
+				break
+			}
+			if src.r.(*txnReader).lost() {
+				// The new owner resumes from the last committed offset.
+				log.Warn("partition reassigned, transaction dropped", map[string]any{"err": err.Error(), "topic": m.Topic, "offset": m.Offset})
+				break
+			}
+			log.Error("transaction failed", map[string]any{"err": err.Error(), "topic": m.Topic, "offset": m.Offset})
+			ok = sleep(ctx, 500*time.Millisecond)
+		}
+		c.txn.mu.Unlock()
+		if !ok {
+			return
+		}
+	}
+}
+
+// run publishes msgs and commits m's offset for the group of r, which m was
+// fetched from, in one transaction. Any failure before the commit request
+// aborts the transaction and starts a new producer session, so a retry
+// cannot duplicate messages.
+func (t *transactor) run(ctx context.Context, r *txnReader, m kafka.Message, msgs []kafka.Message) error {
+	if err := t.prepare(ctx, r, m, msgs); err != nil {
+		t.abort(ctx)
+		return err
+	}
+	// A retried EndTxn of a transaction that did commit succeeds, so only
+	// losing the session starts over.
+	for {
+		err := t.end(ctx, true)
+		if err == nil {
+			return nil
+		}
+		if fenced(err) {
+			t.producerID = -1
+			return err
+		}
+		if !sleep(ctx, 500*time.Millisecond) {
+			return err
+		}
+	}
+}
+
+func (t *transactor) prepare(ctx context.Context, r *txnReader, m kafka.Message, msgs []kafka.Message) error {
+	gen := r.generation()
+	if gen == nil {
+		return errors.New("no group generation")
+	}
+	if err := t.init(ctx); err != nil {
+		return err
+	}
+	batches, err := t.partition(ctx, msgs)
+	if err != nil {
+		return err
+	}
+	if len(batches) > 0 {
+		if err := t.addPartitions(ctx, batches); err != nil {
+			return err
+		}
+		for tp, msgs := range batches {
+			if err := t.produce(ctx, tp, msgs); err != nil {
+				return err
+			}
+		}
+	}
+
+	res, err := t.client.AddOffsetsToTxn(ctx, &kafka.AddOffsetsToTxnRequest{
+		TransactionalID: t.id,
+		ProducerID:      t.producerID,
+		ProducerEpoch:   t.epoch,
+		GroupID:         gen.GroupID,
+	})
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return fmt.Errorf("add offsets to transaction: %w", res.Error)
+	}
+	// The coordinator rejects the commit, and so the transaction, if this
+	// member no longer holds the partition in that generation.
+	cres, err := t.client.TxnOffsetCommit(ctx, &kafka.TxnOffsetCommitRequest{
+		TransactionalID: t.id,
+		GroupID:         gen.GroupID,
+		ProducerID:      t.producerID,
+		ProducerEpoch:   t.epoch,
+		GenerationID:    int(gen.ID),
+		MemberID:        gen.MemberID,
+		Topics: map[string][]kafka.TxnOffsetCommit{
+			m.Topic: {{Partition: m.Partition, Offset: m.Offset + 1}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, ps := range cres.Topics {
+		for _, p := range ps {
+			if p.Error != nil {
+				return fmt.Errorf("commit offset in transaction: %w", p.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// init starts a producer session if there is none. Initializing aborts
+// whatever transaction a previous session of the ID left open.
+func (t *transactor) init(ctx context.Context) error {
+	if t.producerID >= 0 {
+		return nil
+	}
+	res, err := t.client.InitProducerID(ctx, &kafka.InitProducerIDRequest{
+		TransactionalID:      t.id,
+		TransactionTimeoutMs: int(txnTimeout / time.Millisecond),
+		ProducerID:           -1,
+		ProducerEpoch:        -1,
+	})
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return fmt.Errorf("init producer id: %w", res.Error)
+	}
+	t.producerID, t.epoch = res.Producer.ProducerID, res.Producer.ProducerEpoch
+	t.seq = make(map[topicPartition]int32)
+	return nil
+}
+
+// partition groups msgs by the partition the key hashes to, like the
+// non-transactional writer.
+func (t *transactor) partition(ctx context.Context, msgs []kafka.Message) (map[topicPartition][]kafka.Message, error) {
+	batches := make(map[topicPartition][]kafka.Message)
+	for _, m := range msgs {
+		parts, err := t.topicPartitions(ctx, m.Topic)
+		if err != nil {
+			return nil, err
+		}
+		tp := topicPartition{m.Topic, (&kafka.Hash{}).Balance(m, parts...)}
+		batches[tp] = append(batches[tp], m)
+	}
+	return batches, nil
+}
+
+func (t *transactor) topicPartitions(ctx context.Context, topic string) ([]int, error) {
+	if parts, ok := t.partitions[topic]; ok {
+		return parts, nil
+	}
+	meta, err := t.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Topics) != 1 || meta.Topics[0].Error != nil {
+		return nil, fmt.Errorf("topic %s not found", topic)
+	}
+	var parts []int
+	for _, p := range meta.Topics[0].Partitions {
+		parts = append(parts, p.ID)
+	}
+	if t.partitions == nil {
+		t.partitions = make(map[string][]int)
+	}
+	t.partitions[topic] = parts
+	return parts, nil
+}
+
+func (t *transactor) addPartitions(ctx context.Context, batches map[topicPartition][]kafka.Message) error {
+	topics := make(map[string][]kafka.AddPartitionToTxn)
+	for tp := range batches {
+		topics[tp.topic] = append(topics[tp.topic], kafka.AddPartitionToTxn{Partition: tp.partition})
+	}
+	res, err := t.client.AddPartitionsToTxn(ctx, &kafka.AddPartitionsToTxnRequest{
+		TransactionalID: t.id,
+		ProducerID:      t.producerID,
+		ProducerEpoch:   t.epoch,
+		Topics:          topics,
+	})
+	if err != nil {
+		return err
+	}
+	for topic, ps := range res.Topics {
+		for _, p := range ps {
+			if p.Error != nil {
+				return fmt.Errorf("add %s/%d to transaction: %w", topic, p.Partition, p.Error)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *transactor) produce(ctx context.Context, tp topicPartition, msgs []kafka.Message) error {
+	records, err := transactionalBatch(msgs, int64(t.producerID), int16(t.epoch), t.seq[tp])
+	if err != nil {
+		return err
+	}
+	res, err := t.client.RawProduce(ctx, &kafka.RawProduceRequest{
+		Topic:           tp.topic,
+		Partition:       tp.partition,
+		RequiredAcks:    kafka.RequireAll,
+		TransactionalID: t.id,
+		RawRecords:      protocol.RawRecordSet{Reader: bytes.NewReader(records)},
+	})
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return fmt.Errorf("produce to %s/%d: %w", tp.topic, tp.partition, res.Error)
+	}
+	t.seq[tp] += int32(len(msgs))
+	return nil
+}
+
+func (t *transactor) end(ctx context.Context, commit bool) error {
+	res, err := t.client.EndTxn(ctx, &kafka.EndTxnRequest{
+		TransactionalID: t.id,
+		ProducerID:      t.producerID,
+		ProducerEpoch:   t.epoch,
+		Committed:       commit,
+	})
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return fmt.Errorf("end transaction: %w", res.Error)
+	}
+	return nil
+}
+
+// abort ends the open transaction, if any, and drops the session; the next
+// init aborts it anyway should this fail.
+func (t *transactor) abort(ctx context.Context) {
+	if t.producerID >= 0 {
+		_ = t.end(ctx, false)
+	}
+	t.producerID = -1
+}
+
+func fenced(err error) bool {
+	return errors.Is(err, kafka.ProducerFenced) || errors.Is(err, kafka.InvalidProducerEpoch) ||
+		errors.Is(err, kafka.TransactionCoordinatorFenced) || errors.Is(err, kafka.InvalidProducerIDMapping)
+}
+
+// txnReader reads a topic as a member of a consumer group like
+// *kafka.Reader, but through kafka.ConsumerGroup, which exposes the
+// generation and member ID a transactional offset commit is fenced with.
+// Messages are only committed within a transaction.
+type txnReader struct {
+	cfg    kafka.ReaderConfig
+	group  *kafka.ConsumerGroup
+	err    error
+	msgs   chan txnMessage
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	cur txnMessage
+}
+
+// txnMessage is a fetched message with the generation it was read in;
+// gctx is done once that generation ends.
+type txnMessage struct {
+	m    kafka.Message
+	gen  *kafka.Generation
+	gctx context.Context
+}
+
+func newTxnReader(cfg kafka.ReaderConfig) *txnReader {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &txnReader{cfg: cfg, msgs: make(chan txnMessage), cancel: cancel, done: make(chan struct{})}
+	r.group, r.err = kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:      cfg.GroupID,
+		Brokers: cfg.Brokers,
+		Dialer:  cfg.Dialer,
+		Topics:  []string{cfg.Topic},
+	})
+	if r.err != nil {
+		close(r.done)
+		return r
+	}
+	go r.run(ctx)
+	return r
+}
+
+// run joins each generation and reads the partitions it assigns.
+func (r *txnReader) run(ctx context.Context) {
+	defer close(r.done)
+	for {
+		gen, err := r.group.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, kafka.ErrGroupClosed) {
+				return
+			}
+			if !sleep(ctx, 500*time.Millisecond) {
+				return
+			}
+			continue
+		}
+		for _, a := range gen.Assignments[r.cfg.Topic] {
+			a := a
+			gen.Start(func(gctx context.Context) { r.readPartition(gctx, gen, a) })
+		}
+	}
+}
+
+func (r *txnReader) readPartition(gctx context.Context, gen *kafka.Generation, a kafka.PartitionAssignment) {
+	pr := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:        r.cfg.Brokers,
+		Topic:          r.cfg.Topic,
+		Partition:      a.ID,
+		MinBytes:       r.cfg.MinBytes,
+		MaxBytes:       r.cfg.MaxBytes,
+		Dialer:         r.cfg.Dialer,
+		IsolationLevel: kafka.ReadCommitted,
+	})
+	defer pr.Close()
+	if err := pr.SetOffset(a.Offset); err != nil {
+		return
+	}
+	for {
+		m, err := pr.ReadMessage(gctx)
+		if err != nil {
+			if !sleep(gctx, 500*time.Millisecond) {
+				return
+			}
+			continue
+		}
+		select {
+		case r.msgs <- txnMessage{m: m, gen: gen, gctx: gctx}:
+		case <-gctx.Done():
+			return
+		}
+	}
+}
+
+// FetchMessage returns the next message of a partition the member still
+// holds.
+func (r *txnReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if r.err != nil {
+		return kafka.Message{}, r.err
+	}
+	for {
+		select {
+		case tm := <-r.msgs:
+			if tm.gctx.Err() != nil {
+				continue
+			}
+			r.mu.Lock()
+			r.cur = tm
+			r.mu.Unlock()
+			return tm.m, nil
+		case <-r.done:
+			return kafka.Message{}, io.EOF
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		}
+	}
+}
+
+// CommitMessages commits outside a transaction, in the generation the last
+// message was fetched in.
+func (r *txnReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	gen := r.generation()
+	if gen == nil {
+		return errors.New("no group generation")
+	}
+	offsets := make(map[string]map[int]int64)
+	for _, m := range msgs {
+		if offsets[m.Topic] == nil {
+			offsets[m.Topic] = make(map[int]int64)
+		}
+		offsets[m.Topic][m.Partition] = m.Offset + 1
+	}
+	return gen.CommitOffsets(offsets)
+}
+
+func (r *txnReader) Config() kafka.ReaderConfig { return r.cfg }
+
+func (r *txnReader) Close() error {
+	r.cancel()
+	var err error
+	if r.group != nil {
+		err = r.group.Close()
+	}
+	<-r.done
+	return err
+}
+
+// generation is the generation the last fetched message was read in.
+func (r *txnReader) generation() *kafka.Generation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cur.gen
+}
+
+// lost reports whether the generation of the last fetched message ended,
+// i.e. its partition may now belong to another member.
+func (r *txnReader) lost() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cur.gctx != nil && r.cur.gctx.Err() != nil
+}
+
+// transactionalBatch encodes msgs as one transactional record batch of the
+// producer session starting at sequence seq. kafka-go encodes the batch
+// without a producer, so the session fields are written into it and the
+// checksum recomputed.
+func transactionalBatch(msgs []kafka.Message, producerID int64, epoch int16, seq int32) ([]byte, error) {
+	records := make([]protocol.Record, len(msgs))
+	for i, m := range msgs {
+		headers := make([]protocol.Header, len(m.Headers))
+		for j, h := range m.Headers {
+			headers[j] = protocol.Header{Key: h.Key, Value: h.Value}
+		}
+		records[i] = protocol.Record{
+			Time:    m.Time,
+			Key:     protocol.NewBytes(m.Key),
+			Value:   protocol.NewBytes(m.Value),
+			Headers: headers,
+		}
+	}
+	rs := protocol.RecordSet{
+		Version:    2,
+		Attributes: protocol.Transactional,
+		Records:    protocol.NewRecordReader(records...),
+	}
+	var buf bytes.Buffer
+	if _, err := rs.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	// The batch follows a 4-byte size; field offsets are those of the v2
+	// record batch format.
+	batch := buf.Bytes()[4:]
+	binary.BigEndian.PutUint64(batch[43:], uint64(producerID))
+	binary.BigEndian.PutUint16(batch[51:], uint16(epoch))
+	binary.BigEndian.PutUint32(batch[53:], uint32(seq))
+	binary.BigEndian.PutUint32(batch[17:], crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli)))
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,567 @@
+package redstone
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/addoffsetstotxn"
+	"github.com/segmentio/kafka-go/protocol/addpartitionstotxn"
+	"github.com/segmentio/kafka-go/protocol/endtxn"
+	"github.com/segmentio/kafka-go/protocol/initproducerid"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	"github.com/segmentio/kafka-go/protocol/rawproduce"
+	"github.com/segmentio/kafka-go/protocol/txnoffsetcommit"
+)
+
+// The producer fields patched into kafka-go's encoding must decode back,
+// under a valid CRC, with the records intact.
+func TestTransactionalBatch(t *testing.T) {
+	at := time.UnixMilli(1_700_000_000_000)
+	msgs := []kafka.Message{
+		{Key: []byte("o1"), Value: []byte(`{"a":1}`), Time: at, Headers: []kafka.Header{{Key: "h", Value: []byte("v")}}},
+		{Key: []byte("o2"), Value: []byte(`{"a":2}`), Time: at},
+	}
+	b, err := transactionalBatch(msgs, 1234, 7, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rs protocol.RecordSet
+	// ReadFrom verifies the CRC.
+	if _, err := rs.ReadFrom(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if !rs.Attributes.Transactional() || rs.Attributes.Control() {
+		t.Fatalf("attributes %v", rs.Attributes)
+	}
+	rb := batchOf(t, rs.Records)
+	if rb.ProducerID != 1234 || rb.ProducerEpoch != 7 || rb.BaseSequence != 42 {
+		t.Fatalf("producer %d epoch %d sequence %d", rb.ProducerID, rb.ProducerEpoch, rb.BaseSequence)
+	}
+	for i, m := range msgs {
+		r, err := rb.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, _ := protocol.ReadAll(r.Key)
+		v, _ := protocol.ReadAll(r.Value)
+		if string(k) != string(m.Key) || string(v) != string(m.Value) || !r.Time.Equal(at) || len(r.Headers) != len(m.Headers) {
+			t.Fatalf("record %d: %q %q %v %v", i, k, v, r.Time, r.Headers)
+		}
+	}
+	if _, err := rb.ReadRecord(); err == nil {
+		t.Fatal("extra record")
+	}
+}
+
+// batchOf returns the single record batch in records.
+func batchOf(t *testing.T, records protocol.RecordReader) *protocol.RecordBatch {
+	t.Helper()
+	if s, ok := records.(*protocol.RecordStream); ok && len(s.Records) == 1 {
+		records = s.Records[0]
+	}
+	rb, ok := records.(*protocol.RecordBatch)
+	if !ok {
+		t.Fatalf("records %T", records)
+	}
+	return rb
+}
+
+// txnRecord is a record produced in a transaction.
+type txnRecord struct {
+	topic      string
+	partition  int
+	key, value string
+	headers    []kafka.Header
+	epoch      int16
+	seq        int32
+}
+
+// txnState is what one transaction wrote: records and group offsets.
+type txnState struct {
+	epoch   int16
+	records []txnRecord
+	offsets map[string]int64 // "topic/partition" -> next offset
+}
+
+// fakeTxnBroker is a kafka.RoundTripper standing in for a single broker
+// that is also the transaction and group coordinator. It keeps what each
+// transaction wrote apart until EndTxn, and fences requests of any epoch
+// but the latest, like the coordinator does.
+type fakeTxnBroker struct {
+	mu         sync.Mutex
+	producerID int64
+	epoch      int16
+	open       *txnState
+	committed  []txnState
+	aborted    []txnState
+	requests   []string
+
+	// fail, if set, may answer a request with an error code instead.
+	fail func(req protocol.Message) int16
+}
+
+func (b *fakeTxnBroker) RoundTrip(_ context.Context, _ net.Addr, req protocol.Message) (protocol.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var code int16
+	if b.fail != nil {
+		code = b.fail(req)
+	}
+	stale := func(epoch int16) bool {
+		if code == 0 && epoch != b.epoch {
+			code = int16(kafka.ProducerFenced)
+		}
+		return code != 0
+	}
+
+	switch r := req.(type) {
+	case *initproducerid.Request:
+		b.requests = append(b.requests, "init")
+		if code == 0 {
+			// A new session aborts what the previous one left open.
+			b.endOpen(false)
+			b.producerID = 1000
+			b.epoch++
+		}
+		return &initproducerid.Response{ErrorCode: code, ProducerID: b.producerID, ProducerEpoch: b.epoch}, nil
+
+	case *metadata.Request:
+		res := &metadata.Response{Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: "fake", Port: 9092}}}
+		for _, name := range r.TopicNames {
+			res.Topics = append(res.Topics, metadata.ResponseTopic{Name: name, Partitions: []metadata.ResponsePartition{
+				{PartitionIndex: 0, LeaderID: 1}, {PartitionIndex: 1, LeaderID: 1},
+			}})
+		}
+		return res, nil
+
+	case *addpartitionstotxn.Request:
+		b.requests = append(b.requests, "add-partitions")
+		res := &addpartitionstotxn.Response{}
+		stale(r.ProducerEpoch)
+		for _, t := range r.Topics {
+			rt := addpartitionstotxn.ResponseResult{Name: t.Name}
+			for _, p := range t.Partitions {
+				rt.Results = append(rt.Results, addpartitionstotxn.ResponsePartition{PartitionIndex: p, ErrorCode: code})
+			}
+			res.Results = append(res.Results, rt)
+		}
+		if code == 0 {
+			b.begin(r.ProducerEpoch)
+		}
+		return res, nil
+
+	case *rawproduce.Request:
+		t, p := r.Topics[0].Topic, r.Topics[0].Partitions[0]
+		b.requests = append(b.requests, fmt.Sprintf("produce %s/%d", t, p.Partition))
+		var rs protocol.RecordSet
+		if _, err := rs.ReadFrom(p.RecordSet.Reader); err != nil {
+			return nil, err
+		}
+		batch, ok := rs.Records.(*protocol.RecordBatch)
+		if !ok {
+			if s, isStream := rs.Records.(*protocol.RecordStream); isStream && len(s.Records) == 1 {
+				batch, ok = s.Records[0].(*protocol.RecordBatch)
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("records %T", rs.Records)
+		}
+		if !stale(batch.ProducerEpoch) && b.open == nil {
+			code = int16(kafka.InvalidTransactionState)
+		}
+		if code == 0 {
+			for i := int32(0); ; i++ {
+				rec, err := batch.ReadRecord()
+				if err != nil {
+					break
+				}
+				k, _ := protocol.ReadAll(rec.Key)
+				v, _ := protocol.ReadAll(rec.Value)
+				var hs []kafka.Header
+				for _, h := range rec.Headers {
+					hs = append(hs, kafka.Header{Key: h.Key, Value: h.Value})
+				}
+				b.open.records = append(b.open.records, txnRecord{
+					topic: t, partition: int(p.Partition), key: string(k), value: string(v), headers: hs,
+					epoch: batch.ProducerEpoch, seq: batch.BaseSequence + i,
+				})
+			}
+		}
+		return &produce.Response{Topics: []produce.ResponseTopic{{Topic: t, Partitions: []produce.ResponsePartition{{Partition: p.Partition, ErrorCode: code}}}}}, nil
+
+	case *addoffsetstotxn.Request:
+		b.requests = append(b.requests, "add-offsets "+r.GroupID)
+		if !stale(r.ProducerEpoch) {
+			b.begin(r.ProducerEpoch)
+		}
+		return &addoffsetstotxn.Response{ErrorCode: code}, nil
+
+	case *txnoffsetcommit.Request:
+		res := &txnoffsetcommit.Response{}
+		stale(r.ProducerEpoch)
+		if code == 0 && b.open == nil {
+			code = int16(kafka.InvalidTransactionState)
+		}
+		for _, t := range r.Topics {
+			rt := txnoffsetcommit.ResponseTopic{Name: t.Name}
+			for _, p := range t.Partitions {
+				b.requests = append(b.requests, fmt.Sprintf("commit %s/%d=%d gen %d %s", t.Name, p.Partition, p.CommittedOffset, r.GenerationID, r.MemberID))
+				if code == 0 {
+					b.open.offsets[fmt.Sprintf("%s/%d", t.Name, p.Partition)] = p.CommittedOffset
+				}
+				rt.Partitions = append(rt.Partitions, txnoffsetcommit.ResponsePartition{Partition: p.Partition, ErrorCode: code})
+			}
+			res.Topics = append(res.Topics, rt)
+		}
+		return res, nil
+
+	case *endtxn.Request:
+		if r.Committed {
+			b.requests = append(b.requests, "end commit")
+		} else {
+			b.requests = append(b.requests, "end abort")
+		}
+		if !stale(r.ProducerEpoch) {
+			b.endOpen(r.Committed)
+		}
+		return &endtxn.Response{ErrorCode: code}, nil
+	}
+	return nil, fmt.Errorf("unexpected request %T", req)
+}
+
+func (b *fakeTxnBroker) begin(epoch int16) {
+	if b.open == nil {
+		b.open = &txnState{epoch: epoch, offsets: map[string]int64{}}
+	}
+}
+
+func (b *fakeTxnBroker) endOpen(commit bool) {
+	if b.open == nil {
+		return
+	}
+	if commit {
+		b.committed = append(b.committed, *b.open)
+	} else {
+		b.aborted = append(b.aborted, *b.open)
+	}
+	b.open = nil
+}
+
+// fenceBy plays another instance initializing the same transactional ID.
+func (b *fakeTxnBroker) fenceBy() {
+	b.endOpen(false)
+	b.epoch++
+}
+
+func (b *fakeTxnBroker) state() (committed, aborted []txnState, requests []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]txnState(nil), b.committed...), append([]txnState(nil), b.aborted...), append([]string(nil), b.requests...)
+}
+
+// txnHarness is a consumer of topic t in group g in exactly-once mode on a
+// fakeTxnBroker, with an output producer on topic out. Messages are handed
+// to its reader with deliver.
+type txnHarness struct {
+	broker *fakeTxnBroker
+	c      *Consumer
+	out    *Producer
+	r      *txnReader
+}
+
+var txnGen = &kafka.Generation{ID: 3, GroupID: "g", MemberID: "m1"}
+
+func newTxnHarness(b *fakeTxnBroker) *txnHarness {
+	r := &txnReader{
+		cfg:    kafka.ReaderConfig{Brokers: []string{"fake:9092"}, Topic: "t", GroupID: "g"},
+		msgs:   make(chan txnMessage),
+		cancel: func() {},
+		done:   make(chan struct{}),
+	}
+	c := &Consumer{r: r, transport: b}
+	c.txn = &transactor{client: c.client(), id: "tx-1", producerID: -1}
+	c.dlq = &Producer{topic: DeadLetterTopic("t", "g"), w: &txnWriter{w: &kafka.Writer{}, topic: DeadLetterTopic("t", "g"), t: c.txn}}
+	out := &Producer{topic: "out", w: &txnWriter{w: &kafka.Writer{}, topic: "out", t: c.txn}}
+	return &txnHarness{broker: b, c: c, out: out, r: r}
+}
+
+// run runs the consumer with h until the returned stop is called and
+// returns its log.
+func (th *txnHarness) run(h Handler) (stop func() *logBuffer) {
+	l, buf := testLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		th.c.Run(ctx, l, h)
+	}()
+	return func() *logBuffer {
+		cancel()
+		<-done
+		return buf
+	}
+}
+
+// deliver hands m to the consumer as read in generation gctx.
+func (th *txnHarness) deliver(t *testing.T, gctx context.Context, m kafka.Message) {
+	t.Helper()
+	m.Topic = "t"
+	select {
+	case th.r.msgs <- txnMessage{m: m, gen: txnGen, gctx: gctx}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not fetch")
+	}
+}
+
+// waitTxns waits until n transactions are committed and returns them.
+func (th *txnHarness) waitTxns(t *testing.T, n int) []txnState {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	waitFor(t, ctx, fmt.Sprintf("%d committed transactions", n), func() bool {
+		committed, _, _ := th.broker.state()
+		return len(committed) >= n
+	})
+	committed, _, _ := th.broker.state()
+	return committed
+}
+
+// outputs returns the records of txns on topic, as key=value.
+func outputs(txns []txnState, topic string) []string {
+	var out []string
+	for _, s := range txns {
+		for _, r := range s.records {
+			if r.topic == topic {
+				out = append(out, r.key+"="+r.value)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// writeOutputs is a handler publishing a=1 and b=2 to out and returning err.
+func (th *txnHarness) writeOutputs(calls *atomic.Int32, err error) Handler {
+	return func(ctx context.Context, m kafka.Message) error {
+		calls.Add(1)
+		for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}} {
+			if werr := th.out.WriteMessage(ctx, kafka.Message{Key: []byte(kv[0]), Value: []byte(kv[1])}); werr != nil {
+				return werr
+			}
+		}
+		return err
+	}
+}
+
+// A handler's outputs and the offset of its message are committed in one
+// transaction, in that order, and a session serves many transactions.
+func TestTxnCommitsOutputsWithOffset(t *testing.T) {
+	b := &fakeTxnBroker{}
+	th := newTxnHarness(b)
+	var calls atomic.Int32
+	stop := th.run(th.writeOutputs(&calls, nil))
+	defer stop()
+
+	th.deliver(t, context.Background(), kafka.Message{Partition: 1, Offset: 41, Key: []byte("o1"), Value: []byte(`{}`)})
+	txns := th.waitTxns(t, 1)
+	if got := fmt.Sprint(outputs(txns, "out")); got != "[a=1 b=2]" {
+		t.Fatalf("outputs %s", got)
+	}
+	if fmt.Sprint(txns[0].offsets) != "map[t/1:42]" {
+		t.Fatalf("offsets %v, want t/1 committed past 41", txns[0].offsets)
+	}
+	_, _, reqs := b.state()
+	var order []string
+	for _, r := range reqs {
+		if !strings.HasPrefix(r, "produce") {
+			order = append(order, r)
+		}
+	}
+	if got := strings.Join(order, ", "); got != "init, add-partitions, add-offsets g, commit t/1=42 gen 3 m1, end commit" {
+		t.Fatalf("requests %s", got)
+	}
+	if i := slices.IndexFunc(reqs, func(r string) bool { return strings.HasPrefix(r, "commit") }); slices.ContainsFunc(reqs[i:], func(r string) bool { return strings.HasPrefix(r, "produce") }) {
+		t.Fatalf("produced after the offset commit: %v", reqs)
+	}
+
+	th.deliver(t, context.Background(), kafka.Message{Partition: 1, Offset: 42, Key: []byte("o1"), Value: []byte(`{}`)})
+	txns = th.waitTxns(t, 2)
+	if fmt.Sprint(txns[1].offsets) != "map[t/1:43]" || txns[1].epoch != txns[0].epoch {
+		t.Fatalf("second transaction %+v", txns[1])
+	}
+	// Sequences continue per partition within the session.
+	last := map[int]int32{}
+	for _, s := range txns {
+		for _, r := range s.records {
+			if prev, ok := last[r.partition]; ok && r.seq != prev+1 {
+				t.Errorf("partition %d: sequence %d after %d", r.partition, r.seq, prev)
+			}
+			last[r.partition] = r.seq
+		}
+	}
+	if _, _, reqs := b.state(); slices.Index(reqs[1:], "init") >= 0 {
+		t.Errorf("new session for the second transaction: %v", reqs)
+	}
+}
+
+// A failed handler's outputs are dropped; only the dead-letter copy is
+// published, in the transaction that commits the offset.
+func TestTxnHandlerErrorDropsOutputs(t *testing.T) {
+	b := &fakeTxnBroker{}
+	th := newTxnHarness(b)
+	var calls atomic.Int32
+	stop := th.run(th.writeOutputs(&calls, errors.New("bad order")))
+	defer stop()
+
+	th.deliver(t, context.Background(), kafka.Message{Offset: 7, Key: []byte("o1"), Value: []byte(`{}`)})
+	txns := th.waitTxns(t, 1)
+	committed, aborted, _ := b.state()
+	if out := outputs(append(committed, aborted...), "out"); len(out) != 0 {
+		t.Fatalf("failed handler's outputs produced: %v", out)
+	}
+	dlq := txns[0].records
+	if len(dlq) != 1 || dlq[0].topic != DeadLetterTopic("t", "g") || dlq[0].key != "o1" {
+		t.Fatalf("records %+v, want the dead-letter copy", dlq)
+	}
+	if got := fmt.Sprint(headerValues(kafka.Message{Headers: dlq[0].headers}, headerError)); got != "[bad order]" {
+		t.Errorf("dead letter error %s", got)
+	}
+	if fmt.Sprint(txns[0].offsets) != "map[t/0:8]" {
+		t.Errorf("offsets %v", txns[0].offsets)
+	}
+}
+
+// A transaction that fails before its commit is aborted, with what it
+// produced, and redone in a new session without running the handler again.
+func TestTxnAbortsFailedTransaction(t *testing.T) {
+	b := &fakeTxnBroker{}
+	failed := false
+	b.fail = func(req protocol.Message) int16 {
+		if _, ok := req.(*txnoffsetcommit.Request); ok && !failed {
+			failed = true
+			return int16(kafka.RequestTimedOut)
+		}
+		return 0
+	}
+	th := newTxnHarness(b)
+	var calls atomic.Int32
+	stop := th.run(th.writeOutputs(&calls, nil))
+	defer stop()
+
+	th.deliver(t, context.Background(), kafka.Message{Offset: 3, Key: []byte("o1"), Value: []byte(`{}`)})
+	txns := th.waitTxns(t, 1)
+	committed, aborted, reqs := b.state()
+	if len(committed) != 1 || len(aborted) != 1 {
+		t.Fatalf("%d committed, %d aborted transactions, want 1 each", len(committed), len(aborted))
+	}
+	if got := fmt.Sprint(outputs(aborted, "out")); got != "[a=1 b=2]" || len(aborted[0].offsets) != 0 {
+		t.Fatalf("aborted transaction %s, offsets %v", got, aborted[0].offsets)
+	}
+	if got := fmt.Sprint(outputs(txns, "out")); got != "[a=1 b=2]" || fmt.Sprint(txns[0].offsets) != "map[t/0:4]" {
+		t.Fatalf("committed transaction %s, offsets %v", got, txns[0].offsets)
+	}
+	if txns[0].epoch == aborted[0].epoch {
+		t.Errorf("retried in the aborted session, epoch %d", txns[0].epoch)
+	}
+	for _, r := range txns[0].records {
+		if r.seq > 1 {
+			t.Errorf("sequence %d in a new session", r.seq)
+		}
+	}
+	if i := slices.Index(reqs, "end abort"); i < 0 || reqs[i+1] != "init" {
+		t.Errorf("requests %v, want an abort and a new session", reqs)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler ran %d times", n)
+	}
+}
+
+// When another session takes over the transactional ID, the transaction of
+// the fenced one is never committed; while the partition is still held, the
+// message is committed in a new session.
+func TestTxnFenced(t *testing.T) {
+	b := &fakeTxnBroker{}
+	fenced := false
+	b.fail = func(req protocol.Message) int16 {
+		if r, ok := req.(*endtxn.Request); ok && r.Committed && !fenced {
+			fenced = true
+			b.fenceBy()
+		}
+		return 0
+	}
+	th := newTxnHarness(b)
+	var calls atomic.Int32
+	stop := th.run(th.writeOutputs(&calls, nil))
+	defer stop()
+
+	th.deliver(t, context.Background(), kafka.Message{Offset: 3, Key: []byte("o1"), Value: []byte(`{}`)})
+	txns := th.waitTxns(t, 1)
+	committed, aborted, reqs := b.state()
+	if len(committed) != 1 || len(aborted) != 1 {
+		t.Fatalf("%d committed, %d aborted transactions, want 1 each", len(committed), len(aborted))
+	}
+	// Nothing more is sent in the fenced session.
+	if i := slices.Index(reqs, "end commit"); reqs[i+1] != "init" {
+		t.Errorf("requests %v, want a new session right after fencing", reqs)
+	}
+	if txns[0].epoch <= aborted[0].epoch+1 {
+		t.Fatalf("committed in epoch %d, want one after the fencing session's %d", txns[0].epoch, aborted[0].epoch+1)
+	}
+	for _, r := range txns[0].records {
+		if r.epoch != txns[0].epoch {
+			t.Errorf("record of epoch %d in a transaction of epoch %d", r.epoch, txns[0].epoch)
+		}
+	}
+	if fmt.Sprint(txns[0].offsets) != "map[t/0:4]" || calls.Load() != 1 {
+		t.Errorf("offsets %v after %d handler calls", txns[0].offsets, calls.Load())
+	}
+}
+
+// A zombie, fenced after its partition was reassigned, drops the
+// transaction: the new owner resumes from the last committed offset.
+func TestTxnFencedAfterRebalance(t *testing.T) {
+	b := &fakeTxnBroker{}
+	gctx, endGeneration := context.WithCancel(context.Background())
+	fenced := false
+	b.fail = func(req protocol.Message) int16 {
+		if r, ok := req.(*endtxn.Request); ok && r.Committed && !fenced {
+			fenced = true
+			endGeneration()
+			b.fenceBy()
+		}
+		return 0
+	}
+	th := newTxnHarness(b)
+	var calls atomic.Int32
+	stop := th.run(th.writeOutputs(&calls, nil))
+
+	th.deliver(t, gctx, kafka.Message{Offset: 3, Key: []byte("o1"), Value: []byte(`{}`)})
+	// The next message is only fetched once the first is given up on.
+	th.deliver(t, context.Background(), kafka.Message{Partition: 1, Offset: 9, Key: []byte("o2"), Value: []byte(`{}`)})
+	txns := th.waitTxns(t, 1)
+	log := stop()
+
+	if len(txns) != 1 || fmt.Sprint(txns[0].offsets) != "map[t/1:10]" {
+		t.Fatalf("committed %+v, want only the second message", txns)
+	}
+	_, _, reqs := b.state()
+	if n := strings.Count(strings.Join(reqs, ";"), "end commit"); n != 2 {
+		t.Errorf("%d commit attempts, want one per message: %v", n, reqs)
+	}
+	if !slices.Contains(msgs(log.entries(t)), "partition reassigned, transaction dropped") {
+		t.Errorf("log %v", msgs(log.entries(t)))
+	}
+}
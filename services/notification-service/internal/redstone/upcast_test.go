@@ -0,0 +1,70 @@
+package redstone
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestUpcastOrderCreatedV1(t *testing.T) {
+	out, err := Upcast([]byte(`{"event_type":"OrderCreated","event_id":"e1","order_id":"o1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p map[string]any
+	if err := json.Unmarshal(out, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p["currency"] != "INR" || p["schema_version"] != float64(SchemaVersion) {
+		t.Fatalf("got %s", out)
+	}
+}
+
+func TestUpcastCurrentUnchanged(t *testing.T) {
+	in := []byte(`{"event_type":"OrderCreated","schema_version":2,"currency":"USD"}`)
+	out, err := Upcast(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(in) {
+		t.Fatalf("got %s", out)
+	}
+}
+
+func TestUpcastRejectsNonObjects(t *testing.T) {
+	for _, in := range []string{`null`, `[]`, `"x"`, `1`, ``} {
+		if _, err := Upcast([]byte(in)); err == nil {
+			t.Errorf("Upcast(%q): want error", in)
+		}
+	}
+}
+
+// A null record must be dead-lettered, not crash the consumer.
+func TestNullPayloadGoesToDLQ(t *testing.T) {
+	b := NewMemoryBroker(1)
+	if err := b.Producer("t").WriteMessage(context.Background(), kafka.Message{Key: []byte("k"), Value: []byte("null")}); err != nil {
+		t.Fatal(err)
+	}
+	c := b.RetryingConsumer("t", "g", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var called atomic.Bool
+	go c.Run(ctx, NewLogger("test"), func(context.Context, kafka.Message) error {
+		called.Store(true)
+		return nil
+	})
+	for len(b.Messages(DeadLetterTopic("t", "g"))) == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("null payload not dead-lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if called.Load() {
+		t.Fatal("handler ran for a null payload")
+	}
+}
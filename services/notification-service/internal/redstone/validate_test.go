@@ -0,0 +1,29 @@
+package redstone
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateRejectsNonObjects(t *testing.T) {
+	v := NewValidator(ValidationStrict, NewLogger("test"))
+	for _, in := range []string{`null`, `[]`, `"x"`, `1`} {
+		var ve *ValidationError
+		if err := v.Validate([]byte(in)); !errors.As(err, &ve) {
+			t.Errorf("Validate(%q) = %v, want *ValidationError", in, err)
+		}
+	}
+}
+
+func TestValidatePaymentCaptured(t *testing.T) {
+	v := NewValidator(ValidationStrict, NewLogger("test"))
+	ev := sampleEvents()[3].(PaymentCaptured)
+	if err := v.Validate([]byte(mustMarshal(t, ev))); err != nil {
+		t.Fatal(err)
+	}
+	ev.Amount = 0
+	var ve *ValidationError
+	if err := v.Validate([]byte(mustMarshal(t, ev))); !errors.As(err, &ve) {
+		t.Fatalf("amount 0: got %v", err)
+	}
+}
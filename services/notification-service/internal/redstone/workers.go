@@ -0,0 +1,129 @@
+package redstone
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// SetWorkers makes Run handle up to n messages at once, on the source topic
+// and on each retry tier. Messages with the same key always go to the same
+// worker, so per-key order is kept; offsets are committed only up to the
+// last message of a partition whose predecessors are all done.
+func (c *Consumer) SetWorkers(n int) {
+	c.workers = n
+}
+
+// fetched is a message tracked by offsetTracker.
+type fetched struct {
+	m    kafka.Message
+	done bool
+}
+
+// offsetTracker decides which offset is safe to commit while messages of a
+// partition complete out of order. Each fetch is tracked on its own: after a
+// rebalance the reader fetches uncommitted offsets again while the first
+// copies may still be in flight.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[int][]*fetched
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[int][]*fetched)}
+}
+
+func (t *offsetTracker) track(m kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partitions[m.Partition] = append(t.partitions[m.Partition], &fetched{m: m})
+}
+
+// complete marks the earliest unfinished fetch of m done and returns the
+// messages of its partition that no longer have an unfinished predecessor,
+// in fetch order. Copies of an offset share a key, so they complete in
+// fetch order too.
+func (t *offsetTracker) complete(m kafka.Message) []kafka.Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending := t.partitions[m.Partition]
+	for _, f := range pending {
+		if !f.done && f.m.Offset == m.Offset {
+			f.done, f.m = true, m
+			break
+		}
+	}
+	var ready []kafka.Message
+	for len(pending) > 0 && pending[0].done {
+		ready = append(ready, pending[0].m)
+		pending = pending[1:]
+	}
+	t.partitions[m.Partition] = pending
+	return ready
+}
+
+func workerFor(key []byte, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// consumeConcurrently is consume with a per-key worker pool. Messages queued
+// but not started when ctx is cancelled are left uncommitted.
+func (c *Consumer) consumeConcurrently(ctx context.Context, log *Logger, src *Consumer, h Handler, next int, delayed bool) {
+	work := context.WithoutCancel(ctx)
+	tracker := newOffsetTracker()
+	completed := make(chan kafka.Message, c.workers)
+
+	// A single committer keeps commits of a partition monotonic.
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		for m := range completed {
+			ready := tracker.complete(m)
+			if len(ready) == 0 {
+				continue
+			}
+			// Kafka commits the last offset; the other transports ack each
+			// message, so a redelivered one still in flight is not acked.
+			if err := src.Commit(work, ready...); err != nil {
+				last := ready[len(ready)-1]
+				log.Error("consumer commit failed", map[string]any{"err": err.Error(), "topic": last.Topic, "offset": last.Offset})
+			}
+		}
+	}()
+
+	queues := make([]chan kafka.Message, c.workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan kafka.Message, 1)
+		wg.Add(1)
+		go func(q <-chan kafka.Message) {
+			defer wg.Done()
+			for m := range q {
+				if ctx.Err() != nil || !c.handle(ctx, work, log, m, h, next) {
+					continue
+				}
+				completed <- m
+			}
+		}(queues[i])
+	}
+
+	for {
+		m, ok := c.fetch(ctx, log, src, delayed)
+		if !ok {
+			break
+		}
+		tracker.track(m)
+		queues[workerFor(m.Key, c.workers)] <- m
+	}
+
+	for _, q := range queues {
+		close(q)
+	}
+	wg.Wait()
+	close(completed)
+	<-committed
+}
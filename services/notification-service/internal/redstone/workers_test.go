@@ -0,0 +1,259 @@
+package redstone
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func offsetsOf(msgs []kafka.Message) []int64 {
+	out := []int64{}
+	for _, m := range msgs {
+		out = append(out, m.Offset)
+	}
+	return out
+}
+
+func TestOffsetTrackerOutOfOrder(t *testing.T) {
+	tr := newOffsetTracker()
+	msg := func(p int, off int64) kafka.Message { return kafka.Message{Partition: p, Offset: off} }
+	for off := int64(0); off < 4; off++ {
+		tr.track(msg(0, off))
+	}
+	tr.track(msg(1, 7))
+
+	for _, c := range []struct {
+		m    kafka.Message
+		want []int64
+	}{
+		{msg(0, 2), []int64{}},
+		{msg(1, 7), []int64{7}},
+		{msg(0, 0), []int64{0}},
+		{msg(0, 3), []int64{}},
+		{msg(0, 1), []int64{1, 2, 3}},
+	} {
+		if got := offsetsOf(tr.complete(c.m)); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Fatalf("complete %d/%d: ready %v, want %v", c.m.Partition, c.m.Offset, got, c.want)
+		}
+	}
+}
+
+// After a rebalance the reader fetches uncommitted offsets again while the
+// first copies may still be in flight; each fetch is tracked on its own.
+func TestOffsetTrackerRefetch(t *testing.T) {
+	tr := newOffsetTracker()
+	for _, off := range []int64{5, 6, 5, 6} {
+		tr.track(kafka.Message{Offset: off})
+	}
+	var ready []int64
+	for _, off := range []int64{6, 6, 5, 5} {
+		ready = append(ready, offsetsOf(tr.complete(kafka.Message{Offset: off}))...)
+	}
+	if fmt.Sprint(ready) != "[5 6 5 6]" {
+		t.Fatalf("ready %v, want every fetch once", ready)
+	}
+	tr.track(kafka.Message{Offset: 7})
+	if got := offsetsOf(tr.complete(kafka.Message{Offset: 7})); fmt.Sprint(got) != "[7]" {
+		t.Fatalf("ready %v after refetch, want [7]", got)
+	}
+}
+
+// committedOffset is the next offset group will read from partition p.
+func committedOffset(b *MemoryBroker, topic, group string, p int) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.group(topic, group).committed[p]
+}
+
+func waitFor(t *testing.T, ctx context.Context, what string, cond func() bool) {
+	t.Helper()
+	for !cond() {
+		if ctx.Err() != nil {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func writeKeyed(t *testing.T, ctx context.Context, p *Producer, keys ...string) {
+	t.Helper()
+	for _, k := range keys {
+		if err := p.WriteMessage(ctx, kafka.Message{Key: []byte(k), Value: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runWorkers runs c with n workers until the returned stop is called.
+func runWorkers(c *Consumer, n int, h Handler) (stop func()) {
+	c.SetWorkers(n)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, NewLogger("test"), h)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// Messages of a key are handled in order even when handlers take varying
+// time, and everything is committed.
+func TestWorkersKeepKeyOrder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := NewMemoryBroker(1)
+	var keys []string
+	for i := 0; i < 200; i++ {
+		keys = append(keys, fmt.Sprint("k", i%7))
+	}
+	writeKeyed(t, ctx, b.Producer("t"), keys...)
+
+	var mu sync.Mutex
+	last := map[string]int64{}
+	stop := runWorkers(b.Consumer("t", "g"), 4, func(_ context.Context, m kafka.Message) error {
+		time.Sleep(time.Duration(rand.Intn(300)) * time.Microsecond)
+		mu.Lock()
+		defer mu.Unlock()
+		if prev, ok := last[string(m.Key)]; ok && prev >= m.Offset {
+			t.Errorf("key %s: offset %d handled after %d", m.Key, m.Offset, prev)
+		}
+		last[string(m.Key)] = m.Offset
+		return nil
+	})
+	defer stop()
+	waitFor(t, ctx, "all offsets committed", func() bool { return committedOffset(b, "t", "g", 0) == int64(len(keys)) })
+}
+
+// A slow message holds back the commit of later ones that finished first.
+func TestWorkersCommitAfterSlowMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := NewMemoryBroker(1)
+	writeKeyed(t, ctx, b.Producer("t"), "a", "b", "b", "b")
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	handled := 0
+	stop := runWorkers(b.Consumer("t", "g"), 2, func(_ context.Context, m kafka.Message) error {
+		if string(m.Key) == "a" {
+			<-release
+		}
+		mu.Lock()
+		handled++
+		mu.Unlock()
+		return nil
+	})
+	defer stop()
+	waitFor(t, ctx, "b handled", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handled == 3
+	})
+	if off := committedOffset(b, "t", "g", 0); off != 0 {
+		t.Fatalf("committed %d while offset 0 is in flight", off)
+	}
+	close(release)
+	waitFor(t, ctx, "all offsets committed", func() bool { return committedOffset(b, "t", "g", 0) == 4 })
+}
+
+// Messages fetched but not started when Run stops stay uncommitted and are
+// delivered again; the one in flight finishes and is committed.
+func TestWorkersShutdownLeavesQueuedUncommitted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := NewMemoryBroker(1)
+	writeKeyed(t, ctx, b.Producer("t"), "a", "a", "a")
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var handled []int64
+	c := b.Consumer("t", "g")
+	stop := runWorkers(c, 2, func(_ context.Context, m kafka.Message) error {
+		if m.Offset == 0 {
+			close(started)
+			<-release
+		}
+		mu.Lock()
+		handled = append(handled, m.Offset)
+		mu.Unlock()
+		return nil
+	})
+	<-started
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	// Let Run see the cancellation before the worker frees up.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-stopped
+	c.Close()
+
+	if fmt.Sprint(handled) != "[0]" {
+		t.Fatalf("handled %v after shutdown, want only the one in flight", handled)
+	}
+	if off := committedOffset(b, "t", "g", 0); off != 1 {
+		t.Fatalf("committed %d, want 1", off)
+	}
+	m, err := b.Consumer("t", "g").Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Offset != 1 {
+		t.Fatalf("redelivered offset %d, want 1", m.Offset)
+	}
+}
+
+// A rebalance while a message is in flight makes the reader fetch it and
+// its successors again; once the duplicates are handled, commits go on.
+func TestWorkersRebalance(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if workerFor([]byte("a"), 2) == workerFor([]byte("b"), 2) {
+		t.Fatal("keys a and b share a worker")
+	}
+	b := NewMemoryBroker(1)
+	p := b.Producer("t")
+	writeKeyed(t, ctx, p, "a", "b")
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	seen := map[int64]int{}
+	count := func(off int64) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return seen[off]
+	}
+	stop := runWorkers(b.Consumer("t", "g"), 2, func(_ context.Context, m kafka.Message) error {
+		mu.Lock()
+		seen[m.Offset]++
+		first := m.Offset == 0 && seen[0] == 1
+		mu.Unlock()
+		if first {
+			<-release
+		}
+		return nil
+	})
+	defer stop()
+	waitFor(t, ctx, "offset 1 handled", func() bool { return count(1) == 1 })
+
+	// A member joins; partition 0 stays with the running consumer, which
+	// restarts from the committed offset 0.
+	idle := b.Consumer("t", "g")
+	defer idle.Close()
+	waitFor(t, ctx, "offset 1 fetched again", func() bool { return count(1) == 2 })
+	close(release)
+	waitFor(t, ctx, "offset 0 handled again", func() bool { return count(0) == 2 })
+
+	writeKeyed(t, ctx, p, "b")
+	waitFor(t, ctx, "offset 2 committed", func() bool { return committedOffset(b, "t", "g", 0) == 3 })
+}
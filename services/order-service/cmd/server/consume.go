@@ -3,118 +3,160 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"time"
+	"errors"
 
-	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
 
 	"github.com/redstone/order-service/internal/redstone"
 )
 
-func (a *App) consumeInventoryLoop(ctx context.Context) {
-	for {
-		m, err := a.invConsumer.Fetch(ctx)
-		if err != nil {
-			a.log.Error("inventory fetch failed", map[string]any{"err": err.Error()})
-			time.Sleep(500 * time.Millisecond)
-			continue
+func (a *App) handleInventoryEvent(ctx context.Context, m kafka.Message) error {
+	md := redstone.MetadataOf(m)
+	switch md.EventType {
+	case "InventoryReserved":
+		var ev redstone.InventoryReserved
+		if err := redstone.Decode(m, &ev); err != nil {
+			return err
 		}
-
-		var envelope map[string]any
-		if err := json.Unmarshal(m.Value, &envelope); err != nil {
-			_ = a.invConsumer.Commit(ctx, m)
-			continue
+		return a.applyOnce(ctx, md.EventID, func(tx *orderTx) error {
+			return tx.setStatus(ctx, ev.OrderID, "INVENTORY_RESERVED", "InventoryReserved", mustJSON(ev))
+		})
+	case "InventoryFailed":
+		var ev redstone.InventoryFailed
+		if err := redstone.Decode(m, &ev); err != nil {
+			return err
 		}
-
-		// Determine event type
-		et, _ := envelope["event_type"].(string)
-		switch et {
-		case "InventoryReserved":
-			var ev redstone.InventoryReserved
-			if json.Unmarshal(m.Value, &ev) == nil {
-				_ = updateOrderStatus(ctx, a.db, a.log, ev.OrderID, "INVENTORY_RESERVED", "InventoryReserved", m.Value)
+		return a.applyOnce(ctx, md.EventID, func(tx *orderTx) error {
+			if err := tx.setStatus(ctx, ev.OrderID, "CANCELLED", "InventoryFailed", mustJSON(ev)); err != nil {
+				return err
 			}
-		case "InventoryFailed":
-			var ev redstone.InventoryFailed
-			if json.Unmarshal(m.Value, &ev) == nil {
-				_ = updateOrderStatus(ctx, a.db, a.log, ev.OrderID, "CANCELLED", "InventoryFailed", m.Value)
-				// Emit OrderCancelled for notifications
-				cancel := redstone.OrderCancelled{
-					BaseEvent: redstone.BaseEvent{
-						EventID: uuid.NewString(),
-						EventType: "OrderCancelled",
-						OccurredAt: time.Now().UTC(),
-						CorrelationID: ev.CorrelationID,
-					},
-					OrderID: ev.OrderID,
-					Reason: ev.Reason,
-				}
-				_ = a.ordersProducer.Write(ctx, ev.OrderID, cancel)
+			// Emit OrderCancelled for notifications
+			cancel := redstone.OrderCancelled{
+				BaseEvent: redstone.CausedBy(ev.BaseEvent, "OrderCancelled"),
+				OrderID:   ev.OrderID,
+				Reason:    ev.Reason,
 			}
-		}
-
-		_ = a.invConsumer.Commit(ctx, m)
+			return tx.enqueue(ctx, ev.OrderID, "OrderCancelled", cancel)
+		})
 	}
+
+	return nil
 }
 
-func (a *App) consumePaymentLoop(ctx context.Context) {
-	for {
-		m, err := a.payConsumer.Fetch(ctx)
-		if err != nil {
-			a.log.Error("payment fetch failed", map[string]any{"err": err.Error()})
-			time.Sleep(500 * time.Millisecond)
-			continue
+func (a *App) handlePaymentEvent(ctx context.Context, m kafka.Message) error {
+	md := redstone.MetadataOf(m)
+	switch md.EventType {
+	case "PaymentCaptured":
+		var ev redstone.PaymentCaptured
+		if err := redstone.Decode(m, &ev); err != nil {
+			return err
 		}
-
-		var envelope map[string]any
-		if err := json.Unmarshal(m.Value, &envelope); err != nil {
-			_ = a.payConsumer.Commit(ctx, m)
-			continue
+		return a.applyOnce(ctx, md.EventID, func(tx *orderTx) error {
+			if err := tx.setStatus(ctx, ev.OrderID, "PAID", "PaymentCaptured", mustJSON(ev)); err != nil {
+				return err
+			}
+			// Confirm order
+			confirm := redstone.OrderConfirmed{
+				BaseEvent: redstone.CausedBy(ev.BaseEvent, "OrderConfirmed"),
+				OrderID:   ev.OrderID,
+			}
+			if err := tx.enqueue(ctx, ev.OrderID, "OrderConfirmed", confirm); err != nil {
+				return err
+			}
+			return tx.setStatus(ctx, ev.OrderID, "CONFIRMED", "OrderConfirmed", mustJSON(confirm))
+		})
+	case "PaymentFailed":
+		var ev redstone.PaymentFailed
+		if err := redstone.Decode(m, &ev); err != nil {
+			return err
 		}
-
-		et, _ := envelope["event_type"].(string)
-		switch et {
-		case "PaymentCaptured":
-			var ev redstone.PaymentCaptured
-			if json.Unmarshal(m.Value, &ev) == nil {
-				_ = updateOrderStatus(ctx, a.db, a.log, ev.OrderID, "PAID", "PaymentCaptured", m.Value)
-				// Confirm order
-				confirm := redstone.OrderConfirmed{
-					BaseEvent: redstone.BaseEvent{
-						EventID: uuid.NewString(),
-						EventType: "OrderConfirmed",
-						OccurredAt: time.Now().UTC(),
-						CorrelationID: ev.CorrelationID,
-					},
-					OrderID: ev.OrderID,
-				}
-				_ = a.ordersProducer.Write(ctx, ev.OrderID, confirm)
-				_ = updateOrderStatus(ctx, a.db, a.log, ev.OrderID, "CONFIRMED", "OrderConfirmed", mustJSON(confirm))
+		return a.applyOnce(ctx, md.EventID, func(tx *orderTx) error {
+			if err := tx.setStatus(ctx, ev.OrderID, "CANCELLED", "PaymentFailed", mustJSON(ev)); err != nil {
+				return err
 			}
-		case "PaymentFailed":
-			var ev redstone.PaymentFailed
-			if json.Unmarshal(m.Value, &ev) == nil {
-				_ = updateOrderStatus(ctx, a.db, a.log, ev.OrderID, "CANCELLED", "PaymentFailed", m.Value)
-				cancel := redstone.OrderCancelled{
-					BaseEvent: redstone.BaseEvent{
-						EventID: uuid.NewString(),
-						EventType: "OrderCancelled",
-						OccurredAt: time.Now().UTC(),
-						CorrelationID: ev.CorrelationID,
-					},
-					OrderID: ev.OrderID,
-					Reason: ev.Reason,
-				}
-				_ = a.ordersProducer.Write(ctx, ev.OrderID, cancel)
+			cancel := redstone.OrderCancelled{
+				BaseEvent: redstone.CausedBy(ev.BaseEvent, "OrderCancelled"),
+				OrderID:   ev.OrderID,
+				Reason:    ev.Reason,
 			}
+			return tx.enqueue(ctx, ev.OrderID, "OrderCancelled", cancel)
+		})
+	}
+
+	return nil
+}
+
+// orderTx is the transaction a consumed event is applied in. Status changes
+// are collected so they are logged and counted only once it commits.
+type orderTx struct {
+	storeTx
+	changes []statusChange
+}
+
+type statusChange struct {
+	orderID, status, eventType string
+}
+
+// applyOnce runs fn in a transaction that also records eventID in
+// processed_events, so a redelivered event has no effect. Outgoing events
+// must be written with tx.enqueue to share that guarantee.
+func (a *App) applyOnce(ctx context.Context, eventID string, fn func(tx *orderTx) error) error {
+	if eventID == "" {
+		return errors.New("missing event_id")
+	}
+	var tx *orderTx
+	applied, err := a.db.applyOnce(ctx, eventID, func(st storeTx) error {
+		tx = &orderTx{storeTx: st}
+		return fn(tx)
+	})
+	if err != nil {
+		return redstone.Retryable(err)
+	}
+	if !applied {
+		a.log.InfoContext(ctx, "duplicate event skipped", map[string]any{"event_id": eventID})
+		return nil
+	}
+
+	for _, c := range tx.changes {
+		a.log.InfoContext(ctx, "order status updated", map[string]any{"order_id": c.orderID, "status": c.status, "event": c.eventType})
+		switch c.status {
+		case "CONFIRMED":
+			redstone.RecordSagaOutcome("confirmed", c.eventType)
+		case "CANCELLED":
+			redstone.RecordSagaOutcome("cancelled", c.eventType)
 		}
+	}
+	return nil
+}
 
-		_ = a.payConsumer.Commit(ctx, m)
+// setStatus moves the order to newStatus and appends to its timeline; it is
+// a no-op when the order is already in that status.
+func (tx *orderTx) setStatus(ctx context.Context, orderID, newStatus, eventType string, payload []byte) error {
+	current, err := tx.lockStatus(ctx, orderID)
+	if err != nil {
+		return err
 	}
+	if current == newStatus {
+		// idempotent
+		return nil
+	}
+
+	if err := tx.updateStatus(ctx, orderID, newStatus); err != nil {
+		return err
+	}
+	if err := tx.appendEvent(ctx, orderID, eventType, payload); err != nil {
+		return err
+	}
+	tx.changes = append(tx.changes, statusChange{orderID: orderID, status: newStatus, eventType: eventType})
+	return nil
+}
+
+// enqueue writes ev to the outbox; the relay publishes it once tx commits.
+func (tx *orderTx) enqueue(ctx context.Context, orderID, eventType string, ev any) error {
+	return tx.storeTx.enqueue(ctx, orderID, eventType, mustJSON(ev), redstone.TraceParent(ctx))
 }
 
 func mustJSON(v any) []byte {
 	b, _ := json.Marshal(v)
 	return b
 }
-
-var _ = uuid.NewString
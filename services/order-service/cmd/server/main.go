@@ -4,14 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/exaring/otelpgx"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/redstone/order-service/internal/redstone"
@@ -21,11 +25,17 @@ type Config struct {
 	ServiceName    string
 	HTTPPort       string
 	DatabaseURL    string
-	KafkaBrokers   []string
+	Kafka          redstone.KafkaConfig
 	TopicOrders    string
 	TopicInventory string
 	TopicPayments  string
 	GroupID        string
+	RetryDelays    []time.Duration
+	TracesExporter string
+	Validation     redstone.ValidationMode
+	EventFormat    redstone.EventFormat
+	Codec          redstone.Codec
+	OTLPEndpoint   string
 }
 
 type CreateOrderRequest struct {
@@ -45,15 +55,19 @@ func env(key, def string) string {
 	return v
 }
 
-func parseCSV(s string) []string {
-	var out []string
+func parseDurations(s string) ([]time.Duration, error) {
+	var out []time.Duration
 	for _, p := range strings.Split(s, ",") {
-		p = strings.TrimSpace(p)
-		if p != "" {
-			out = append(out, p)
+		if p = strings.TrimSpace(p); p == "" {
+			continue
 		}
+		d, err := time.ParseDuration(p)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
 	}
-	return out
+	return out, nil
 }
 
 func main() {
@@ -61,70 +75,165 @@ func main() {
 		ServiceName:    env("SERVICE_NAME", "order-service"),
 		HTTPPort:       env("HTTP_PORT", "8081"),
 		DatabaseURL:    env("DATABASE_URL", ""),
-		KafkaBrokers:   parseCSV(env("KAFKA_BROKERS", "localhost:9092")),
 		TopicOrders:    env("KAFKA_TOPIC_ORDERS", "redstone.orders"),
 		TopicInventory: env("KAFKA_TOPIC_INVENTORY", "redstone.inventory"),
 		TopicPayments:  env("KAFKA_TOPIC_PAYMENTS", "redstone.payments"),
 		GroupID:        env("KAFKA_GROUP_ID", "order-service"),
+		TracesExporter: env("OTEL_TRACES_EXPORTER", "otlp"),
+		OTLPEndpoint:   env("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
 	}
 
 	log := redstone.NewLogger(cfg.ServiceName)
+	level, err := redstone.ParseLevel(env("LOG_LEVEL", "info"))
+	if err != nil {
+		log.Error("invalid LOG_LEVEL", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	log.SetLevel(level)
+	// Libraries logging through log/slog end up in the service log.
+	slog.SetDefault(slog.New(log.Handler()))
+	kafkaCfg, err := redstone.LoadKafkaConfig(env)
+	if err != nil {
+		log.Error("invalid kafka config", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	cfg.Kafka = kafkaCfg
+	if cfg.RetryDelays, err = parseDurations(env("KAFKA_RETRY_DELAYS", "5s,1m,10m")); err != nil {
+		log.Error("invalid KAFKA_RETRY_DELAYS", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.Validation, err = redstone.ParseValidationMode(env("SCHEMA_VALIDATION", "warn")); err != nil {
+		log.Error("invalid SCHEMA_VALIDATION", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.EventFormat, err = redstone.ParseEventFormat(env("EVENT_FORMAT", "redstone")); err != nil {
+		log.Error("invalid EVENT_FORMAT", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.Codec, err = redstone.ParseCodec(env("EVENT_CODEC", "json")); err != nil {
+		log.Error("invalid EVENT_CODEC", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if err := redstone.CheckCodec(cfg.EventFormat, cfg.Codec); err != nil {
+		log.Error("invalid EVENT_CODEC", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
 
 	if cfg.DatabaseURL == "" {
 		log.Error("DATABASE_URL is required", nil)
 		os.Exit(1)
 	}
 
-	ctx := context.Background()
-	db, err := pgxpool.New(ctx, cfg.DatabaseURL)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownTracing, err := redstone.InitTracing(ctx, redstone.TracingConfig{
+		ServiceName: cfg.ServiceName,
+		Exporter:    cfg.TracesExporter,
+		Endpoint:    cfg.OTLPEndpoint,
+	})
+	if err != nil {
+		log.Error("tracing init failed", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	poolCfg, err := pgxpool.ParseConfig(cfg.DatabaseURL)
+	if err != nil {
+		log.Error("invalid DATABASE_URL", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	poolCfg.ConnConfig.Tracer = otelpgx.NewTracer()
+	db, err := pgxpool.NewWithConfig(ctx, poolCfg)
 	if err != nil {
 		log.Error("db connect failed", map[string]any{"err": err.Error()})
 		os.Exit(1)
 	}
 	defer db.Close()
+	redstone.RegisterDBPool(func() redstone.PoolStats { return db.Stat() })
 
 	if err := migrate(ctx, db); err != nil {
 		log.Error("migration failed", map[string]any{"err": err.Error()})
 		os.Exit(1)
 	}
 
-	ordersProducer := redstone.NewProducer(cfg.KafkaBrokers, cfg.TopicOrders)
+	validator := redstone.NewValidator(cfg.Validation, log)
+	ordersProducer := redstone.NewProducer(cfg.Kafka, cfg.TopicOrders)
+	ordersProducer.SetValidator(validator)
+	ordersProducer.SetFormat(cfg.EventFormat, "/redstone/"+cfg.ServiceName)
+	ordersProducer.SetCodec(cfg.Codec)
 	defer ordersProducer.Close()
 
 	// Consumers for saga results
-	invConsumer := redstone.NewConsumer(cfg.KafkaBrokers, cfg.TopicInventory, cfg.GroupID)
-	payConsumer := redstone.NewConsumer(cfg.KafkaBrokers, cfg.TopicPayments, cfg.GroupID)
+	invConsumer := redstone.NewRetryingConsumer(cfg.Kafka, cfg.TopicInventory, cfg.GroupID, cfg.RetryDelays)
+	invConsumer.SetValidator(validator)
+	payConsumer := redstone.NewRetryingConsumer(cfg.Kafka, cfg.TopicPayments, cfg.GroupID, cfg.RetryDelays)
+	payConsumer.SetValidator(validator)
 	defer invConsumer.Close()
 	defer payConsumer.Close()
+	if err := redstone.EnsureTopics(ctx, cfg.Kafka, append(append([]string{ordersProducer.Topic()}, invConsumer.Topics()...), payConsumer.Topics()...)...); err != nil {
+		log.Error("topic check failed", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
 
-	app := &App{cfg: cfg, log: log, db: db, ordersProducer: ordersProducer, invConsumer: invConsumer, payConsumer: payConsumer}
+	app := &App{cfg: cfg, log: log, db: &pgStore{db: db}, ordersProducer: ordersProducer, invConsumer: invConsumer, payConsumer: payConsumer}
 
-	go app.outboxLoop(ctx)
-	go app.consumeInventoryLoop(ctx)
-	go app.consumePaymentLoop(ctx)
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() { defer wg.Done(); f() }()
+	}
+	run(func() { app.outboxLoop(ctx) })
+	run(func() { invConsumer.Run(ctx, log, app.handleInventoryEvent) })
+	run(func() { payConsumer.Run(ctx, log, app.handlePaymentEvent) })
 
 	r := chi.NewRouter()
+	r.Use(redstone.TraceRoutes)
+	r.Use(redstone.MeasureHTTP)
 	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200); w.Write([]byte("ok")) })
+	r.Get("/readyz", redstone.ReadyHandler(map[string]redstone.Check{
+		"postgres":           db.Ping,
+		"kafka_orders":       ordersProducer.Check,
+		"consumer_inventory": invConsumer.Check,
+		"consumer_payments":  payConsumer.Check,
+	}))
+	r.Handle("/metrics", redstone.MetricsHandler())
 	r.Post("/v1/orders", app.createOrderHandler)
 
 	srv := &http.Server{
 		Addr:              ":" + cfg.HTTPPort,
-		Handler:           r,
+		Handler:           redstone.TraceHTTP(cfg.ServiceName, r),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
-	log.Info("http server starting", map[string]any{"port": cfg.HTTPPort})
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Error("http server error", map[string]any{"err": err.Error()})
+	go func() {
+		log.Info("http server starting", map[string]any{"port": cfg.HTTPPort})
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("http server error", map[string]any{"err": err.Error()})
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info("shutting down", nil)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Error("http shutdown failed", map[string]any{"err": err.Error()})
 	}
+	// Loops return once their in-flight message is handled and committed;
+	// deferred closes then release Kafka, the DB pool and the exporter.
+	wg.Wait()
 }
 
+// currency of every order; prices are integer minor units.
+const currency = "INR"
+
 type App struct {
 	cfg            Config
 	log            *redstone.Logger
-	db             *pgxpool.Pool
-	ordersProducer *redstone.Producer
-	invConsumer    *redstone.Consumer
-	payConsumer    *redstone.Consumer
+	db             store
+	ordersProducer redstone.Publisher
+	invConsumer    redstone.Subscriber
+	payConsumer    redstone.Subscriber
 }
 
 func (a *App) createOrderHandler(w http.ResponseWriter, r *http.Request) {
@@ -149,7 +258,7 @@ func (a *App) createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	var total int64
 	items := make([]redstone.OrderItem, 0, len(req.Items))
 	for _, it := range req.Items {
-		if it.SKU == "" || it.Qty <= 0 || it.UnitPrice < 0 {
+		if it.SKU == "" || it.Qty <= 0 || it.UnitPrice <= 0 {
 			http.Error(w, "invalid item", 400)
 			return
 		}
@@ -158,10 +267,13 @@ func (a *App) createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Idempotency: return existing order if idem key already used
-	var existingID string
-	err := a.db.QueryRow(ctx, `select order_id from idempotency where idem_key=$1`, idem).Scan(&existingID)
-	if err == nil && existingID != "" {
-		ord, err := a.getOrder(ctx, existingID)
+	existingID, err := a.db.orderForIdemKey(ctx, idem)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if existingID != "" {
+		ord, err := a.db.getOrder(ctx, existingID)
 		if err != nil {
 			http.Error(w, "failed to load order", 500)
 			return
@@ -171,69 +283,30 @@ func (a *App) createOrderHandler(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(ord)
 		return
 	}
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
-		http.Error(w, "db error", 500)
-		return
-	}
 
 	orderID := "ord_" + uuid.NewString()
 	corr := uuid.NewString()
 
-	tx, err := a.db.Begin(ctx)
-	if err != nil {
-		http.Error(w, "db error", 500)
-		return
-	}
-	defer tx.Rollback(ctx)
-
-	_, err = tx.Exec(ctx, `insert into orders(id,user_id,status,total_amount,currency,created_at,updated_at) values ($1,$2,$3,$4,$5,now(),now())`,
-		orderID, req.UserID, "PENDING", total, "INR")
-	if err != nil {
-		http.Error(w, "db error", 500)
-		return
-	}
-	for _, it := range items {
-		_, err = tx.Exec(ctx, `insert into order_items(order_id,sku,qty,unit_price,total_price) values ($1,$2,$3,$4,$5)`,
-			orderID, it.SKU, it.Qty, it.UnitPrice, int64(it.Qty)*it.UnitPrice)
-		if err != nil {
-			http.Error(w, "db error", 500)
-			return
-		}
-	}
-
-	// store idempotency mapping
-	_, _ = tx.Exec(ctx, `insert into idempotency(idem_key,order_id,created_at) values ($1,$2,now()) on conflict (idem_key) do nothing`, idem, orderID)
-
 	// Outbox event
-	ev := redstone.OrderCreated{
-		BaseEvent: redstone.BaseEvent{
-			EventID:       uuid.NewString(),
-			EventType:     "OrderCreated",
-			OccurredAt:    time.Now().UTC(),
-			CorrelationID: corr,
-		},
-		OrderID: orderID,
-		UserID:  req.UserID,
-		Items:   items,
-	}
+	ev := redstone.NewOrderCreated(redstone.BaseEvent{
+		EventID:       uuid.NewString(),
+		OccurredAt:    time.Now().UTC(),
+		CorrelationID: corr,
+	}, orderID, req.UserID, items, currency)
 	b, _ := json.Marshal(ev)
-	_, err = tx.Exec(ctx, `insert into outbox(aggregate_id,event_type,payload,status,created_at) values ($1,$2,$3,'PENDING',now())`,
-		orderID, "OrderCreated", b)
+	err = a.db.createOrder(ctx, newOrder{
+		Order:       Order{ID: orderID, UserID: req.UserID, Status: "PENDING", TotalAmount: total, Currency: currency},
+		IdemKey:     idem,
+		Items:       items,
+		Created:     b,
+		TraceParent: redstone.TraceParent(ctx),
+	})
 	if err != nil {
 		http.Error(w, "db error", 500)
 		return
 	}
 
-	// Audit timeline
-	_, _ = tx.Exec(ctx, `insert into order_events(order_id,type,payload,created_at) values ($1,$2,$3,now())`,
-		orderID, "OrderCreated", b)
-
-	if err := tx.Commit(ctx); err != nil {
-		http.Error(w, "db error", 500)
-		return
-	}
-
-	ord, _ := a.getOrder(ctx, orderID)
+	ord, _ := a.db.getOrder(ctx, orderID)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(201)
 	_ = json.NewEncoder(w).Encode(ord)
@@ -246,13 +319,3 @@ type Order struct {
 	TotalAmount int64  `json:"total_amount"`
 	Currency    string `json:"currency"`
 }
-
-func (a *App) getOrder(ctx context.Context, id string) (*Order, error) {
-	var o Order
-	err := a.db.QueryRow(ctx, `select id,user_id,status,total_amount,currency from orders where id=$1`, id).
-		Scan(&o.ID, &o.UserID, &o.Status, &o.TotalAmount, &o.Currency)
-	if err != nil {
-		return nil, err
-	}
-	return &o, nil
-}
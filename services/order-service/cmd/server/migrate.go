@@ -46,6 +46,11 @@ func migrate(ctx context.Context, db *pgxpool.Pool) error {
 			created_at timestamptz not null,
 			published_at timestamptz null
 		)`,
+		`alter table outbox add column if not exists trace_parent text null`,
+		`create table if not exists processed_events(
+			event_id text primary key,
+			processed_at timestamptz not null
+		)`,
 	}
 	for _, s := range stmts {
 		if _, err := db.Exec(ctx, s); err != nil {
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/redstone/order-service/internal/redstone"
+)
+
+// memStore is store in memory. A transaction holds the lock throughout and
+// its writes apply only if it succeeds.
+type memStore struct {
+	mu        sync.Mutex
+	orders    map[string]*Order
+	idem      map[string]string
+	processed map[string]bool
+	timeline  map[string][]string
+	outbox    []outboxRow
+	published map[int64]bool
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		orders:    make(map[string]*Order),
+		idem:      make(map[string]string),
+		processed: make(map[string]bool),
+		timeline:  make(map[string][]string),
+		published: make(map[int64]bool),
+	}
+}
+
+func (s *memStore) orderForIdemKey(_ context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.idem[key], nil
+}
+
+func (s *memStore) createOrder(_ context.Context, o newOrder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.orders[o.ID]; ok {
+		return fmt.Errorf("order %s exists", o.ID)
+	}
+	ord := o.Order
+	s.orders[o.ID] = &ord
+	if _, ok := s.idem[o.IdemKey]; !ok {
+		s.idem[o.IdemKey] = o.ID
+	}
+	s.addOutbox(o.ID, "OrderCreated", o.Created, o.TraceParent)
+	s.timeline[o.ID] = append(s.timeline[o.ID], "OrderCreated")
+	return nil
+}
+
+func (s *memStore) addOutbox(orderID, eventType string, payload []byte, traceParent string) {
+	s.outbox = append(s.outbox, outboxRow{
+		ID:          int64(len(s.outbox) + 1),
+		AggregateID: orderID,
+		EventType:   eventType,
+		Payload:     payload,
+		TraceParent: traceParent,
+		CreatedAt:   time.Now(),
+	})
+}
+
+func (s *memStore) getOrder(_ context.Context, id string) (*Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[id]
+	if !ok {
+		return nil, fmt.Errorf("order %s not found", id)
+	}
+	cp := *o
+	return &cp, nil
+}
+
+func (s *memStore) applyOnce(_ context.Context, eventID string, fn func(tx storeTx) error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.processed[eventID] {
+		return false, nil
+	}
+	tx := &memTx{s: s, status: make(map[string]string)}
+	if err := fn(tx); err != nil {
+		return false, err
+	}
+	s.processed[eventID] = true
+	for id, st := range tx.status {
+		s.orders[id].Status = st
+	}
+	for _, e := range tx.events {
+		s.timeline[e[0]] = append(s.timeline[e[0]], e[1])
+	}
+	for _, r := range tx.outbox {
+		s.addOutbox(r.AggregateID, r.EventType, r.Payload, r.TraceParent)
+	}
+	return true, nil
+}
+
+func (s *memStore) countPendingOutbox(_ context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.outbox) - len(s.published)), nil
+}
+
+func (s *memStore) pendingOutbox(_ context.Context, limit int) ([]outboxRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var batch []outboxRow
+	for _, r := range s.outbox {
+		if !s.published[r.ID] && len(batch) < limit {
+			batch = append(batch, r)
+		}
+	}
+	return batch, nil
+}
+
+func (s *memStore) markPublished(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published[id] = true
+	return nil
+}
+
+// events returns the order's timeline.
+func (s *memStore) events(id string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.timeline[id]...)
+}
+
+// memTx buffers the writes of one applyOnce; the store is locked.
+type memTx struct {
+	s      *memStore
+	status map[string]string
+	events [][2]string
+	outbox []outboxRow
+}
+
+func (t *memTx) lockStatus(_ context.Context, orderID string) (string, error) {
+	if st, ok := t.status[orderID]; ok {
+		return st, nil
+	}
+	o, ok := t.s.orders[orderID]
+	if !ok {
+		return "", fmt.Errorf("order %s not found", orderID)
+	}
+	return o.Status, nil
+}
+
+func (t *memTx) updateStatus(_ context.Context, orderID, status string) error {
+	t.status[orderID] = status
+	return nil
+}
+
+func (t *memTx) appendEvent(_ context.Context, orderID, eventType string, _ []byte) error {
+	t.events = append(t.events, [2]string{orderID, eventType})
+	return nil
+}
+
+func (t *memTx) enqueue(_ context.Context, orderID, eventType string, payload []byte, traceParent string) error {
+	t.outbox = append(t.outbox, outboxRow{AggregateID: orderID, EventType: eventType, Payload: payload, TraceParent: traceParent})
+	return nil
+}
+
+// saga runs order-service on a MemoryBroker and an in-memory store, with
+// inventory-service and payment-service played by stand-ins that follow
+// their event contracts: SKU "SOLD-OUT" is out of stock, and payments above
+// 10000 are declined.
+type saga struct {
+	t      *testing.T
+	broker *redstone.MemoryBroker
+	db     *memStore
+	app    *App
+}
+
+func startSaga(t *testing.T) *saga {
+	t.Helper()
+	cfg := Config{
+		ServiceName:    "order-service",
+		TopicOrders:    "redstone.orders",
+		TopicInventory: "redstone.inventory",
+		TopicPayments:  "redstone.payments",
+		GroupID:        "order-service",
+	}
+	b := redstone.NewMemoryBroker(3)
+	log := redstone.NewLogger("test")
+	log.SetLevel(slog.LevelError)
+	s := &saga{t: t, broker: b, db: newMemStore()}
+	s.app = &App{
+		cfg:            cfg,
+		log:            log,
+		db:             s.db,
+		ordersProducer: b.Producer(cfg.TopicOrders),
+		invConsumer:    b.RetryingConsumer(cfg.TopicInventory, cfg.GroupID, nil),
+		payConsumer:    b.RetryingConsumer(cfg.TopicPayments, cfg.GroupID, nil),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() { defer wg.Done(); f() }()
+	}
+	run(func() { s.app.outboxLoop(ctx) })
+	run(func() { s.app.invConsumer.Run(ctx, log, s.app.handleInventoryEvent) })
+	run(func() { s.app.payConsumer.Run(ctx, log, s.app.handlePaymentEvent) })
+
+	inventory := b.Producer(cfg.TopicInventory)
+	run(func() {
+		b.Consumer(cfg.TopicOrders, "inventory-service").Run(ctx, log, func(ctx context.Context, m kafka.Message) error {
+			if redstone.MetadataOf(m).EventType != "OrderCreated" {
+				return nil
+			}
+			var ev redstone.OrderCreated
+			if err := redstone.Decode(m, &ev); err != nil {
+				return err
+			}
+			var amount int64
+			for _, it := range ev.Items {
+				if it.SKU == "SOLD-OUT" {
+					return inventory.Write(ctx, ev.OrderID, redstone.NewInventoryFailed(redstone.CausedBy(ev.BaseEvent, "InventoryFailed"), ev.OrderID, "insufficient stock"))
+				}
+				amount += int64(it.Qty) * it.UnitPrice
+			}
+			return inventory.Write(ctx, ev.OrderID, redstone.NewInventoryReserved(redstone.CausedBy(ev.BaseEvent, "InventoryReserved"), ev.OrderID, amount))
+		})
+	})
+	payments := b.Producer(cfg.TopicPayments)
+	run(func() {
+		b.Consumer(cfg.TopicInventory, "payment-service").Run(ctx, log, func(ctx context.Context, m kafka.Message) error {
+			if redstone.MetadataOf(m).EventType != "InventoryReserved" {
+				return nil
+			}
+			var ev redstone.InventoryReserved
+			if err := redstone.Decode(m, &ev); err != nil {
+				return err
+			}
+			// Order-service applies inventory and payment results from
+			// different topics; a real payment takes long enough that the
+			// reservation is applied first.
+			s.waitStatus(ev.OrderID, "INVENTORY_RESERVED", "CANCELLED")
+			if ev.Amount > 10000 {
+				return payments.Write(ctx, ev.OrderID, redstone.NewPaymentFailed(redstone.CausedBy(ev.BaseEvent, "PaymentFailed"), ev.OrderID, "mock decline"))
+			}
+			return payments.Write(ctx, ev.OrderID, redstone.NewPaymentCaptured(redstone.CausedBy(ev.BaseEvent, "PaymentCaptured"), ev.OrderID, ev.Amount))
+		})
+	})
+
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return s
+}
+
+// order posts an order and returns the response status and body.
+func (s *saga) order(idemKey string, body string) (int, Order) {
+	s.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/orders", bytes.NewBufferString(body))
+	req.Header.Set("Idempotency-Key", idemKey)
+	rec := httptest.NewRecorder()
+	s.app.createOrderHandler(rec, req)
+	var o Order
+	if rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &o); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	return rec.Code, o
+}
+
+// waitStatus waits until the order has one of statuses and returns it.
+func (s *saga) waitStatus(id string, statuses ...string) string {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if o, err := s.db.getOrder(context.Background(), id); err == nil {
+			for _, st := range statuses {
+				if o.Status == st {
+					return st
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ""
+}
+
+// published waits for the outbox to relay eventType for the order.
+func (s *saga) published(id, eventType string) kafka.Message {
+	s.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, m := range s.broker.Messages(s.app.cfg.TopicOrders) {
+			if md := redstone.MetadataOf(m); md.Key == id && md.EventType == eventType {
+				return m
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.t.Fatalf("%s not published for %s", eventType, id)
+	return kafka.Message{}
+}
+
+func TestSagaConfirmsOrder(t *testing.T) {
+	s := startSaga(t)
+	code, o := s.order("k1", `{"user_id":"u1","items":[{"sku":"A","qty":2,"unit_price":150}]}`)
+	if code != http.StatusCreated || o.Status != "PENDING" || o.TotalAmount != 300 {
+		t.Fatalf("create: %d %+v", code, o)
+	}
+	if st := s.waitStatus(o.ID, "CONFIRMED", "CANCELLED"); st != "CONFIRMED" {
+		t.Fatalf("status %q", st)
+	}
+	m := s.published(o.ID, "OrderConfirmed")
+	var ev redstone.OrderConfirmed
+	if err := redstone.Decode(m, &ev); err != nil {
+		t.Fatal(err)
+	}
+	created := s.published(o.ID, "OrderCreated")
+	if ev.CorrelationID != redstone.MetadataOf(created).CorrelationID {
+		t.Fatalf("correlation %q, want the order's", ev.CorrelationID)
+	}
+	want := []string{"OrderCreated", "InventoryReserved", "PaymentCaptured", "OrderConfirmed"}
+	if got := s.db.events(o.ID); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("timeline %v, want %v", got, want)
+	}
+
+	// A retried request returns the same order.
+	code, again := s.order("k1", `{"user_id":"u1","items":[{"sku":"A","qty":2,"unit_price":150}]}`)
+	if code != http.StatusOK || again.ID != o.ID {
+		t.Fatalf("retry: %d %+v", code, again)
+	}
+}
+
+func TestSagaCancelsOrder(t *testing.T) {
+	s := startSaga(t)
+	for _, tc := range []struct {
+		name, body, reason string
+		timeline           []string
+	}{
+		{"out of stock", `{"user_id":"u1","items":[{"sku":"SOLD-OUT","qty":1,"unit_price":100}]}`, "insufficient stock",
+			[]string{"InventoryFailed", "OrderCreated"}},
+		{"declined", `{"user_id":"u1","items":[{"sku":"A","qty":1,"unit_price":20000}]}`, "mock decline",
+			[]string{"InventoryReserved", "OrderCreated", "PaymentFailed"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, o := s.order(tc.name, tc.body)
+			if code != http.StatusCreated {
+				t.Fatalf("create: %d", code)
+			}
+			if st := s.waitStatus(o.ID, "CONFIRMED", "CANCELLED"); st != "CANCELLED" {
+				t.Fatalf("status %q", st)
+			}
+			var ev redstone.OrderCancelled
+			if err := redstone.Decode(s.published(o.ID, "OrderCancelled"), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.Reason != tc.reason {
+				t.Fatalf("reason %q, want %q", ev.Reason, tc.reason)
+			}
+			got := s.db.events(o.ID)
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tc.timeline) {
+				t.Fatalf("timeline %v, want %v", got, tc.timeline)
+			}
+		})
+	}
+}
+
+// Payment cannot capture a zero amount, so an order that would total zero
+// is refused up front instead of staying PENDING with its stock reserved.
+func TestSagaRejectsZeroTotal(t *testing.T) {
+	s := startSaga(t)
+	code, _ := s.order("k1", `{"user_id":"u1","items":[{"sku":"A","qty":1,"unit_price":0}]}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("create: %d, want 400", code)
+	}
+	if id, _ := s.db.orderForIdemKey(context.Background(), "k1"); id != "" {
+		t.Fatalf("order %s stored", id)
+	}
+	if n, _ := s.db.countPendingOutbox(context.Background()); n != 0 {
+		t.Fatalf("%d events enqueued", n)
+	}
+}
+
+// A redelivered result changes nothing and publishes nothing.
+func TestSagaIgnoresRedelivery(t *testing.T) {
+	s := startSaga(t)
+	_, o := s.order("k1", `{"user_id":"u1","items":[{"sku":"A","qty":1,"unit_price":100}]}`)
+	if st := s.waitStatus(o.ID, "CONFIRMED", "CANCELLED"); st != "CONFIRMED" {
+		t.Fatalf("status %q", st)
+	}
+	s.published(o.ID, "OrderConfirmed")
+	var captured kafka.Message
+	for _, m := range s.broker.Messages(s.app.cfg.TopicPayments) {
+		if redstone.MetadataOf(m).Key == o.ID {
+			captured = m
+		}
+	}
+	before := len(s.db.events(o.ID))
+	if err := s.app.handlePaymentEvent(context.Background(), captured); err != nil {
+		t.Fatal(err)
+	}
+	if after := len(s.db.events(o.ID)); after != before {
+		t.Fatalf("timeline grew from %d to %d", before, after)
+	}
+	if n, _ := s.db.countPendingOutbox(context.Background()); n != 0 {
+		t.Fatalf("%d events enqueued", n)
+	}
+}
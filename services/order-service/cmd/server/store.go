@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/redstone/order-service/internal/redstone"
+)
+
+// store is the order database. pgStore keeps it in Postgres; tests run the
+// saga on an in-memory one.
+type store interface {
+	// orderForIdemKey returns the order created under key, "" if none.
+	orderForIdemKey(ctx context.Context, key string) (string, error)
+	// createOrder stores o, its items, the idempotency key and ev in the
+	// outbox and timeline, all or nothing.
+	createOrder(ctx context.Context, o newOrder) error
+	getOrder(ctx context.Context, id string) (*Order, error)
+	// applyOnce runs fn in a transaction that also records eventID, and
+	// reports false without running fn if eventID was recorded before.
+	applyOnce(ctx context.Context, eventID string, fn func(tx storeTx) error) (bool, error)
+
+	countPendingOutbox(ctx context.Context) (int64, error)
+	pendingOutbox(ctx context.Context, limit int) ([]outboxRow, error)
+	markPublished(ctx context.Context, id int64) error
+}
+
+// storeTx is the part of a transaction the event handlers use.
+type storeTx interface {
+	// lockStatus returns the order's status, locking it until the
+	// transaction ends.
+	lockStatus(ctx context.Context, orderID string) (string, error)
+	updateStatus(ctx context.Context, orderID, status string) error
+	appendEvent(ctx context.Context, orderID, eventType string, payload []byte) error
+	enqueue(ctx context.Context, orderID, eventType string, payload []byte, traceParent string) error
+}
+
+// newOrder is an order as created from a request.
+type newOrder struct {
+	Order
+	IdemKey     string
+	Items       []redstone.OrderItem
+	Created     []byte // OrderCreated payload
+	TraceParent string
+}
+
+type pgStore struct {
+	db *pgxpool.Pool
+}
+
+func (s *pgStore) orderForIdemKey(ctx context.Context, key string) (string, error) {
+	var id string
+	err := s.db.QueryRow(ctx, `select order_id from idempotency where idem_key=$1`, key).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
+
+func (s *pgStore) createOrder(ctx context.Context, o newOrder) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `insert into orders(id,user_id,status,total_amount,currency,created_at,updated_at) values ($1,$2,$3,$4,$5,now(),now())`,
+		o.ID, o.UserID, o.Status, o.TotalAmount, o.Currency)
+	if err != nil {
+		return err
+	}
+	for _, it := range o.Items {
+		_, err = tx.Exec(ctx, `insert into order_items(order_id,sku,qty,unit_price,total_price) values ($1,$2,$3,$4,$5)`,
+			o.ID, it.SKU, it.Qty, it.UnitPrice, int64(it.Qty)*it.UnitPrice)
+		if err != nil {
+			return err
+		}
+	}
+
+	// store idempotency mapping
+	_, _ = tx.Exec(ctx, `insert into idempotency(idem_key,order_id,created_at) values ($1,$2,now()) on conflict (idem_key) do nothing`, o.IdemKey, o.ID)
+
+	// Keep the request's trace context so the relayed event joins this trace
+	_, err = tx.Exec(ctx, `insert into outbox(aggregate_id,event_type,payload,trace_parent,status,created_at) values ($1,$2,$3,$4,'PENDING',now())`,
+		o.ID, "OrderCreated", o.Created, o.TraceParent)
+	if err != nil {
+		return err
+	}
+
+	// Audit timeline
+	_, _ = tx.Exec(ctx, `insert into order_events(order_id,type,payload,created_at) values ($1,$2,$3,now())`,
+		o.ID, "OrderCreated", o.Created)
+
+	return tx.Commit(ctx)
+}
+
+func (s *pgStore) getOrder(ctx context.Context, id string) (*Order, error) {
+	var o Order
+	err := s.db.QueryRow(ctx, `select id,user_id,status,total_amount,currency from orders where id=$1`, id).
+		Scan(&o.ID, &o.UserID, &o.Status, &o.TotalAmount, &o.Currency)
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (s *pgStore) applyOnce(ctx context.Context, eventID string, fn func(tx storeTx) error) (bool, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `insert into processed_events(event_id,processed_at) values ($1,now()) on conflict (event_id) do nothing`, eventID)
+	if err != nil {
+		return false, fmt.Errorf("mark processed: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	if err := fn(pgTx{tx}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+func (s *pgStore) countPendingOutbox(ctx context.Context) (int64, error) {
+	var n int64
+	err := s.db.QueryRow(ctx, `select count(*) from outbox where status='PENDING'`).Scan(&n)
+	return n, err
+}
+
+func (s *pgStore) pendingOutbox(ctx context.Context, limit int) ([]outboxRow, error) {
+	rows, err := s.db.Query(ctx, `select id,aggregate_id,event_type,payload,coalesce(trace_parent,''),created_at from outbox where status='PENDING' order by id asc limit $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []outboxRow
+	for rows.Next() {
+		var r outboxRow
+		if err := rows.Scan(&r.ID, &r.AggregateID, &r.EventType, &r.Payload, &r.TraceParent, &r.CreatedAt); err == nil {
+			batch = append(batch, r)
+		}
+	}
+	return batch, rows.Err()
+}
+
+func (s *pgStore) markPublished(ctx context.Context, id int64) error {
+	_, err := s.db.Exec(ctx, `update outbox set status='PUBLISHED', published_at=now() where id=$1`, id)
+	return err
+}
+
+type pgTx struct {
+	tx pgx.Tx
+}
+
+func (t pgTx) lockStatus(ctx context.Context, orderID string) (string, error) {
+	var status string
+	err := t.tx.QueryRow(ctx, `select status from orders where id=$1 for update`, orderID).Scan(&status)
+	return status, err
+}
+
+func (t pgTx) updateStatus(ctx context.Context, orderID, status string) error {
+	_, err := t.tx.Exec(ctx, `update orders set status=$2, updated_at=now() where id=$1`, orderID, status)
+	return err
+}
+
+func (t pgTx) appendEvent(ctx context.Context, orderID, eventType string, payload []byte) error {
+	_, err := t.tx.Exec(ctx, `insert into order_events(order_id,type,payload,created_at) values ($1,$2,$3,now())`, orderID, eventType, payload)
+	return err
+}
+
+func (t pgTx) enqueue(ctx context.Context, orderID, eventType string, payload []byte, traceParent string) error {
+	_, err := t.tx.Exec(ctx, `insert into outbox(aggregate_id,event_type,payload,trace_parent,status,created_at) values ($1,$2,$3,$4,'PENDING',now())`,
+		orderID, eventType, payload, traceParent)
+	return err
+}
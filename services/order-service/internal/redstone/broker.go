@@ -0,0 +1,29 @@
+package redstone
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Publisher publishes events to one topic. *Producer implements it for
+// Kafka and for MemoryBroker.
+type Publisher interface {
+	Write(ctx context.Context, key string, v any) error
+	WriteMessage(ctx context.Context, m kafka.Message) error
+	Check(ctx context.Context) error
+	Close() error
+}
+
+// Subscriber delivers the messages of one topic to a Handler as a member of
+// a consumer group. *Consumer implements it for Kafka and for MemoryBroker.
+type Subscriber interface {
+	Run(ctx context.Context, log *Logger, h Handler)
+	Check(ctx context.Context) error
+	Close() error
+}
+
+var (
+	_ Publisher  = (*Producer)(nil)
+	_ Subscriber = (*Consumer)(nil)
+)
@@ -0,0 +1,315 @@
+package redstone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Handler processes a single fetched message. A nil error commits the
+// message; errors wrapped with Retryable are re-delivered through the retry
+// tiers, anything else is treated as permanent.
+type Handler func(ctx context.Context, m kafka.Message) error
+
+const (
+	headerRetryAttempt   = "redstone-retry-attempt"
+	headerRetryNotBefore = "redstone-retry-not-before"
+	headerOriginalTopic  = "redstone-original-topic"
+	headerError          = "redstone-error"
+	// headerValidationReport carries the JSON ValidationError of an event
+	// dead-lettered for failing schema validation.
+	headerValidationReport = "redstone-validation-report"
+)
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// Retryable marks err as transient so the message is consumed again after
+// the next retry delay instead of being treated as a permanent failure.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+func IsRetryable(err error) bool {
+	var re *retryableError
+	return errors.As(err, &re)
+}
+
+// RetryTopic names the delayed retry topic for one tier of a consumer group.
+func RetryTopic(topic, groupID string, delay time.Duration) string {
+	return fmt.Sprintf("%s.%s.retry.%s", topic, groupID, formatDelay(delay))
+}
+
+// DeadLetterTopic names the topic that receives messages a consumer group
+// gave up on.
+func DeadLetterTopic(topic, groupID string) string {
+	return fmt.Sprintf("%s.%s.dlq", topic, groupID)
+}
+
+func formatDelay(d time.Duration) string {
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d >= time.Minute && d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	case d >= time.Second && d%time.Second == 0:
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	default:
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	}
+}
+
+type retryStage struct {
+	delay    time.Duration
+	consumer *Consumer
+	producer *Producer
+}
+
+// NewRetryingConsumer returns a consumer that re-delivers retryable failures
+// through one delayed topic per entry in delays, then to the dead-letter
+// topic. Each tier is read by its own reader, so waiting out a delay never
+// blocks the source partition.
+func NewRetryingConsumer(cfg KafkaConfig, topic, groupID string, delays []time.Duration) *Consumer {
+	return withRetries(topic, groupID, delays,
+		func(t string) *Consumer { return NewConsumer(cfg, t, groupID) },
+		func(t string) *Producer { return NewProducer(cfg, t) })
+}
+
+func withRetries(topic, groupID string, delays []time.Duration, consumer func(string) *Consumer, producer func(string) *Producer) *Consumer {
+	c := consumer(topic)
+	for _, d := range delays {
+		t := RetryTopic(topic, groupID, d)
+		c.stages = append(c.stages, &retryStage{
+			delay:    d,
+			consumer: consumer(t),
+			producer: producer(t),
+		})
+	}
+	c.dlq = producer(DeadLetterTopic(topic, groupID))
+	return c
+}
+
+// Run fetches messages and passes them to h until ctx is cancelled. Retry
+// tiers, if any, are consumed concurrently with the source topic. On
+// cancellation the message in flight is finished and committed before Run
+// returns.
+func (c *Consumer) Run(ctx context.Context, log *Logger, h Handler) {
+	c.setLogger(log)
+	var wg sync.WaitGroup
+	for i, s := range c.stages {
+		s.consumer.setLogger(log)
+		wg.Add(1)
+		go func(i int, s *retryStage) {
+			defer wg.Done()
+			c.consume(ctx, log, s.consumer, h, i+1, true)
+		}(i, s)
+	}
+	c.consume(ctx, log, c, h, 0, false)
+	wg.Wait()
+}
+
+// setLogger hands log to a reader that logs by itself, e.g. to report
+// entries it drops.
+func (c *Consumer) setLogger(log *Logger) {
+	if r, ok := c.r.(interface{ setLogger(*Logger) }); ok {
+		r.setLogger(log)
+	}
+}
+
+// consume drives src with h. next is the index of the retry tier that
+// receives retryable failures from src; delayed holds each message until its
+// not-before time.
+func (c *Consumer) consume(ctx context.Context, log *Logger, src *Consumer, h Handler, next int, delayed bool) {
+	if c.txn != nil {
+		c.consumeInTransactions(ctx, log, src, h, next, delayed)
+		return
+	}
+	if c.workers > 1 {
+		c.consumeConcurrently(ctx, log, src, h, next, delayed)
+		return
+	}
+
+	// Work already fetched is allowed to finish during shutdown.
+	work := context.WithoutCancel(ctx)
+	for {
+		m, ok := c.fetch(ctx, log, src, delayed)
+		if !ok || !c.handle(ctx, work, log, m, h, next) {
+			return
+		}
+		if err := src.Commit(work, m); err != nil {
+			log.Error("consumer commit failed", map[string]any{"err": err.Error(), "topic": m.Topic, "offset": m.Offset})
+		}
+	}
+}
+
+// fetch returns the next message of src that is due, reporting false once
+// ctx is cancelled.
+func (c *Consumer) fetch(ctx context.Context, log *Logger, src *Consumer, delayed bool) (kafka.Message, bool) {
+	for {
+		m, err := src.Fetch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return kafka.Message{}, false
+			}
+			log.Error("consumer fetch failed", map[string]any{"err": err.Error(), "topic": src.r.Config().Topic})
+			if !sleep(ctx, 500*time.Millisecond) {
+				return kafka.Message{}, false
+			}
+			continue
+		}
+
+		observeLag(src.r.Config().GroupID, m)
+		if delayed && !waitNotBefore(ctx, m) {
+			// Left uncommitted; the tier re-delivers it after restart.
+			return kafka.Message{}, false
+		}
+		return m, true
+	}
+}
+
+// handle runs h on m under work and reroutes failures. It reports false if
+// ctx was cancelled before a failure could be rerouted, in which case m must
+// not be committed.
+func (c *Consumer) handle(ctx, work context.Context, log *Logger, m kafka.Message, h Handler, next int) bool {
+	start := time.Now()
+	m, herr := c.normalize(m)
+	hctx, span := startProcessSpan(withEventFields(work, m), m)
+	if herr == nil {
+		herr = c.validator.check(m.Value, map[string]any{"topic": m.Topic, "partition": m.Partition, "offset": m.Offset})
+	}
+	if herr == nil {
+		herr = h(hctx, m)
+	}
+	endSpan(span, herr)
+	observeHandler(m.Topic, start, herr)
+	if herr == nil {
+		return true
+	}
+	for {
+		err := c.reroute(hctx, log, m, herr, next)
+		if err == nil {
+			return true
+		}
+		log.ErrorContext(hctx, "reroute failed", map[string]any{"err": err.Error(), "topic": m.Topic, "offset": m.Offset})
+		if !sleep(ctx, 500*time.Millisecond) {
+			return false
+		}
+	}
+}
+
+// normalize returns m as the current Redstone envelope, whatever format and
+// schema version it was published in. Current protobuf events stay protobuf
+// unless they must be validated.
+func (c *Consumer) normalize(m kafka.Message) (kafka.Message, error) {
+	m, err := fromCloudEvent(m)
+	if err != nil {
+		return m, err
+	}
+	if contentType(m) == ContentTypeProtobuf {
+		if currentProto(m) && !c.validator.enabled() {
+			return m, nil
+		}
+		if m, err = protoToJSON(m); err != nil {
+			return m, err
+		}
+	}
+	return upcastMessage(m)
+}
+
+// sleep waits for d and reports false if ctx was cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (c *Consumer) reroute(ctx context.Context, log *Logger, m kafka.Message, herr error, next int) error {
+	fields := map[string]any{
+		"err":       herr.Error(),
+		"topic":     m.Topic,
+		"partition": m.Partition,
+		"offset":    m.Offset,
+		"key":       string(m.Key),
+	}
+	if IsRetryable(herr) && next < len(c.stages) {
+		s := c.stages[next]
+		fields["attempt"] = next + 1
+		fields["delay"] = s.delay.String()
+		log.WarnContext(ctx, "handler failed, scheduling retry", fields)
+		return s.producer.WriteMessage(ctx, forwarded(m, herr, next+1, time.Now().Add(s.delay)))
+	}
+	if c.dlq == nil {
+		log.ErrorContext(ctx, "handler failed", fields)
+		return nil
+	}
+	log.ErrorContext(ctx, "handler failed, sending to dead-letter topic", fields)
+	return c.dlq.WriteMessage(ctx, forwarded(m, herr, next, time.Time{}))
+}
+
+// forwarded copies m for re-publishing, recording the failure and the
+// earliest time the message may be handled again.
+func forwarded(m kafka.Message, herr error, attempt int, notBefore time.Time) kafka.Message {
+	out := kafka.Message{Key: m.Key, Value: m.Value, Time: time.Now()}
+	origin := m.Topic
+	for _, h := range m.Headers {
+		switch h.Key {
+		case headerRetryAttempt, headerRetryNotBefore, headerError, headerValidationReport:
+			continue
+		case headerOriginalTopic:
+			origin = string(h.Value)
+			continue
+		}
+		out.Headers = append(out.Headers, h)
+	}
+	out.Headers = append(out.Headers,
+		kafka.Header{Key: headerOriginalTopic, Value: []byte(origin)},
+		kafka.Header{Key: headerRetryAttempt, Value: []byte(strconv.Itoa(attempt))},
+		kafka.Header{Key: headerError, Value: []byte(herr.Error())},
+	)
+	if report, ok := validationReport(herr); ok {
+		out.Headers = append(out.Headers, report)
+	}
+	if !notBefore.IsZero() {
+		out.Headers = append(out.Headers, kafka.Header{
+			Key:   headerRetryNotBefore,
+			Value: []byte(strconv.FormatInt(notBefore.UnixMilli(), 10)),
+		})
+	}
+	return out
+}
+
+// waitNotBefore holds a message read from a retry tier until its not-before
+// time, reporting false if ctx was cancelled first.
+func waitNotBefore(ctx context.Context, m kafka.Message) bool {
+	for _, hd := range m.Headers {
+		if hd.Key != headerRetryNotBefore {
+			continue
+		}
+		ms, err := strconv.ParseInt(string(hd.Value), 10, 64)
+		if err != nil {
+			return true
+		}
+		if wait := time.Until(time.UnixMilli(ms)); wait > 0 {
+			return sleep(ctx, wait)
+		}
+		return true
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+// Code generated by eventgen from the events JSON schema. DO NOT EDIT.
+
+package redstone
+
+import "time"
+
+// SchemaVersion is the event schema version this package produces.
+const SchemaVersion = 2
+
+// Event types, the value of event_type for each event.
+const (
+	EventOrderCreated      = "OrderCreated"
+	EventInventoryReserved = "InventoryReserved"
+	EventInventoryFailed   = "InventoryFailed"
+	EventPaymentCaptured   = "PaymentCaptured"
+	EventPaymentFailed     = "PaymentFailed"
+	EventOrderConfirmed    = "OrderConfirmed"
+	EventOrderCancelled    = "OrderCancelled"
+)
+
+type BaseEvent struct {
+	EventID       string    `json:"event_id"`
+	EventType     string    `json:"event_type"`
+	SchemaVersion int       `json:"schema_version"`
+	OccurredAt    time.Time `json:"occurred_at"`
+	CorrelationID string    `json:"correlation_id"`
+	CausationID   string    `json:"causation_id,omitempty"`
+}
+
+type OrderItem struct {
+	SKU       string `json:"sku"`
+	Qty       int    `json:"qty"`
+	UnitPrice int64  `json:"unit_price"`
+}
+
+type OrderCreated struct {
+	BaseEvent
+	OrderID string      `json:"order_id"`
+	UserID  string      `json:"user_id"`
+	Items   []OrderItem `json:"items"`
+	// ISO 4217 code of item prices; added in v2, v1 events are upcast with INR.
+	Currency string `json:"currency"`
+}
+
+type InventoryReserved struct {
+	BaseEvent
+	OrderID string `json:"order_id"`
+	// Order total, sum of qty * unit_price over its items.
+	Amount int64 `json:"amount,omitempty"`
+}
+
+type InventoryFailed struct {
+	BaseEvent
+	OrderID string `json:"order_id"`
+	Reason  string `json:"reason"`
+}
+
+type PaymentCaptured struct {
+	BaseEvent
+	OrderID string `json:"order_id"`
+	Amount  int64  `json:"amount"`
+}
+
+type PaymentFailed struct {
+	BaseEvent
+	OrderID string `json:"order_id"`
+	Reason  string `json:"reason"`
+}
+
+type OrderConfirmed struct {
+	BaseEvent
+	OrderID string `json:"order_id"`
+}
+
+type OrderCancelled struct {
+	BaseEvent
+	OrderID string `json:"order_id"`
+	Reason  string `json:"reason"`
+}
+
+// NewOrderCreated builds the OrderCreated event on envelope base, setting its event type and schema version.
+func NewOrderCreated(base BaseEvent, orderID string, userID string, items []OrderItem, currency string) OrderCreated {
+	base.EventType = EventOrderCreated
+	base.SchemaVersion = SchemaVersion
+	return OrderCreated{BaseEvent: base, OrderID: orderID, UserID: userID, Items: items, Currency: currency}
+}
+
+// NewInventoryReserved builds the InventoryReserved event on envelope base, setting its event type and schema version.
+func NewInventoryReserved(base BaseEvent, orderID string, amount int64) InventoryReserved {
+	base.EventType = EventInventoryReserved
+	base.SchemaVersion = SchemaVersion
+	return InventoryReserved{BaseEvent: base, OrderID: orderID, Amount: amount}
+}
+
+// NewInventoryFailed builds the InventoryFailed event on envelope base, setting its event type and schema version.
+func NewInventoryFailed(base BaseEvent, orderID string, reason string) InventoryFailed {
+	base.EventType = EventInventoryFailed
+	base.SchemaVersion = SchemaVersion
+	return InventoryFailed{BaseEvent: base, OrderID: orderID, Reason: reason}
+}
+
+// NewPaymentCaptured builds the PaymentCaptured event on envelope base, setting its event type and schema version.
+func NewPaymentCaptured(base BaseEvent, orderID string, amount int64) PaymentCaptured {
+	base.EventType = EventPaymentCaptured
+	base.SchemaVersion = SchemaVersion
+	return PaymentCaptured{BaseEvent: base, OrderID: orderID, Amount: amount}
+}
+
+// NewPaymentFailed builds the PaymentFailed event on envelope base, setting its event type and schema version.
+func NewPaymentFailed(base BaseEvent, orderID string, reason string) PaymentFailed {
+	base.EventType = EventPaymentFailed
+	base.SchemaVersion = SchemaVersion
+	return PaymentFailed{BaseEvent: base, OrderID: orderID, Reason: reason}
+}
+
+// NewOrderConfirmed builds the OrderConfirmed event on envelope base, setting its event type and schema version.
+func NewOrderConfirmed(base BaseEvent, orderID string) OrderConfirmed {
+	base.EventType = EventOrderConfirmed
+	base.SchemaVersion = SchemaVersion
+	return OrderConfirmed{BaseEvent: base, OrderID: orderID}
+}
+
+// NewOrderCancelled builds the OrderCancelled event on envelope base, setting its event type and schema version.
+func NewOrderCancelled(base BaseEvent, orderID string, reason string) OrderCancelled {
+	base.EventType = EventOrderCancelled
+	base.SchemaVersion = SchemaVersion
+	return OrderCancelled{BaseEvent: base, OrderID: orderID, Reason: reason}
+}
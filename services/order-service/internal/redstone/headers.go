@@ -0,0 +1,83 @@
+package redstone
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka header keys written on every published event.
+const (
+	HeaderEventType     = "event_type"
+	HeaderEventID       = "event_id"
+	HeaderCorrelationID = "correlation_id"
+	HeaderCausationID   = "causation_id"
+	HeaderSchemaVersion = "schema_version"
+	HeaderTraceParent   = "traceparent"
+)
+
+// Base lets Producer read envelope fields without re-parsing the payload.
+func (e BaseEvent) Base() BaseEvent { return e }
+
+// Metadata is the envelope of a consumed message, read from its headers.
+type Metadata struct {
+	EventType     string
+	EventID       string
+	CorrelationID string
+	CausationID   string
+	SchemaVersion string
+	TraceParent   string
+
+	Key       string
+	Topic     string
+	Partition int
+	Offset    int64
+}
+
+// MetadataOf returns the envelope of m. Messages published before headers
+// were introduced fall back to the JSON body.
+func MetadataOf(m kafka.Message) Metadata {
+	md := Metadata{
+		Key:       string(m.Key),
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+	}
+	for _, h := range m.Headers {
+		switch h.Key {
+		case HeaderEventType:
+			md.EventType = string(h.Value)
+		case HeaderEventID:
+			md.EventID = string(h.Value)
+		case HeaderCorrelationID:
+			md.CorrelationID = string(h.Value)
+		case HeaderCausationID:
+			md.CausationID = string(h.Value)
+		case HeaderSchemaVersion:
+			md.SchemaVersion = string(h.Value)
+		case HeaderTraceParent:
+			md.TraceParent = string(h.Value)
+		}
+	}
+	if md.EventType == "" {
+		var base BaseEvent
+		if json.Unmarshal(m.Value, &base) == nil {
+			md.EventType = base.EventType
+			md.EventID = base.EventID
+			md.CorrelationID = base.CorrelationID
+			md.CausationID = base.CausationID
+		}
+	}
+	return md
+}
+
+func eventHeaders(base BaseEvent) []kafka.Header {
+	return []kafka.Header{
+		{Key: HeaderEventType, Value: []byte(base.EventType)},
+		{Key: HeaderEventID, Value: []byte(base.EventID)},
+		{Key: HeaderCorrelationID, Value: []byte(base.CorrelationID)},
+		{Key: HeaderCausationID, Value: []byte(base.CausationID)},
+		{Key: HeaderSchemaVersion, Value: []byte(strconv.Itoa(versionOf(base)))},
+	}
+}
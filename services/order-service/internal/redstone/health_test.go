@@ -0,0 +1,50 @@
+package redstone
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestCheckMember(t *testing.T) {
+	group := func(state string, clientIDs ...string) *kafka.DescribeGroupsResponse {
+		g := kafka.DescribeGroupsResponseGroup{GroupID: "g", GroupState: state}
+		for _, id := range clientIDs {
+			g.Members = append(g.Members, kafka.DescribeGroupsResponseMember{ClientID: id})
+		}
+		return &kafka.DescribeGroupsResponse{Groups: []kafka.DescribeGroupsResponseGroup{g}}
+	}
+	for _, c := range []struct {
+		name string
+		resp *kafka.DescribeGroupsResponse
+		err  string
+	}{
+		{"member", group("Stable", "other", "me"), ""},
+		{"kicked", group("Stable", "other"), "not a member of group g (Stable)"},
+		{"not joined", group("Empty"), "not a member of group g (Empty)"},
+		{"rebalancing", group("PreparingRebalance"), ""},
+		{"syncing", group("CompletingRebalance", "other"), ""},
+		{"group error", &kafka.DescribeGroupsResponse{Groups: []kafka.DescribeGroupsResponseGroup{{GroupID: "g", Error: kafka.NotCoordinatorForGroup}}}, "group g: "},
+		{"missing", &kafka.DescribeGroupsResponse{}, "group g not described"},
+	} {
+		err := checkMember(c.resp, "g", "me")
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+// Readers of the same group get distinct client IDs, so Check can tell
+// this process's members apart from other replicas and tiers.
+func TestMemberClientID(t *testing.T) {
+	a, b := memberClientID("t", "g"), memberClientID("t", "g")
+	if a == b || !strings.HasPrefix(a, "g@") || !strings.Contains(a, "/t#") {
+		t.Fatalf("client IDs %q, %q", a, b)
+	}
+	c := NewConsumer(KafkaConfig{Brokers: []string{"localhost:9092"}}, "t", "g")
+	defer c.Close()
+	if id := c.r.Config().Dialer.ClientID; !strings.HasPrefix(id, "g@") {
+		t.Fatalf("reader client ID %q", id)
+	}
+}
@@ -0,0 +1,30 @@
+package redstone
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// eventNamespace scopes derived event IDs; changing it changes every ID.
+var eventNamespace = uuid.MustParse("6f1c5b0e-2d7a-4c1e-9a55-3b8f0f0e7d21")
+
+// DeriveEventID returns the ID of the eventType event emitted in reaction to
+// the event causeID. Handling the same cause twice yields the same ID, so
+// downstream dedupe recognises the retry.
+func DeriveEventID(causeID, eventType string) string {
+	return uuid.NewSHA1(eventNamespace, []byte(causeID+"/"+eventType)).String()
+}
+
+// CausedBy returns the envelope for an eventType event emitted in reaction to
+// cause, keeping its correlation ID and recording it as the causation ID.
+func CausedBy(cause BaseEvent, eventType string) BaseEvent {
+	return BaseEvent{
+		EventID:       DeriveEventID(cause.EventID, eventType),
+		EventType:     eventType,
+		SchemaVersion: SchemaVersion,
+		OccurredAt:    time.Now().UTC(),
+		CorrelationID: cause.CorrelationID,
+		CausationID:   cause.EventID,
+	}
+}
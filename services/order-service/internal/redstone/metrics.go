@@ -0,0 +1,167 @@
+package redstone
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redstone_http_requests_total",
+		Help: "HTTP requests by route and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redstone_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	sagaOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redstone_saga_outcomes_total",
+		Help: "Orders reaching a terminal saga state, by outcome and reason.",
+	}, []string{"outcome", "reason"})
+
+	outboxPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "redstone_outbox_pending",
+		Help: "Outbox rows waiting to be published.",
+	})
+
+	outboxPublishLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "redstone_outbox_publish_latency_seconds",
+		Help:    "Time from outbox insert to successful publish.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	})
+
+	consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "redstone_consumer_lag",
+		Help: "Messages behind the partition high-water mark, as of the last fetch.",
+	}, []string{"group", "topic", "partition"})
+
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redstone_consumer_handle_duration_seconds",
+		Help:    "Message handler latency by topic and result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic", "result"})
+)
+
+// MetricsHandler serves the Prometheus exposition format on /metrics.
+func MetricsHandler() http.Handler { return promhttp.Handler() }
+
+// MeasureHTTP is chi middleware recording request counts and latency by
+// route pattern.
+func MeasureHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rc := chi.RouteContext(r.Context()); rc != nil && rc.RoutePattern() != "" {
+			route = rc.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// RecordSagaOutcome counts an order reaching a terminal state. reason must
+// be low-cardinality, e.g. the event type that caused a cancellation.
+func RecordSagaOutcome(outcome, reason string) {
+	sagaOutcomes.WithLabelValues(outcome, reason).Inc()
+}
+
+func SetOutboxPending(n int64) { outboxPending.Set(float64(n)) }
+
+// ObserveOutboxPublish records how long a row waited in the outbox.
+func ObserveOutboxPublish(createdAt time.Time) {
+	outboxPublishLatency.Observe(time.Since(createdAt).Seconds())
+}
+
+func observeLag(group string, m kafka.Message) {
+	if m.HighWaterMark == 0 {
+		return
+	}
+	consumerLag.WithLabelValues(group, m.Topic, strconv.Itoa(m.Partition)).
+		Set(float64(m.HighWaterMark - m.Offset - 1))
+}
+
+func observeHandler(topic string, start time.Time, err error) {
+	result := "ok"
+	switch {
+	case IsRetryable(err):
+		result = "retry"
+	case err != nil:
+		result = "error"
+	}
+	handlerDuration.WithLabelValues(topic, result).Observe(time.Since(start).Seconds())
+}
+
+// PoolStats is the subset of *pgxpool.Stat exported as metrics.
+type PoolStats interface {
+	AcquiredConns() int32
+	IdleConns() int32
+	TotalConns() int32
+	MaxConns() int32
+	AcquireCount() int64
+	EmptyAcquireCount() int64
+	AcquireDuration() time.Duration
+}
+
+type poolCollector struct {
+	stat     func() PoolStats
+	acquired *prometheus.Desc
+	idle     *prometheus.Desc
+	total    *prometheus.Desc
+	max      *prometheus.Desc
+	acquires *prometheus.Desc
+	empty    *prometheus.Desc
+	waited   *prometheus.Desc
+}
+
+// RegisterDBPool exports connection pool statistics, sampled at scrape time.
+func RegisterDBPool(stat func() PoolStats) {
+	prometheus.MustRegister(&poolCollector{
+		stat:     stat,
+		acquired: prometheus.NewDesc("redstone_db_pool_acquired_conns", "Connections currently in use.", nil, nil),
+		idle:     prometheus.NewDesc("redstone_db_pool_idle_conns", "Idle connections.", nil, nil),
+		total:    prometheus.NewDesc("redstone_db_pool_total_conns", "Open connections.", nil, nil),
+		max:      prometheus.NewDesc("redstone_db_pool_max_conns", "Configured pool size.", nil, nil),
+		acquires: prometheus.NewDesc("redstone_db_pool_acquires_total", "Successful connection acquires.", nil, nil),
+		empty:    prometheus.NewDesc("redstone_db_pool_empty_acquires_total", "Acquires that had to wait for a connection.", nil, nil),
+		waited:   prometheus.NewDesc("redstone_db_pool_acquire_seconds_total", "Total time spent acquiring connections.", nil, nil),
+	})
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquired
+	ch <- c.idle
+	ch <- c.total
+	ch <- c.max
+	ch <- c.acquires
+	ch <- c.empty
+	ch <- c.waited
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stat()
+	ch <- prometheus.MustNewConstMetric(c.acquired, prometheus.GaugeValue, float64(s.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(s.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, float64(s.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.max, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.acquires, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.empty, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.waited, prometheus.CounterValue, s.AcquireDuration().Seconds())
+}
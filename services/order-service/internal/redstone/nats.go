@@ -0,0 +1,394 @@
+package redstone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/segmentio/kafka-go"
+)
+
+// NATS JetStream transport. Each topic is a stream named after the topic
+// with dots replaced, e.g. redstone.orders is stream redstone_orders with
+// subjects redstone_orders.<key>; a consumer group is a durable pull
+// consumer of that stream. Acks are explicit, and a Commit acks exactly the
+// committed messages: JetStream redelivers a message after a lower sequence
+// was acked, so acking everything up to a sequence could ack one that is
+// still being handled.
+//
+// Unlike Kafka partitions, a durable consumer spreads messages over all of
+// its members, so events of one key are only handled in order while the
+// group has a single member.
+
+// headerNATSKey carries the message key, which may not be a valid subject
+// token.
+const headerNATSKey = "redstone-key"
+
+// natsAckWait is how long a delivered message may stay unacked before
+// JetStream delivers it again.
+const natsAckWait = time.Minute
+
+func natsStream(topic string) string {
+	return subjectToken(topic)
+}
+
+// subjectToken makes s usable as one subject token and stream name.
+func subjectToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n', '/', '\\':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func natsConnect(cfg KafkaConfig) (*nats.Conn, jetstream.JetStream, error) {
+	opts := []nats.Option{nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1)}
+	if cfg.TLS != nil {
+		opts = append(opts, nats.Secure(cfg.TLS))
+	}
+	nc, err := nats.Connect(cfg.NATSURL, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("nats connect: %w", err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	return nc, js, nil
+}
+
+// natsWriter publishes to the stream of one topic.
+type natsWriter struct {
+	nc    *nats.Conn
+	js    jetstream.JetStream
+	topic string
+	err   error
+}
+
+func newNATSProducer(cfg KafkaConfig, topic string) *Producer {
+	w := &natsWriter{topic: topic}
+	w.nc, w.js, w.err = natsConnect(cfg)
+	return &Producer{w: w, topic: topic}
+}
+
+func (w *natsWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	for _, m := range msgs {
+		msg := &nats.Msg{
+			Subject: natsStream(w.topic) + "." + subjectToken(string(m.Key)),
+			Data:    m.Value,
+			Header:  nats.Header{headerNATSKey: {string(m.Key)}},
+		}
+		for _, h := range m.Headers {
+			msg.Header[h.Key] = []string{string(h.Value)}
+		}
+		if _, err := w.js.PublishMsg(ctx, msg); err != nil {
+			return fmt.Errorf("publish to %s: %w", w.topic, err)
+		}
+	}
+	return nil
+}
+
+func (w *natsWriter) Close() error {
+	if w.nc != nil {
+		w.nc.Close()
+	}
+	return nil
+}
+
+func (w *natsWriter) check(ctx context.Context) error {
+	if w.err != nil {
+		return w.err
+	}
+	return natsCheck(ctx, w.nc, w.js, w.topic)
+}
+
+func natsCheck(ctx context.Context, nc *nats.Conn, js jetstream.JetStream, topic string) error {
+	if !nc.IsConnected() {
+		return fmt.Errorf("nats: %s", nc.Status())
+	}
+	if _, err := js.Stream(ctx, natsStream(topic)); err != nil {
+		return fmt.Errorf("stream %s: %w", natsStream(topic), err)
+	}
+	return nil
+}
+
+// natsReader reads one topic as a durable consumer named after the group.
+type natsReader struct {
+	nc    *nats.Conn
+	js    jetstream.JetStream
+	topic string
+	group string
+	err   error
+
+	mu      sync.Mutex
+	iter    jetstream.MessagesContext
+	pending map[int64]jetstream.Msg
+	msgs    chan natsResult
+	done    chan struct{}
+}
+
+type natsResult struct {
+	msg jetstream.Msg
+	err error
+}
+
+func newNATSConsumer(cfg KafkaConfig, topic, groupID string) *Consumer {
+	r := &natsReader{
+		topic:   topic,
+		group:   groupID,
+		pending: make(map[int64]jetstream.Msg),
+		msgs:    make(chan natsResult),
+		done:    make(chan struct{}),
+	}
+	r.nc, r.js, r.err = natsConnect(cfg)
+	return &Consumer{r: r}
+}
+
+// start creates the durable consumer and the goroutine feeding r.msgs on
+// first use, so a missing stream is retried by the fetch loop.
+func (r *natsReader) start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil || r.iter != nil {
+		return r.err
+	}
+	cons, err := r.js.CreateOrUpdateConsumer(ctx, natsStream(r.topic), jetstream.ConsumerConfig{
+		Durable:       subjectToken(r.group),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       natsAckWait,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+	})
+	if err != nil {
+		return fmt.Errorf("consumer %s on %s: %w", r.group, natsStream(r.topic), err)
+	}
+	if r.iter, err = cons.Messages(); err != nil {
+		return err
+	}
+	go r.pump(r.iter)
+	return nil
+}
+
+// pump hands messages from iter to FetchMessage until Close.
+func (r *natsReader) pump(iter jetstream.MessagesContext) {
+	for {
+		msg, err := iter.Next()
+		if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+			return
+		}
+		select {
+		case r.msgs <- natsResult{msg, err}:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *natsReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if err := r.start(ctx); err != nil {
+		return kafka.Message{}, err
+	}
+	for {
+		var res natsResult
+		select {
+		case res = <-r.msgs:
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		}
+		msg, err := res.msg, res.err
+		if err != nil {
+			return kafka.Message{}, err
+		}
+		m, err := r.message(msg)
+		if err != nil {
+			_ = msg.Term()
+			continue
+		}
+		// Hold retry-tier messages in JetStream rather than in memory.
+		if d := time.Until(notBefore(m)); d > time.Second {
+			_ = msg.NakWithDelay(d)
+			continue
+		}
+		r.mu.Lock()
+		r.pending[m.Offset] = msg
+		r.mu.Unlock()
+		return m, nil
+	}
+}
+
+func (r *natsReader) message(msg jetstream.Msg) (kafka.Message, error) {
+	md, err := msg.Metadata()
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	m := kafka.Message{
+		Topic:         r.topic,
+		Offset:        int64(md.Sequence.Stream),
+		HighWaterMark: int64(md.Sequence.Stream + md.NumPending + 1),
+		Value:         msg.Data(),
+		Time:          md.Timestamp,
+	}
+	for k, vs := range msg.Headers() {
+		if k == headerNATSKey {
+			m.Key = []byte(vs[0])
+			continue
+		}
+		if strings.HasPrefix(k, "Nats-") || len(vs) == 0 {
+			continue
+		}
+		m.Headers = append(m.Headers, kafka.Header{Key: k, Value: []byte(vs[0])})
+	}
+	return m, nil
+}
+
+func notBefore(m kafka.Message) time.Time {
+	for _, h := range m.Headers {
+		if h.Key == headerRetryNotBefore {
+			if ms, err := strconv.ParseInt(string(h.Value), 10, 64); err == nil {
+				return time.UnixMilli(ms)
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// CommitMessages acks the delivered messages in msgs.
+func (r *natsReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	var acks []jetstream.Msg
+	for _, m := range msgs {
+		if msg, ok := r.pending[m.Offset]; ok {
+			acks = append(acks, msg)
+			delete(r.pending, m.Offset)
+		}
+	}
+	r.mu.Unlock()
+	var errs []error
+	for _, msg := range acks {
+		errs = append(errs, msg.DoubleAck(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func (r *natsReader) Config() kafka.ReaderConfig {
+	return kafka.ReaderConfig{Topic: r.topic, GroupID: r.group}
+}
+
+// Close stops fetching and naks messages delivered but not committed, so
+// another member gets them without waiting out the ack wait.
+func (r *natsReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	close(r.done)
+	if r.iter != nil {
+		r.iter.Stop()
+	}
+	for seq, msg := range r.pending {
+		_ = msg.Nak()
+		delete(r.pending, seq)
+	}
+	if r.nc != nil {
+		r.nc.Close()
+	}
+	return nil
+}
+
+func (r *natsReader) check(ctx context.Context) error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := natsCheck(ctx, r.nc, r.js, r.topic); err != nil {
+		return err
+	}
+	if _, err := r.js.Consumer(ctx, natsStream(r.topic), subjectToken(r.group)); err != nil {
+		return fmt.Errorf("consumer %s: %w", r.group, err)
+	}
+	return nil
+}
+
+func (r *natsReader) retention(ctx context.Context) (time.Duration, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return natsRetention(ctx, r.js, r.topic)
+}
+
+func natsRetention(ctx context.Context, js jetstream.JetStream, topic string) (time.Duration, error) {
+	s, err := js.Stream(ctx, natsStream(topic))
+	if err != nil {
+		return 0, fmt.Errorf("stream %s: %w", natsStream(topic), err)
+	}
+	info, err := s.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if info.Config.MaxAge == 0 {
+		return -1, nil
+	}
+	return info.Config.MaxAge, nil
+}
+
+// ensureStreams is EnsureTopics for NATS: partition counts don't apply,
+// retention is the stream's max age.
+func ensureStreams(ctx context.Context, cfg KafkaConfig, topics []string) error {
+	nc, js, err := natsConnect(cfg)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	var missing []string
+	var errs []error
+	for _, t := range topics {
+		_, err := js.Stream(ctx, natsStream(t))
+		switch {
+		case errors.Is(err, jetstream.ErrStreamNotFound):
+			if !cfg.CreateTopics {
+				missing = append(missing, natsStream(t))
+				continue
+			}
+			sc := jetstream.StreamConfig{
+				Name:     natsStream(t),
+				Subjects: []string{natsStream(t) + ".*"},
+				Storage:  jetstream.FileStorage,
+			}
+			if cfg.TopicRetention > 0 {
+				sc.MaxAge = cfg.TopicRetention
+			}
+			if cfg.TopicReplication > 0 {
+				sc.Replicas = cfg.TopicReplication
+			}
+			if _, err := js.CreateStream(ctx, sc); err != nil && !errors.Is(err, jetstream.ErrStreamNameAlreadyInUse) {
+				errs = append(errs, fmt.Errorf("create stream %s: %w", sc.Name, err))
+			}
+		case err != nil:
+			return fmt.Errorf("stream %s: %w", natsStream(t), err)
+		case cfg.TopicRetention != 0:
+			got, err := natsRetention(ctx, js, t)
+			if err != nil {
+				return err
+			}
+			if want := cfg.TopicRetention; got >= 0 && (want < 0 || got < want) {
+				errs = append(errs, fmt.Errorf("stream %s retains %s, want %s", natsStream(t), retentionString(got), retentionString(want)))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing streams %s; create them or set KAFKA_CREATE_TOPICS=true", strings.Join(missing, ", "))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,225 @@
+package redstone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var errKafkaOnly = errors.New("reading offset ranges needs the kafka transport")
+
+// PartitionRange is the span [First, End) of offsets held by one partition.
+type PartitionRange struct {
+	Partition int
+	First     int64
+	End       int64
+}
+
+// TopicOffsets returns the range of every partition of topic. A non-zero
+// since moves First to the first message at or after that time.
+func TopicOffsets(ctx context.Context, cfg KafkaConfig, topic string, since time.Time) ([]PartitionRange, error) {
+	if !cfg.isKafka() {
+		return nil, errKafkaOnly
+	}
+	client := &kafka.Client{Addr: kafka.TCP(cfg.Brokers...), Transport: cfg.transport()}
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, fmt.Errorf("broker metadata: %w", err)
+	}
+	var partitions []int
+	for _, t := range meta.Topics {
+		if t.Name != topic {
+			continue
+		}
+		if t.Error != nil {
+			return nil, fmt.Errorf("topic %s: %w", topic, t.Error)
+		}
+		for _, p := range t.Partitions {
+			partitions = append(partitions, p.ID)
+		}
+	}
+	if len(partitions) == 0 {
+		return nil, fmt.Errorf("topic %s not found", topic)
+	}
+	sort.Ints(partitions)
+
+	// One request per kind: brokers reject a partition listed twice.
+	first, err := listOffsets(ctx, client, topic, partitions, kafka.ReadUncommitted, kafka.FirstOffsetOf)
+	if err != nil {
+		return nil, err
+	}
+	end, err := listOffsets(ctx, client, topic, partitions, kafka.ReadUncommitted, kafka.LastOffsetOf)
+	if err != nil {
+		return nil, err
+	}
+	var at map[int]int64
+	if !since.IsZero() {
+		if at, err = listOffsets(ctx, client, topic, partitions, kafka.ReadUncommitted, func(p int) kafka.OffsetRequest { return kafka.TimeOffsetOf(p, since) }); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]PartitionRange, 0, len(partitions))
+	for _, p := range partitions {
+		r := PartitionRange{Partition: p, First: first[p], End: end[p]}
+		if at != nil {
+			// -1: nothing at or after since.
+			if r.First = at[p]; r.First < 0 {
+				r.First = r.End
+			}
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func listOffsets(ctx context.Context, client *kafka.Client, topic string, partitions []int, isolation kafka.IsolationLevel, req func(int) kafka.OffsetRequest) (map[int]int64, error) {
+	reqs := make([]kafka.OffsetRequest, len(partitions))
+	for i, p := range partitions {
+		reqs[i] = req(p)
+	}
+	resp, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{topic: reqs}, IsolationLevel: isolation})
+	if err != nil {
+		return nil, fmt.Errorf("list offsets of %s: %w", topic, err)
+	}
+	out := make(map[int]int64, len(partitions))
+	for _, p := range resp.Topics[topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("list offsets of %s/%d: %w", topic, p.Partition, p.Error)
+		}
+		switch {
+		case len(p.Offsets) > 0:
+			for o := range p.Offsets {
+				out[p.Partition] = o
+			}
+		case p.LastOffset >= 0:
+			out[p.Partition] = p.LastOffset
+		default:
+			out[p.Partition] = p.FirstOffset
+		}
+	}
+	return out, nil
+}
+
+// LastStableOffset returns the end of the committed messages of one
+// partition: the first offset of the oldest transaction still open on it,
+// or the partition's end when none is. A read-committed consumer reads no
+// further.
+func LastStableOffset(ctx context.Context, cfg KafkaConfig, topic string, partition int) (int64, error) {
+	if !cfg.isKafka() {
+		return 0, errKafkaOnly
+	}
+	client := &kafka.Client{Addr: kafka.TCP(cfg.Brokers...), Transport: cfg.transport()}
+	end, err := listOffsets(ctx, client, topic, []int{partition}, kafka.ReadCommitted, kafka.LastOffsetOf)
+	if err != nil {
+		return 0, err
+	}
+	o, ok := end[partition]
+	if !ok {
+		return 0, fmt.Errorf("list offsets of %s/%d: partition missing from response", topic, partition)
+	}
+	return o, nil
+}
+
+// NewPartitionConsumer returns a consumer of one partition of topic that
+// starts at offset and belongs to no group. It cannot Commit; tools use it
+// to read a range of a topic without disturbing the services' groups.
+func NewPartitionConsumer(cfg KafkaConfig, topic string, partition int, offset int64) (*Consumer, error) {
+	if !cfg.isKafka() {
+		return nil, errKafkaOnly
+	}
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   cfg.Brokers,
+		Topic:     topic,
+		Partition: partition,
+		MinBytes:  1,
+		MaxBytes:  10e6,
+		Dialer:    cfg.dialer(),
+		// Aborted transactions are not replayed.
+		IsolationLevel: kafka.ReadCommitted,
+	})
+	if err := r.SetOffset(offset); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &Consumer{r: r, transport: cfg.transport()}, nil
+}
+
+// Replayed copies m for re-publishing to another topic, without the retry
+// and failure headers a previous delivery may have added.
+func Replayed(m kafka.Message) kafka.Message {
+	out := kafka.Message{Key: m.Key, Value: m.Value}
+	for _, h := range m.Headers {
+		switch h.Key {
+		case headerRetryAttempt, headerRetryNotBefore, headerOriginalTopic, headerError, headerValidationReport:
+			continue
+		}
+		out.Headers = append(out.Headers, h)
+	}
+	return out
+}
+
+// Record is the NDJSON form of a message, written by the replay and archive
+// tools and read back by replay. JSON payloads are kept inline as Value;
+// anything else, e.g. protobuf, goes base64-encoded in ValueBase64.
+type Record struct {
+	Topic       string            `json:"topic"`
+	Partition   int               `json:"partition"`
+	Offset      int64             `json:"offset"`
+	Time        time.Time         `json:"time"`
+	Key         string            `json:"key"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Value       json.RawMessage   `json:"value,omitempty"`
+	ValueBase64 []byte            `json:"value_base64,omitempty"`
+}
+
+func RecordOf(m kafka.Message) Record {
+	r := Record{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Time:      m.Time.UTC(),
+		Key:       string(m.Key),
+	}
+	if len(m.Headers) > 0 {
+		r.Headers = make(map[string]string, len(m.Headers))
+		for _, h := range m.Headers {
+			r.Headers[h.Key] = string(h.Value)
+		}
+	}
+	if json.Valid(m.Value) {
+		r.Value = m.Value
+	} else {
+		r.ValueBase64 = m.Value
+	}
+	return r
+}
+
+// Message rebuilds the message r was made from, headers in key order.
+func (r Record) Message() kafka.Message {
+	m := kafka.Message{
+		Topic:     r.Topic,
+		Partition: r.Partition,
+		Offset:    r.Offset,
+		Time:      r.Time,
+		Key:       []byte(r.Key),
+		Value:     r.ValueBase64,
+	}
+	if r.Value != nil {
+		m.Value = r.Value
+	}
+	keys := make([]string, 0, len(r.Headers))
+	for k := range r.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m.Headers = append(m.Headers, kafka.Header{Key: k, Value: []byte(r.Headers[k])})
+	}
+	return m
+}
@@ -0,0 +1,208 @@
+package redstone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Topics returns every topic the consumer reads or writes: its own, its
+// retry tiers and its dead-letter topic.
+func (c *Consumer) Topics() []string {
+	topics := []string{c.r.Config().Topic}
+	for _, s := range c.stages {
+		topics = append(topics, s.producer.topic)
+	}
+	if c.dlq != nil {
+		topics = append(topics, c.dlq.topic)
+	}
+	return topics
+}
+
+// Topic returns the topic the producer writes to.
+func (p *Producer) Topic() string { return p.topic }
+
+// EnsureTopics checks that topics exist with the partition count and at
+// least the retention declared in cfg, creating missing ones with those
+// settings when cfg.CreateTopics is set. It reports every problem at once so
+// a service can refuse to start instead of spinning on fetch errors.
+func EnsureTopics(ctx context.Context, cfg KafkaConfig, topics ...string) error {
+	topics = uniq(topics)
+	switch cfg.Transport {
+	case TransportNATS:
+		return ensureStreams(ctx, cfg, topics)
+	case TransportRedis:
+		return ensureRedisStreams(ctx, cfg, topics)
+	}
+	client := &kafka.Client{Addr: kafka.TCP(cfg.Brokers...), Transport: cfg.transport()}
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: topics})
+	if err != nil {
+		return fmt.Errorf("broker metadata: %w", err)
+	}
+	partitions := make(map[string]int, len(topics))
+	for _, t := range meta.Topics {
+		switch {
+		case t.Error == nil:
+			partitions[t.Name] = len(t.Partitions)
+		case !errors.Is(t.Error, kafka.UnknownTopicOrPartition):
+			return fmt.Errorf("topic %s: %w", t.Name, t.Error)
+		}
+	}
+
+	var missing, existing []string
+	for _, t := range topics {
+		if _, ok := partitions[t]; ok {
+			existing = append(existing, t)
+		} else {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 {
+		if !cfg.CreateTopics {
+			return fmt.Errorf("missing topics %s; create them or set KAFKA_CREATE_TOPICS=true", strings.Join(missing, ", "))
+		}
+		if err := createTopics(ctx, client, cfg, missing); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	for _, t := range existing {
+		if want := cfg.TopicPartitions; want > 0 && partitions[t] != want {
+			errs = append(errs, fmt.Errorf("topic %s has %d partitions, want %d", t, partitions[t], want))
+		}
+	}
+	if want := cfg.TopicRetention; want != 0 && len(existing) > 0 {
+		retention, err := topicRetentions(ctx, client, existing)
+		if err != nil {
+			return err
+		}
+		for _, t := range existing {
+			if got := retention[t]; got >= 0 && (want < 0 || got < want) {
+				errs = append(errs, fmt.Errorf("topic %s retains %s, want %s", t, retentionString(got), retentionString(want)))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func createTopics(ctx context.Context, client *kafka.Client, cfg KafkaConfig, topics []string) error {
+	req := &kafka.CreateTopicsRequest{}
+	for _, t := range topics {
+		tc := kafka.TopicConfig{Topic: t, NumPartitions: -1, ReplicationFactor: cfg.TopicReplication}
+		if cfg.TopicPartitions > 0 {
+			tc.NumPartitions = cfg.TopicPartitions
+		}
+		if cfg.TopicRetention != 0 {
+			tc.ConfigEntries = []kafka.ConfigEntry{{ConfigName: "retention.ms", ConfigValue: strconv.FormatInt(retentionMillis(cfg.TopicRetention), 10)}}
+		}
+		req.Topics = append(req.Topics, tc)
+	}
+	resp, err := client.CreateTopics(ctx, req)
+	if err != nil {
+		return fmt.Errorf("create topics: %w", err)
+	}
+	var errs []error
+	for _, t := range topics {
+		// Another replica starting at the same time may have won the race.
+		if err := resp.Errors[t]; err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+			errs = append(errs, fmt.Errorf("create topic %s: %w", t, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TopicRetention returns the retention.ms of the consumer's topic. A negative
+// duration means the topic keeps messages forever.
+func (c *Consumer) TopicRetention(ctx context.Context) (time.Duration, error) {
+	if _, ok := c.r.(*memoryReader); ok {
+		return -1, nil
+	}
+	if r, ok := c.r.(interface {
+		retention(context.Context) (time.Duration, error)
+	}); ok {
+		return r.retention(ctx)
+	}
+	topic := c.r.Config().Topic
+	retention, err := topicRetentions(ctx, c.client(), []string{topic})
+	if err != nil {
+		return 0, err
+	}
+	return retention[topic], nil
+}
+
+// topicRetentions returns the retention.ms of each topic, negative for
+// topics that keep messages forever.
+func topicRetentions(ctx context.Context, client *kafka.Client, topics []string) (map[string]time.Duration, error) {
+	req := &kafka.DescribeConfigsRequest{}
+	for _, t := range topics {
+		req.Resources = append(req.Resources, kafka.DescribeConfigRequestResource{
+			ResourceType: kafka.ResourceTypeTopic,
+			ResourceName: t,
+			ConfigNames:  []string{"retention.ms"},
+		})
+	}
+	resp, err := client.DescribeConfigs(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("describe topics %s: %w", strings.Join(topics, ", "), err)
+	}
+	out := make(map[string]time.Duration, len(topics))
+	for _, res := range resp.Resources {
+		if res.Error != nil {
+			return nil, fmt.Errorf("describe topic %s: %w", res.ResourceName, res.Error)
+		}
+		for _, e := range res.ConfigEntries {
+			if e.ConfigName != "retention.ms" {
+				continue
+			}
+			ms, err := strconv.ParseInt(e.ConfigValue, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("topic %s retention.ms %q: %w", res.ResourceName, e.ConfigValue, err)
+			}
+			if ms < 0 {
+				out[res.ResourceName] = -1
+			} else {
+				out[res.ResourceName] = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	for _, t := range topics {
+		if _, ok := out[t]; !ok {
+			return nil, fmt.Errorf("topic %s has no retention.ms", t)
+		}
+	}
+	return out, nil
+}
+
+func retentionMillis(d time.Duration) int64 {
+	if d < 0 {
+		return -1
+	}
+	return d.Milliseconds()
+}
+
+func retentionString(d time.Duration) string {
+	if d < 0 {
+		return "forever"
+	}
+	return d.String()
+}
+
+func uniq(s []string) []string {
+	out := append([]string(nil), s...)
+	sort.Strings(out)
+	n := 0
+	for i, v := range out {
+		if i == 0 || v != out[n-1] {
+			out[n] = v
+			n++
+		}
+	}
+	return out[:n]
+}
@@ -0,0 +1,182 @@
+package redstone
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/segmentio/kafka-go"
+)
+
+// A copy of the current schemas/events/vN/events.json, kept fresh by make
+// events.
+//
+//go:embed schema/events.json
+var eventsSchema []byte
+
+const eventsSchemaURL = "events.json"
+
+// ValidationMode says what happens to events that do not match their schema.
+type ValidationMode string
+
+const (
+	// ValidationOff skips validation.
+	ValidationOff ValidationMode = "off"
+	// ValidationWarn logs invalid events and lets them through.
+	ValidationWarn ValidationMode = "warn"
+	// ValidationStrict refuses to publish invalid events and sends invalid
+	// inbound events to the dead-letter topic without handling them.
+	ValidationStrict ValidationMode = "strict"
+)
+
+func ParseValidationMode(s string) (ValidationMode, error) {
+	switch m := ValidationMode(strings.ToLower(s)); m {
+	case ValidationOff, ValidationWarn, ValidationStrict:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown validation mode %q", s)
+}
+
+// ValidationError reports why an event does not match its schema.
+type ValidationError struct {
+	EventType string   `json:"event_type"`
+	Problems  []string `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s event: %s", e.EventType, strings.Join(e.Problems, "; "))
+}
+
+// Validator checks event payloads against the current event schema. Older
+// payloads must be upcast first.
+type Validator struct {
+	mode ValidationMode
+	log  *Logger
+
+	mu      sync.Mutex
+	schemas map[string]*jsonschema.Schema
+}
+
+func NewValidator(mode ValidationMode, log *Logger) *Validator {
+	return &Validator{mode: mode, log: log, schemas: make(map[string]*jsonschema.Schema)}
+}
+
+// SetValidator validates every event p publishes with Write.
+func (p *Producer) SetValidator(v *Validator) { p.validator = v }
+
+// SetValidator validates every message c consumes, including retry tiers,
+// before it reaches the handler.
+func (c *Consumer) SetValidator(v *Validator) { c.validator = v }
+
+// Validate checks the JSON payload of one event. It returns a
+// *ValidationError for schema violations.
+func (v *Validator) Validate(payload []byte) error {
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return &ValidationError{Problems: []string{"not JSON: " + err.Error()}}
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return &ValidationError{Problems: []string{"not a JSON object"}}
+	}
+	et, _ := obj["event_type"].(string)
+	if et == "" {
+		return &ValidationError{Problems: []string{"missing event_type"}}
+	}
+	s, err := v.schema(et)
+	if err != nil {
+		return &ValidationError{EventType: et, Problems: []string{err.Error()}}
+	}
+	var ve *jsonschema.ValidationError
+	if err := s.Validate(doc); errors.As(err, &ve) {
+		return &ValidationError{EventType: et, Problems: problems(ve, nil)}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v *Validator) enabled() bool { return v != nil && v.mode != ValidationOff }
+
+// check applies the mode to the outcome of Validate. A non-nil result means
+// the event must be rejected.
+func (v *Validator) check(payload []byte, fields map[string]any) error {
+	if !v.enabled() {
+		return nil
+	}
+	err := v.Validate(payload)
+	if err == nil {
+		return nil
+	}
+	if v.mode == ValidationStrict {
+		return err
+	}
+	f := map[string]any{"err": err.Error()}
+	for k, val := range fields {
+		f[k] = val
+	}
+	v.log.Warn("event failed schema validation", f)
+	return nil
+}
+
+func (v *Validator) schema(eventType string) (*jsonschema.Schema, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.schemas[eventType]; ok {
+		return s, nil
+	}
+	var defs struct {
+		Defs map[string]json.RawMessage `json:"$defs"`
+	}
+	if err := json.Unmarshal(eventsSchema, &defs); err != nil {
+		return nil, err
+	}
+	if _, ok := defs.Defs[eventType]; !ok || eventType == "BaseEvent" || eventType == "OrderItem" {
+		return nil, fmt.Errorf("unknown event type %q", eventType)
+	}
+
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	c.AssertFormat = true
+	if err := c.AddResource(eventsSchemaURL, bytes.NewReader(eventsSchema)); err != nil {
+		return nil, err
+	}
+	s, err := c.Compile(eventsSchemaURL + "#/$defs/" + eventType)
+	if err != nil {
+		return nil, err
+	}
+	v.schemas[eventType] = s
+	return s, nil
+}
+
+// problems flattens the leaves of a validation error tree.
+func problems(ve *jsonschema.ValidationError, out []string) []string {
+	if len(ve.Causes) == 0 {
+		loc := ve.InstanceLocation
+		if loc == "" {
+			loc = "/"
+		}
+		return append(out, loc+": "+ve.Message)
+	}
+	for _, c := range ve.Causes {
+		out = problems(c, out)
+	}
+	return out
+}
+
+// validationReport is the JSON recorded on dead-lettered invalid events.
+func validationReport(err error) (kafka.Header, bool) {
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		return kafka.Header{}, false
+	}
+	b, _ := json.Marshal(ve)
+	return kafka.Header{Key: headerValidationReport, Value: b}, true
+}
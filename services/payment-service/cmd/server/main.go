@@ -4,13 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
 
 	"github.com/redstone/payment-service/internal/redstone"
 )
@@ -18,10 +24,18 @@ import (
 type Config struct {
 	ServiceName string
 	HTTPPort string
-	KafkaBrokers []string
+	Kafka redstone.KafkaConfig
 	TopicInventory string
 	TopicPayments string
 	GroupID string
+	RetryDelays []time.Duration
+	TracesExporter string
+	Validation redstone.ValidationMode
+	EventFormat redstone.EventFormat
+	Codec redstone.Codec
+	OTLPEndpoint string
+	ExactlyOnce bool
+	TransactionalID string
 }
 
 func env(key, def string) string {
@@ -30,115 +44,187 @@ func env(key, def string) string {
 	return v
 }
 
-func parseCSV(s string) []string {
-	var out []string
+func parseDurations(s string) ([]time.Duration, error) {
+	var out []time.Duration
 	for _, p := range strings.Split(s, ",") {
-		p = strings.TrimSpace(p)
-		if p != "" { out = append(out, p) }
+		if p = strings.TrimSpace(p); p == "" { continue }
+		d, err := time.ParseDuration(p)
+		if err != nil { return nil, err }
+		out = append(out, d)
 	}
-	return out
+	return out, nil
 }
 
 func main() {
 	cfg := Config{
 		ServiceName: env("SERVICE_NAME","payment-service"),
 		HTTPPort: env("HTTP_PORT","8083"),
-		KafkaBrokers: parseCSV(env("KAFKA_BROKERS","localhost:9092")),
 		TopicInventory: env("KAFKA_TOPIC_INVENTORY","redstone.inventory"),
 		TopicPayments: env("KAFKA_TOPIC_PAYMENTS","redstone.payments"),
 		GroupID: env("KAFKA_GROUP_ID","payment-service"),
+		TracesExporter: env("OTEL_TRACES_EXPORTER","otlp"),
+		OTLPEndpoint: env("OTEL_EXPORTER_OTLP_ENDPOINT",""),
 	}
 	log := redstone.NewLogger(cfg.ServiceName)
+	level, err := redstone.ParseLevel(env("LOG_LEVEL","info"))
+	if err != nil {
+		log.Error("invalid LOG_LEVEL", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	log.SetLevel(level)
+	// Libraries logging through log/slog end up in the service log.
+	slog.SetDefault(slog.New(log.Handler()))
+	kafkaCfg, err := redstone.LoadKafkaConfig(env)
+	if err != nil {
+		log.Error("invalid kafka config", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	cfg.Kafka = kafkaCfg
+	if cfg.RetryDelays, err = parseDurations(env("KAFKA_RETRY_DELAYS","5s,1m,10m")); err != nil {
+		log.Error("invalid KAFKA_RETRY_DELAYS", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	// Exactly-once is the default wherever the transport supports it.
+	if cfg.ExactlyOnce, err = strconv.ParseBool(env("KAFKA_EXACTLY_ONCE",strconv.FormatBool(kafkaCfg.Transport == redstone.TransportKafka))); err != nil {
+		log.Error("invalid KAFKA_EXACTLY_ONCE", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	hostname, _ := os.Hostname()
+	cfg.TransactionalID = env("KAFKA_TRANSACTIONAL_ID",cfg.GroupID+"-"+hostname)
+	if cfg.Validation, err = redstone.ParseValidationMode(env("SCHEMA_VALIDATION","warn")); err != nil {
+		log.Error("invalid SCHEMA_VALIDATION", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.EventFormat, err = redstone.ParseEventFormat(env("EVENT_FORMAT","redstone")); err != nil {
+		log.Error("invalid EVENT_FORMAT", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if cfg.Codec, err = redstone.ParseCodec(env("EVENT_CODEC","json")); err != nil {
+		log.Error("invalid EVENT_CODEC", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	if err := redstone.CheckCodec(cfg.EventFormat, cfg.Codec); err != nil {
+		log.Error("invalid EVENT_CODEC", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownTracing, err := redstone.InitTracing(ctx, redstone.TracingConfig{
+		ServiceName: cfg.ServiceName,
+		Exporter:    cfg.TracesExporter,
+		Endpoint:    cfg.OTLPEndpoint,
+	})
+	if err != nil {
+		log.Error("tracing init failed", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
 
-	producer := redstone.NewProducer(cfg.KafkaBrokers, cfg.TopicPayments)
+	validator := redstone.NewValidator(cfg.Validation, log)
+	producer := redstone.NewProducer(cfg.Kafka, cfg.TopicPayments)
+	producer.SetValidator(validator)
+	producer.SetFormat(cfg.EventFormat, "/redstone/"+cfg.ServiceName)
+	producer.SetCodec(cfg.Codec)
 	defer producer.Close()
 
-	consumer := redstone.NewConsumer(cfg.KafkaBrokers, cfg.TopicInventory, cfg.GroupID)
+	consumer := redstone.NewRetryingConsumer(cfg.Kafka, cfg.TopicInventory, cfg.GroupID, cfg.RetryDelays)
+	consumer.SetValidator(validator)
 	defer consumer.Close()
+	if cfg.ExactlyOnce {
+		if err := consumer.SetExactlyOnce(cfg.TransactionalID, producer); err != nil {
+			log.Error("exactly-once setup failed", map[string]any{"err": err.Error()})
+			os.Exit(1)
+		}
+		log.Info("exactly-once processing enabled", map[string]any{"transactional_id": cfg.TransactionalID})
+	}
+	if err := redstone.EnsureTopics(ctx, cfg.Kafka, append(consumer.Topics(), producer.Topic())...); err != nil {
+		log.Error("topic check failed", map[string]any{"err": err.Error()})
+		os.Exit(1)
+	}
 
 	app := &App{cfg: cfg, log: log, producer: producer, consumer: consumer}
 
-	ctx := context.Background()
-	go app.consumeInventoryLoop(ctx)
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() { defer wg.Done(); f() }()
+	}
+	run(func() { consumer.Run(ctx, log, app.handleInventoryEvent) })
 
 	r := chi.NewRouter()
+	r.Use(redstone.TraceRoutes)
+	r.Use(redstone.MeasureHTTP)
 	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200); w.Write([]byte("ok")) })
+	r.Get("/readyz", redstone.ReadyHandler(map[string]redstone.Check{
+		"kafka_payments": producer.Check,
+		"consumer_inventory": consumer.Check,
+	}))
+	r.Handle("/metrics", redstone.MetricsHandler())
 	r.Get("/v1/mock/provider", func(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(map[string]any{"status":"ok"})
 	})
 
 	srv := &http.Server{
 		Addr: ":" + cfg.HTTPPort,
-		Handler: r,
+		Handler: redstone.TraceHTTP(cfg.ServiceName, r),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
-	log.Info("http server starting", map[string]any{"port": cfg.HTTPPort})
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Error("http server error", map[string]any{"err": err.Error()})
+	go func() {
+		log.Info("http server starting", map[string]any{"port": cfg.HTTPPort})
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("http server error", map[string]any{"err": err.Error()})
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info("shutting down", nil)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Error("http shutdown failed", map[string]any{"err": err.Error()})
 	}
+	// Loops return once their in-flight message is handled and committed;
+	// deferred closes then release the Kafka clients and the exporter.
+	wg.Wait()
 }
 
 type App struct {
 	cfg Config
 	log *redstone.Logger
-	producer *redstone.Producer
-	consumer *redstone.Consumer
+	producer redstone.Publisher
+	consumer redstone.Subscriber
 }
 
-func (a *App) consumeInventoryLoop(ctx context.Context) {
-	for {
-		m, err := a.consumer.Fetch(ctx)
-		if err != nil {
-			a.log.Error("inventory fetch failed", map[string]any{"err": err.Error()})
-			time.Sleep(500 * time.Millisecond)
-			continue
-		}
-
-		var envelope map[string]any
-		if err := json.Unmarshal(m.Value, &envelope); err != nil {
-			_ = a.consumer.Commit(ctx, m)
-			continue
-		}
-
-		et, _ := envelope["event_type"].(string)
-		if et != "InventoryReserved" {
-			_ = a.consumer.Commit(ctx, m)
-			continue
-		}
+func (a *App) handleInventoryEvent(ctx context.Context, m kafka.Message) error {
+	// Filter on headers so other inventory events are never decoded
+	if redstone.MetadataOf(m).EventType != "InventoryReserved" {
+		return nil
+	}
 
-		var ev redstone.InventoryReserved
-		if json.Unmarshal(m.Value, &ev) != nil {
-			_ = a.consumer.Commit(ctx, m)
-			continue
-		}
+	var ev redstone.InventoryReserved
+	if err := redstone.Decode(m, &ev); err != nil {
+		return err
+	}
 
-		// Mock payment: succeed most of the time; fail if order_id ends with certain pattern
-		if strings.HasSuffix(ev.OrderID, "0") {
-			out := redstone.PaymentFailed{
-				BaseEvent: redstone.BaseEvent{
-					EventID: uuid.NewString(),
-					EventType: "PaymentFailed",
-					OccurredAt: time.Now().UTC(),
-					CorrelationID: ev.CorrelationID,
-				},
-				OrderID: ev.OrderID,
-				Reason: "mock decline",
-			}
-			_ = a.producer.Write(ctx, ev.OrderID, out)
-		} else {
-			out := redstone.PaymentCaptured{
-				BaseEvent: redstone.BaseEvent{
-					EventID: uuid.NewString(),
-					EventType: "PaymentCaptured",
-					OccurredAt: time.Now().UTC(),
-					CorrelationID: ev.CorrelationID,
-				},
-				OrderID: ev.OrderID,
-				Amount: 0,
-			}
-			_ = a.producer.Write(ctx, ev.OrderID, out)
+	// Mock payment: succeed most of the time; fail if order_id ends with certain pattern
+	var out any = redstone.PaymentCaptured{
+		BaseEvent: redstone.CausedBy(ev.BaseEvent, "PaymentCaptured"),
+		OrderID:   ev.OrderID,
+		Amount:    ev.Amount,
+	}
+	if strings.HasSuffix(ev.OrderID, "0") {
+		out = redstone.PaymentFailed{
+			BaseEvent: redstone.CausedBy(ev.BaseEvent, "PaymentFailed"),
+			OrderID:   ev.OrderID,
+			Reason:    "mock decline",
 		}
-
-		_ = a.consumer.Commit(ctx, m)
 	}
+	// The result must reach order-service; a broker hiccup is retried
+	// rather than dead-lettered.
+	if err := a.producer.Write(ctx, ev.OrderID, out); err != nil {
+		return redstone.Retryable(fmt.Errorf("publish payment result: %w", err))
+	}
+	return nil
 }
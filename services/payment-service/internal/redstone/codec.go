@@ -0,0 +1,130 @@
+package redstone
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Content types of event payloads, sent in the content-type header.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Codec encodes event structs for the wire.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// JSONCodec encodes events as the Redstone JSON envelope. It is the
+	// default.
+	JSONCodec Codec = jsonCodec{}
+	// ProtobufCodec encodes events per schemas/events/v2/events.proto. It
+	// is smaller and cheaper to decode than JSON; schema validation and
+	// upcasting still work on JSON and convert on demand.
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+func ParseCodec(s string) (Codec, error) {
+	switch strings.ToLower(s) {
+	case "json":
+		return JSONCodec, nil
+	case "protobuf":
+		return ProtobufCodec, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", s)
+}
+
+// CheckCodec reports an error if events cannot be published in format f
+// with codec c.
+func CheckCodec(f EventFormat, c Codec) error {
+	cloudEvents := f == FormatCloudEventsStructured || f == FormatCloudEventsBinary
+	if cloudEvents && c != nil && c != JSONCodec {
+		return fmt.Errorf("%s needs the JSON codec", f)
+	}
+	return nil
+}
+
+// SetCodec makes p encode events with c. CloudEvents formats need
+// JSONCodec.
+func (p *Producer) SetCodec(c Codec) { p.codec = c }
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return ContentTypeJSON }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	pm, ok := v.(protoMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("protobuf: %T is not an event", v)
+	}
+	return pm.appendProto(nil), nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	pu, ok := v.(protoUnmarshaler)
+	if !ok {
+		return fmt.Errorf("protobuf: %T is not an event pointer", v)
+	}
+	return pu.unmarshalProto(data)
+}
+
+func contentType(m kafka.Message) string {
+	for _, h := range m.Headers {
+		if h.Key == headerContentType {
+			return string(h.Value)
+		}
+	}
+	return ContentTypeJSON
+}
+
+// Decode unmarshals the payload of a consumed message into v, a pointer to
+// an event struct, with the codec named by its content-type header.
+func Decode(m kafka.Message, v any) error {
+	if contentType(m) == ContentTypeProtobuf {
+		return ProtobufCodec.Unmarshal(m.Value, v)
+	}
+	return JSONCodec.Unmarshal(m.Value, v)
+}
+
+// protoToJSON re-encodes a protobuf message as the JSON envelope.
+func protoToJSON(m kafka.Message) (kafka.Message, error) {
+	ev, err := newProtoEvent(MetadataOf(m).EventType)
+	if err != nil {
+		return m, err
+	}
+	if err := ev.unmarshalProto(m.Value); err != nil {
+		return m, fmt.Errorf("protobuf: %w", err)
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return m, err
+	}
+	headers := append([]kafka.Header(nil), m.Headers...)
+	headerCarrier{&headers}.Set(headerContentType, ContentTypeJSON)
+	m.Value, m.Headers = b, headers
+	return m, nil
+}
+
+// currentProto reports whether m is a protobuf event at SchemaVersion, which
+// handlers can decode without conversion.
+func currentProto(m kafka.Message) bool {
+	if contentType(m) != ContentTypeProtobuf {
+		return false
+	}
+	v, err := strconv.Atoi(MetadataOf(m).SchemaVersion)
+	return err == nil && v >= SchemaVersion
+}
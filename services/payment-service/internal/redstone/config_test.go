@@ -0,0 +1,273 @@
+package redstone
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// envOf looks keys up in vars, falling back to the default.
+func envOf(vars map[string]string) func(key, def string) string {
+	return func(key, def string) string {
+		if v, ok := vars[key]; ok {
+			return v
+		}
+		return def
+	}
+}
+
+func TestLoadKafkaConfigDefaults(t *testing.T) {
+	cfg, err := LoadKafkaConfig(envOf(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Transport != TransportKafka || len(cfg.Brokers) != 1 || cfg.Brokers[0] != "localhost:9092" {
+		t.Errorf("transport %q brokers %v", cfg.Transport, cfg.Brokers)
+	}
+	if cfg.Compression != 0 || cfg.RequiredAcks != kafka.RequireAll || cfg.BatchSize != 100 || cfg.BatchTimeout != 50*time.Millisecond {
+		t.Errorf("producer settings %+v", cfg)
+	}
+	if cfg.TLS != nil || cfg.SASL != nil {
+		t.Errorf("TLS %v SASL %v, want neither", cfg.TLS, cfg.SASL)
+	}
+	if cfg.TopicPartitions != 0 || cfg.TopicReplication != -1 || cfg.TopicRetention != 0 || cfg.CreateTopics {
+		t.Errorf("topic settings %+v", cfg)
+	}
+}
+
+func TestLoadKafkaConfig(t *testing.T) {
+	cfg, err := LoadKafkaConfig(envOf(map[string]string{
+		"KAFKA_BROKERS":       " b1:9093, ,b2:9093",
+		"KAFKA_BATCH_SIZE":    "500",
+		"KAFKA_BATCH_TIMEOUT": "5ms",
+		"KAFKA_TLS_ENABLED":   "true",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(cfg.Brokers, ",") != "b1:9093,b2:9093" {
+		t.Errorf("brokers %q", cfg.Brokers)
+	}
+	if cfg.BatchSize != 500 || cfg.BatchTimeout != 5*time.Millisecond {
+		t.Errorf("batch %d, %v", cfg.BatchSize, cfg.BatchTimeout)
+	}
+	if cfg.TLS == nil || cfg.TLS.RootCAs != nil || cfg.TLS.MinVersion != tls.VersionTLS12 {
+		t.Errorf("TLS %+v, want TLS 1.2+ with system roots", cfg.TLS)
+	}
+}
+
+func TestLoadKafkaConfigCompression(t *testing.T) {
+	for name, want := range map[string]kafka.Compression{
+		"none":   0,
+		"gzip":   kafka.Gzip,
+		"snappy": kafka.Snappy,
+		"lz4":    kafka.Lz4,
+		"zstd":   kafka.Zstd,
+	} {
+		cfg, err := LoadKafkaConfig(envOf(map[string]string{"KAFKA_COMPRESSION": name}))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if cfg.Compression != want {
+			t.Errorf("%s: got %v", name, cfg.Compression)
+		}
+	}
+}
+
+func TestLoadKafkaConfigAcks(t *testing.T) {
+	for name, want := range map[string]kafka.RequiredAcks{
+		"none": kafka.RequireNone,
+		"one":  kafka.RequireOne,
+		"all":  kafka.RequireAll,
+	} {
+		cfg, err := LoadKafkaConfig(envOf(map[string]string{"KAFKA_REQUIRED_ACKS": name}))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if cfg.RequiredAcks != want {
+			t.Errorf("%s: got %v", name, cfg.RequiredAcks)
+		}
+	}
+}
+
+func TestLoadKafkaConfigSASL(t *testing.T) {
+	for _, name := range []string{"PLAIN", "SCRAM-SHA-256", "scram-sha-512"} {
+		cfg, err := LoadKafkaConfig(envOf(map[string]string{
+			"KAFKA_SASL_MECHANISM": name,
+			"KAFKA_SASL_USERNAME":  "u",
+			"KAFKA_SASL_PASSWORD":  "p",
+		}))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if cfg.SASL == nil || cfg.SASL.Name() != strings.ToUpper(name) {
+			t.Errorf("%s: got %v", name, cfg.SASL)
+		}
+	}
+}
+
+func TestLoadKafkaConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		vars map[string]string
+		err  string
+	}{
+		{map[string]string{"REDSTONE_TRANSPORT": "amqp"}, "REDSTONE_TRANSPORT"},
+		{map[string]string{"KAFKA_COMPRESSION": "brotli"}, "KAFKA_COMPRESSION"},
+		{map[string]string{"KAFKA_REQUIRED_ACKS": "two"}, "KAFKA_REQUIRED_ACKS"},
+		{map[string]string{"KAFKA_BATCH_SIZE": "0"}, "KAFKA_BATCH_SIZE"},
+		{map[string]string{"KAFKA_BATCH_TIMEOUT": "soon"}, "KAFKA_BATCH_TIMEOUT"},
+		{map[string]string{"KAFKA_TLS_ENABLED": "maybe"}, "KAFKA_TLS_ENABLED"},
+		{map[string]string{"KAFKA_TLS_CA_FILE": "/nonexistent/ca.pem"}, "KAFKA_TLS_CA_FILE"},
+		{map[string]string{"KAFKA_TLS_CERT_FILE": "client.pem"}, "must be set together"},
+		{map[string]string{"KAFKA_SASL_MECHANISM": "PLAIN", "KAFKA_SASL_USERNAME": "u"}, "KAFKA_SASL_PASSWORD"},
+		{map[string]string{"KAFKA_SASL_MECHANISM": "GSSAPI", "KAFKA_SASL_USERNAME": "u", "KAFKA_SASL_PASSWORD": "p"}, "unsupported mechanism"},
+	} {
+		_, err := LoadKafkaConfig(envOf(c.vars))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: got %v, want an error about %s", c.vars, err, c.err)
+		}
+	}
+}
+
+// TestKafkaTLS dials a TLS listener standing in for a broker that requires
+// client certificates, with the files named in the environment.
+func TestKafkaTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCert(t, "test-ca", nil, nil)
+	server, serverKey := newCert(t, "broker", ca, caKey)
+	client, clientKey := newCert(t, "order-service", ca, caKey)
+	caFile := writePEM(t, dir, "ca.pem", ca, nil)
+	certFile := writePEM(t, dir, "client.pem", client, nil)
+	keyFile := writePEM(t, dir, "client-key.pem", nil, clientKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peers := make(chan string, 4)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tc := c.(*tls.Conn)
+			if tc.Handshake() == nil {
+				peers <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			tc.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cfg, err := LoadKafkaConfig(envOf(map[string]string{
+		"KAFKA_BROKERS":       ln.Addr().String(),
+		"KAFKA_TLS_CA_FILE":   caFile,
+		"KAFKA_TLS_CERT_FILE": certFile,
+		"KAFKA_TLS_KEY_FILE":  keyFile,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cfg.dialer().DialContext(ctx, "tcp", cfg.Brokers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case cn := <-peers:
+		if cn != "order-service" {
+			t.Fatalf("broker saw client %q", cn)
+		}
+	case <-ctx.Done():
+		t.Fatal("broker saw no handshake")
+	}
+
+	// Without the CA the broker's certificate is not trusted.
+	cfg, err = LoadKafkaConfig(envOf(map[string]string{"KAFKA_BROKERS": ln.Addr().String(), "KAFKA_TLS_ENABLED": "true"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := cfg.dialer().DialContext(ctx, "tcp", cfg.Brokers[0]); err == nil {
+		conn.Close()
+		t.Fatal("dialed a broker signed by an unknown CA")
+	}
+}
+
+// newCert returns a certificate for cn signed by parent, or a self-signed
+// CA when parent is nil.
+func newCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePEM writes cert or key to dir/name and returns the path.
+func writePEM(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	block := &pem.Block{}
+	if cert != nil {
+		block.Type, block.Bytes = "CERTIFICATE", cert.Raw
+	} else {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Type, block.Bytes = "EC PRIVATE KEY", der
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -3,23 +3,57 @@ package redstone
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
 )
 
+// messageWriter is the part of *kafka.Writer a Producer uses.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// messageReader is the part of *kafka.Reader a Consumer uses.
+type messageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Config() kafka.ReaderConfig
+	Close() error
+}
+
 type Producer struct {
-	w *kafka.Writer
+	w         messageWriter
+	topic     string
+	validator *Validator
+	format    EventFormat
+	source    string
+	codec     Codec
 }
 
-func NewProducer(brokers []string, topic string) *Producer {
+func NewProducer(cfg KafkaConfig, topic string) *Producer {
+	switch cfg.Transport {
+	case TransportNATS:
+		return newNATSProducer(cfg, topic)
+	case TransportRedis:
+		return newRedisProducer(cfg, topic)
+	}
 	return &Producer{
+		topic: topic,
 		w: &kafka.Writer{
-			Addr:         kafka.TCP(brokers...),
+			Addr:         kafka.TCP(cfg.Brokers...),
 			Topic:        topic,
 			Balancer:     &kafka.Hash{},
-			BatchTimeout: 50 * time.Millisecond,
-			RequiredAcks: kafka.RequireAll,
+			Compression:  cfg.Compression,
+			BatchSize:    cfg.BatchSize,
+			BatchTimeout: cfg.BatchTimeout,
+			RequiredAcks: cfg.RequiredAcks,
+			Transport:    cfg.transport(),
 		},
 	}
 }
@@ -27,39 +61,155 @@ func NewProducer(brokers []string, topic string) *Producer {
 func (p *Producer) Close() error { return p.w.Close() }
 
 func (p *Producer) Write(ctx context.Context, key string, v any) error {
-	b, err := json.Marshal(v)
-	if err != nil {
+	codec := p.codec
+	if codec == nil {
+		codec = JSONCodec
+	}
+	if err := CheckCodec(p.format, codec); err != nil {
 		return err
 	}
-	return p.w.WriteMessages(ctx, kafka.Message{
-		Key:   []byte(key),
-		Value: b,
-		Time:  time.Now(),
+	cloudEvents := p.format == FormatCloudEventsStructured || p.format == FormatCloudEventsBinary
+
+	base, typed := baseOf(v)
+	var b []byte
+	// The JSON form is needed to validate, to upcast, or to publish as JSON.
+	if !typed || versionOf(base) < SchemaVersion || p.validator.enabled() || codec == JSONCodec {
+		var err error
+		if b, err = json.Marshal(v); err != nil {
+			return err
+		}
+		if !typed {
+			_ = json.Unmarshal(b, &base)
+		}
+		if versionOf(base) < SchemaVersion {
+			// e.g. outbox rows written before an upgrade.
+			if b, err = Upcast(b); err != nil {
+				return err
+			}
+			base.SchemaVersion = SchemaVersion
+			typed = false
+		}
+		if err := p.validator.check(b, map[string]any{"topic": p.topic, "key": key, "event_id": base.EventID}); err != nil {
+			return err
+		}
+	}
+
+	value := b
+	if codec != JSONCodec {
+		if !typed {
+			ev, err := newProtoEvent(base.EventType)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(b, ev); err != nil {
+				return err
+			}
+			v = ev
+		}
+		var err error
+		if value, err = codec.Marshal(v); err != nil {
+			return err
+		}
+	}
+
+	ctx, span := startPublishSpan(ctx, p.topic, key, base)
+	headers := eventHeaders(base)
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier{&headers})
+	var err error
+	if cloudEvents {
+		if value, headers, err = toCloudEvent(p.format, p.source, key, value, headers); err != nil {
+			endSpan(span, err)
+			return err
+		}
+	} else {
+		headers = append(headers, kafka.Header{Key: headerContentType, Value: []byte(codec.ContentType())})
+	}
+	err = p.w.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(key),
+		Value:   value,
+		Headers: headers,
+		Time:    time.Now(),
 	})
+	endSpan(span, err)
+	return err
+}
+
+// baseOf returns the envelope of v when v is an event struct.
+func baseOf(v any) (BaseEvent, bool) {
+	if e, ok := v.(interface{ Base() BaseEvent }); ok {
+		return e.Base(), true
+	}
+	return BaseEvent{}, false
+}
+
+// WriteMessage publishes an already encoded message as-is.
+func (p *Producer) WriteMessage(ctx context.Context, m kafka.Message) error {
+	return p.w.WriteMessages(ctx, m)
 }
 
 type Consumer struct {
-	r *kafka.Reader
+	r         messageReader
+	transport kafka.RoundTripper
+	stages    []*retryStage
+	dlq       *Producer
+	workers   int
+	validator *Validator
+	txn       *transactor
 }
 
-func NewConsumer(brokers []string, topic, groupID string) *Consumer {
+func NewConsumer(cfg KafkaConfig, topic, groupID string) *Consumer {
+	switch cfg.Transport {
+	case TransportNATS:
+		return newNATSConsumer(cfg, topic, groupID)
+	case TransportRedis:
+		return newRedisConsumer(cfg, topic, groupID)
+	}
+	dialer := cfg.dialer()
+	dialer.ClientID = memberClientID(topic, groupID)
 	return &Consumer{
 		r: kafka.NewReader(kafka.ReaderConfig{
-			Brokers:  brokers,
+			Brokers:  cfg.Brokers,
 			Topic:    topic,
 			GroupID:  groupID,
 			MinBytes: 1,
 			MaxBytes: 10e6,
+			Dialer:   dialer,
+			// Skip output of aborted transactions, see SetExactlyOnce.
+			IsolationLevel: kafka.ReadCommitted,
 		}),
+		transport: cfg.transport(),
 	}
 }
 
-func (c *Consumer) Close() error { return c.r.Close() }
+var memberSeq atomic.Int64
+
+// memberClientID names a reader's connections so its own entry can be found
+// among the group's members, see Consumer.Check.
+func memberClientID(topic, groupID string) string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s/%s#%d", groupID, host, topic, memberSeq.Add(1))
+}
+
+func (c *Consumer) Close() error {
+	errs := []error{c.r.Close()}
+	for _, s := range c.stages {
+		errs = append(errs, s.consumer.Close(), s.producer.Close())
+	}
+	if c.dlq != nil {
+		errs = append(errs, c.dlq.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// client returns an admin client for the consumer's brokers.
+func (c *Consumer) client() *kafka.Client {
+	return &kafka.Client{Addr: kafka.TCP(c.r.Config().Brokers...), Transport: c.transport}
+}
 
 func (c *Consumer) Fetch(ctx context.Context) (kafka.Message, error) {
 	return c.r.FetchMessage(ctx)
 }
 
-func (c *Consumer) Commit(ctx context.Context, m kafka.Message) error {
-	return c.r.CommitMessages(ctx, m)
+func (c *Consumer) Commit(ctx context.Context, msgs ...kafka.Message) error {
+	return c.r.CommitMessages(ctx, msgs...)
 }
@@ -0,0 +1,261 @@
+package redstone
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logBuffer collects a Logger's output; it is safe to read while the
+// logger writes.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries decodes the lines written so far.
+func (b *logBuffer) entries(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]any
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func testLogger() (*Logger, *logBuffer) {
+	buf := &logBuffer{}
+	l := NewLogger("test")
+	l.out = buf
+	return l, buf
+}
+
+func msgs(entries []map[string]any) []string {
+	var out []string
+	for _, e := range entries {
+		out = append(out, fmt.Sprint(e["msg"]))
+	}
+	return out
+}
+
+func TestLoggerLevel(t *testing.T) {
+	l, buf := testLogger()
+	logAll := func(round string) {
+		l.Debug(round+" debug", nil)
+		l.Info(round+" info", nil)
+		l.WarnContext(context.Background(), round+" warn", nil)
+		l.ErrorContext(context.Background(), round+" error", nil)
+	}
+	logAll("default")
+	l.SetLevel(slog.LevelWarn)
+	logAll("warn")
+	l.SetLevel(slog.LevelDebug)
+	logAll("debug")
+
+	got := fmt.Sprint(msgs(buf.entries(t)))
+	want := fmt.Sprint([]string{
+		"default info", "default warn", "default error",
+		"warn warn", "warn error",
+		"debug debug", "debug info", "debug warn", "debug error",
+	})
+	if got != want {
+		t.Fatalf("logged %s, want %s", got, want)
+	}
+
+	// Libraries logging through slog are filtered the same way.
+	l.SetLevel(slog.LevelError)
+	s := slog.New(l.Handler())
+	s.Warn("slog warn")
+	s.Error("slog error")
+	if got := msgs(buf.entries(t)); got[len(got)-1] != "slog error" || got[len(got)-2] != "debug error" {
+		t.Fatalf("logged %v after slog", got)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]slog.Level{"debug": slog.LevelDebug, "INFO": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError} {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("%s: got %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("parsed an unknown level")
+	}
+}
+
+func TestLoggerEntry(t *testing.T) {
+	l, buf := testLogger()
+	l.Warn("disk low", map[string]any{"free": 3})
+	e := buf.entries(t)[0]
+	if e["level"] != "WARN" || e["msg"] != "disk low" || e["service"] != "test" || e["free"] != float64(3) {
+		t.Errorf("entry %v", e)
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, fmt.Sprint(e["ts"])); err != nil || time.Since(ts) > time.Minute {
+		t.Errorf("ts %v: %v", e["ts"], err)
+	}
+}
+
+// Context fields are merged, explicit fields win, and the standard keys
+// cannot be overridden.
+func TestWithLogFields(t *testing.T) {
+	l, buf := testLogger()
+	ctx := WithLogFields(context.Background(), map[string]any{"order_id": "o1", "step": "reserve"})
+	ctx = WithLogFields(ctx, map[string]any{"step": "capture", "attempt": 2})
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}, TraceFlags: trace.FlagsSampled})
+	ctx = trace.ContextWithSpanContext(ctx, sc)
+
+	l.InfoContext(ctx, "captured", map[string]any{"attempt": 3, "msg": "spoofed"})
+	l.Info("no context", nil)
+	entries := buf.entries(t)
+	e := entries[0]
+	for k, want := range map[string]any{
+		"order_id": "o1",
+		"step":     "capture",
+		"attempt":  float64(3),
+		"msg":      "captured",
+		"trace_id": sc.TraceID().String(),
+	} {
+		if e[k] != want {
+			t.Errorf("%s = %v, want %v", k, e[k], want)
+		}
+	}
+	if _, ok := entries[1]["order_id"]; ok {
+		t.Errorf("fields logged without their context: %v", entries[1])
+	}
+}
+
+// The fields map of the caller is reused across calls in handlers, so
+// logging must not add to it.
+func TestLoggerKeepsFields(t *testing.T) {
+	l, _ := testLogger()
+	ctx := WithLogFields(context.Background(), map[string]any{"order_id": "o1"})
+	fields := map[string]any{"sku": "A"}
+	l.ErrorContext(ctx, "reserve failed", fields)
+	if fmt.Sprint(fields) != "map[sku:A]" {
+		t.Fatalf("fields changed to %v", fields)
+	}
+	attached := map[string]any{"order_id": "o1"}
+	WithLogFields(WithLogFields(context.Background(), attached), map[string]any{"order_id": "o2"})
+	if attached["order_id"] != "o1" {
+		t.Fatalf("attached fields changed to %v", attached)
+	}
+}
+
+func TestWithEventFields(t *testing.T) {
+	l, buf := testLogger()
+	m := kafka.Message{
+		Key: []byte("o1"),
+		Headers: []kafka.Header{
+			{Key: HeaderEventID, Value: []byte("e1")},
+			{Key: HeaderCorrelationID, Value: []byte("c1")},
+		},
+	}
+	l.InfoContext(withEventFields(context.Background(), m), "handled", nil)
+	// An event with no key or correlation ID does not log empty ones.
+	l.InfoContext(withEventFields(context.Background(), kafka.Message{Value: []byte(`{"event_id":"e2"}`)}), "handled", nil)
+
+	entries := buf.entries(t)
+	if e := entries[0]; e["order_id"] != "o1" || e["event_id"] != "e1" || e["correlation_id"] != "c1" {
+		t.Errorf("entry %v", e)
+	}
+	if e := entries[1]; e["event_id"] != "e2" || e["order_id"] != nil || e["correlation_id"] != nil {
+		t.Errorf("entry %v", e)
+	}
+}
+
+// A handler's context carries the event's identifiers, so whatever it logs,
+// directly or through slog, can be found by order or correlation ID.
+func TestConsumerLogFields(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := NewMemoryBroker(1)
+	ev := sampleEvents()[1]
+	if err := b.Producer("t").Write(ctx, "o1", ev); err != nil {
+		t.Fatal(err)
+	}
+
+	l, buf := testLogger()
+	s := slog.New(l.Handler())
+	done := make(chan struct{})
+	c := b.Consumer("t", "g")
+	runCtx, stop := context.WithCancel(ctx)
+	go func() {
+		defer close(done)
+		c.Run(runCtx, l, func(hctx context.Context, m kafka.Message) error {
+			l.InfoContext(hctx, "reserved", nil)
+			s.InfoContext(hctx, "via slog")
+			stop()
+			return nil
+		})
+	}()
+	<-done
+
+	var found int
+	for _, e := range buf.entries(t) {
+		if e["msg"] != "reserved" && e["msg"] != "via slog" {
+			continue
+		}
+		found++
+		if e["order_id"] != "o1" || e["event_id"] != "e1" || e["correlation_id"] != "c1" {
+			t.Errorf("entry %v", e)
+		}
+	}
+	if found != 2 {
+		t.Fatalf("%d handler entries, want 2", found)
+	}
+}
+
+func TestSlogHandler(t *testing.T) {
+	l, buf := testLogger()
+	s := slog.New(l.Handler()).With("component", "pool").WithGroup("conn").With("id", 7)
+	s.Warn("slow", "took", 1500*time.Millisecond, "err", errors.New("timeout"),
+		slog.Group("peer", "host", "db1"), slog.Group("", "flat", true))
+	e := buf.entries(t)[0]
+	for k, want := range map[string]any{
+		"level":          "WARN",
+		"msg":            "slow",
+		"component":      "pool",
+		"conn.id":        float64(7),
+		"conn.took":      "1.5s",
+		"conn.err":       "timeout",
+		"conn.peer.host": "db1",
+		"conn.flat":      true,
+	} {
+		if e[k] != want {
+			t.Errorf("%s = %v, want %v", k, e[k], want)
+		}
+	}
+
+	// Handlers derived with attributes don't leak them into their parent.
+	base := slog.New(l.Handler())
+	_ = base.With("a", 1)
+	base.Warn("plain")
+	if e := buf.entries(t)[1]; e["a"] != nil {
+		t.Errorf("entry %v", e)
+	}
+}
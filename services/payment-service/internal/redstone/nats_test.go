@@ -0,0 +1,169 @@
+package redstone
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/segmentio/kafka-go"
+)
+
+// natsConfig starts an in-process JetStream server and creates topics.
+func natsConfig(t *testing.T, topics ...string) KafkaConfig {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	cfg := KafkaConfig{Transport: TransportNATS, NATSURL: s.ClientURL(), CreateTopics: true}
+	if err := EnsureTopics(context.Background(), cfg, topics...); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestNATSRoundTrip(t *testing.T) {
+	cfg := natsConfig(t, "t")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := NewProducer(cfg, "t")
+	defer p.Close()
+	keys := []string{"a", "b", "c", "a"}
+	for i, k := range keys {
+		m := kafka.Message{Key: []byte(k), Value: []byte{'0' + byte(i)}, Headers: []kafka.Header{{Key: "h", Value: []byte(k)}}}
+		if err := p.WriteMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewConsumer(cfg, "t", "g")
+	defer c.Close()
+	for i, k := range keys {
+		m, err := c.Fetch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Key) != k || string(m.Value) != string(rune('0'+i)) || len(m.Headers) != 1 || string(m.Headers[0].Value) != k {
+			t.Fatalf("message %d: %+v", i, m)
+		}
+		if err := c.Commit(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Committing a message acks only that message: one fetched earlier and
+// still in flight is delivered again after the consumer goes away.
+func TestNATSCommitAcksOnlyCommitted(t *testing.T) {
+	cfg := natsConfig(t, "t")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := NewProducer(cfg, "t")
+	defer p.Close()
+	for _, k := range []string{"a", "b"} {
+		if err := p.WriteMessage(ctx, kafka.Message{Key: []byte(k), Value: []byte(k)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewConsumer(cfg, "t", "g")
+	first, err := c.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Offset >= second.Offset {
+		t.Fatalf("offsets %d, %d", first.Offset, second.Offset)
+	}
+	if err := c.Commit(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c = NewConsumer(cfg, "t", "g")
+	defer c.Close()
+	m, err := c.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Offset != first.Offset {
+		t.Fatalf("redelivered offset %d, want %d", m.Offset, first.Offset)
+	}
+	if err := c.Commit(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	short, cancelShort := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancelShort()
+	if m, err := c.Fetch(short); err == nil {
+		t.Fatalf("committed offset %d delivered again", m.Offset)
+	}
+}
+
+// With several workers every message is handled and acked once.
+func TestNATSWorkers(t *testing.T) {
+	cfg := natsConfig(t, "t")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := NewProducer(cfg, "t")
+	defer p.Close()
+	const n = 50
+	for i := 0; i < n; i++ {
+		if err := p.WriteMessage(ctx, kafka.Message{Key: []byte{'a' + byte(i%5)}, Value: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewConsumer(cfg, "t", "g")
+	c.SetWorkers(4)
+	var mu sync.Mutex
+	seen := map[int64]int{}
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(runCtx, NewLogger("test"), func(_ context.Context, m kafka.Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			seen[m.Offset]++
+			return nil
+		})
+	}()
+	for {
+		mu.Lock()
+		got := len(seen)
+		mu.Unlock()
+		if got == n {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("handled %d of %d", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	<-done
+	c.Close()
+	for off, k := range seen {
+		if k != 1 {
+			t.Errorf("offset %d handled %d times", off, k)
+		}
+	}
+
+	c = NewConsumer(cfg, "t", "g")
+	defer c.Close()
+	short, cancelShort := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancelShort()
+	if m, err := c.Fetch(short); err == nil {
+		t.Fatalf("offset %d delivered after commit", m.Offset)
+	}
+}
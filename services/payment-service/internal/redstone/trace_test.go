@@ -0,0 +1,116 @@
+package redstone
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// An HTTP request, the event it relays through the outbox, the handling of
+// that event and what the handler publishes form one trace.
+func TestTracePropagation(t *testing.T) {
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+	exp := tracetest.NewInMemoryExporter()
+	shutdown, err := InitTracing(context.Background(), TracingConfig{ServiceName: "test", SpanExporter: keepSpans{exp}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewMemoryBroker(1)
+	orders, payments := b.Producer("orders"), b.Producer("payments")
+	base := BaseEvent{EventID: "e1", OccurredAt: time.Now().UTC(), CorrelationID: "c1"}
+
+	// The handler stores the traceparent the way order-service writes it
+	// to the outbox; the relay publishes with it later.
+	var traceParent string
+	srv := httptest.NewServer(TraceHTTP("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParent = TraceParent(r.Context())
+	})))
+	defer srv.Close()
+	res, err := http.Post(srv.URL+"/v1/orders", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if traceParent == "" {
+		t.Fatal("no traceparent in the request context")
+	}
+	if err := orders.Write(ContextWithTraceParent(context.Background(), traceParent), "o1", NewOrderCreated(base, "o1", "u1", nil, "INR")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	handled := make(chan struct{})
+	go b.Consumer("orders", "g").Run(ctx, NewLogger("test"), func(ctx context.Context, m kafka.Message) error {
+		defer close(handled)
+		return payments.Write(ctx, "o1", NewPaymentCaptured(CausedBy(base, "PaymentCaptured"), "o1", 100))
+	})
+	select {
+	case <-handled:
+	case <-ctx.Done():
+		t.Fatal("event not handled")
+	}
+	cancel()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, s := range exp.GetSpans() {
+		spans[s.Name] = s
+	}
+	chain := []struct {
+		name string
+		kind trace.SpanKind
+	}{
+		{"test", trace.SpanKindServer},
+		{"orders publish", trace.SpanKindProducer},
+		{"orders process", trace.SpanKindConsumer},
+		{"payments publish", trace.SpanKindProducer},
+	}
+	var parent sdktrace.ReadOnlySpan
+	for i, c := range chain {
+		s, ok := spans[c.name]
+		if !ok {
+			t.Fatalf("no %q span in %v", c.name, names(exp.GetSpans()))
+		}
+		if s.SpanKind != c.kind {
+			t.Errorf("%s: kind %v, want %v", c.name, s.SpanKind, c.kind)
+		}
+		if i > 0 {
+			if s.SpanContext.TraceID() != parent.SpanContext().TraceID() {
+				t.Errorf("%s: trace %s, want %s", c.name, s.SpanContext.TraceID(), parent.SpanContext().TraceID())
+			}
+			if s.Parent.SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("%s: parent %s, want %s", c.name, s.Parent.SpanID(), chain[i-1].name)
+			}
+		}
+		parent = s.Snapshot()
+	}
+}
+
+// keepSpans keeps the exported spans past shutdown, which flushes them.
+type keepSpans struct{ *tracetest.InMemoryExporter }
+
+func (keepSpans) Shutdown(context.Context) error { return nil }
+
+func names(spans tracetest.SpanStubs) []string {
+	var out []string
+	for _, s := range spans {
+		out = append(out, s.Name)
+	}
+	return out
+}
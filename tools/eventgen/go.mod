@@ -0,0 +1,3 @@
+module github.com/redstone/eventgen
+
+go 1.22
@@ -0,0 +1,313 @@
+// Command eventgen generates the redstone event structs, event type
+// constants and constructors from the JSON schema in schemas/events.
+//
+//	eventgen -schema schemas/events/v2/events.json -out services/order-service/internal/redstone/events_gen.go
+//
+// With -check it writes nothing and exits non-zero if -out is stale.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"strings"
+)
+
+func main() {
+	schemaPath := flag.String("schema", "", "path to the events JSON schema")
+	out := flag.String("out", "", "Go file to write")
+	pkg := flag.String("package", "redstone", "package name of the generated file")
+	check := flag.Bool("check", false, "fail if -out differs from the generated code instead of writing it")
+	flag.Parse()
+	if *schemaPath == "" || *out == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	raw, err := os.ReadFile(*schemaPath)
+	if err != nil {
+		fatal(err)
+	}
+	code, err := generate(raw, *pkg)
+	if err != nil {
+		fatal(fmt.Errorf("%s: %w", *schemaPath, err))
+	}
+
+	if *check {
+		have, err := os.ReadFile(*out)
+		if err != nil {
+			fatal(err)
+		}
+		if !bytes.Equal(have, code) {
+			fatal(fmt.Errorf("%s is stale; run make events", *out))
+		}
+		return
+	}
+	if err := os.WriteFile(*out, code, 0o644); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "eventgen:", err)
+	os.Exit(1)
+}
+
+// schema is the subset of JSON Schema the event definitions use.
+type schema struct {
+	Ref         string         `json:"$ref"`
+	Type        string         `json:"type"`
+	Format      string         `json:"format"`
+	Description string         `json:"description"`
+	Items       *schema        `json:"items"`
+	Properties  orderedSchemas `json:"properties"`
+	Required    []string       `json:"required"`
+	AllOf       []*schema      `json:"allOf"`
+	GoType      string         `json:"x-go-type"`
+	Defs        orderedSchemas `json:"$defs"`
+	Version     int            `json:"x-schema-version"`
+}
+
+type namedSchema struct {
+	Name   string
+	Schema *schema
+}
+
+// orderedSchemas keeps object keys in document order, which becomes field
+// and declaration order in the generated code.
+type orderedSchemas []namedSchema
+
+func (o *orderedSchemas) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var s schema
+		if err := dec.Decode(&s); err != nil {
+			return err
+		}
+		*o = append(*o, namedSchema{Name: tok.(string), Schema: &s})
+	}
+	return nil
+}
+
+type field struct {
+	JSON     string
+	Name     string
+	Type     string
+	Doc      string
+	Required bool
+}
+
+type object struct {
+	Name   string
+	Doc    string
+	Event  bool
+	Fields []field
+}
+
+const baseEvent = "BaseEvent"
+
+func generate(raw []byte, pkg string) ([]byte, error) {
+	var root schema
+	if err := json.Unmarshal(raw, &root); err != nil {
+		return nil, err
+	}
+
+	var objects []object
+	for _, d := range root.Defs {
+		obj, err := buildObject(d.Name, d.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("$defs/%s: %w", d.Name, err)
+		}
+		objects = append(objects, obj)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by eventgen from the events JSON schema. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	if usesTime(objects) {
+		b.WriteString("import \"time\"\n\n")
+	}
+
+	if root.Version > 0 {
+		b.WriteString("// SchemaVersion is the event schema version this package produces.\n")
+		fmt.Fprintf(&b, "const SchemaVersion = %d\n\n", root.Version)
+	}
+
+	b.WriteString("// Event types, the value of event_type for each event.\nconst (\n")
+	for _, o := range objects {
+		if o.Event {
+			fmt.Fprintf(&b, "\tEvent%s = %q\n", o.Name, o.Name)
+		}
+	}
+	b.WriteString(")\n")
+
+	for _, o := range objects {
+		b.WriteString("\n")
+		writeDoc(&b, "", o.Doc)
+		fmt.Fprintf(&b, "type %s struct {\n", o.Name)
+		if o.Event {
+			fmt.Fprintf(&b, "\t%s\n", baseEvent)
+		}
+		for _, f := range o.Fields {
+			writeDoc(&b, "\t", f.Doc)
+			tag := f.JSON
+			if !f.Required {
+				tag += ",omitempty"
+			}
+			fmt.Fprintf(&b, "\t%s %s `json:%q`\n", f.Name, f.Type, tag)
+		}
+		b.WriteString("}\n")
+	}
+
+	for _, o := range objects {
+		if !o.Event {
+			continue
+		}
+		params := make([]string, 0, len(o.Fields))
+		assigns := make([]string, 0, len(o.Fields))
+		for _, f := range o.Fields {
+			p := paramName(f.JSON)
+			params = append(params, p+" "+f.Type)
+			assigns = append(assigns, f.Name+": "+p)
+		}
+		stamped := "event type"
+		if root.Version > 0 {
+			stamped = "event type and schema version"
+		}
+		fmt.Fprintf(&b, "\n// New%s builds the %s event on envelope base, setting its %s.\n", o.Name, o.Name, stamped)
+		fmt.Fprintf(&b, "func New%s(base BaseEvent, %s) %s {\n", o.Name, strings.Join(params, ", "), o.Name)
+		fmt.Fprintf(&b, "\tbase.EventType = Event%s\n", o.Name)
+		if root.Version > 0 {
+			b.WriteString("\tbase.SchemaVersion = SchemaVersion\n")
+		}
+		fmt.Fprintf(&b, "\treturn %s{BaseEvent: base, %s}\n}\n", o.Name, strings.Join(assigns, ", "))
+	}
+
+	return format.Source(b.Bytes())
+}
+
+// buildObject turns a definition into a struct. Events are definitions of
+// the form allOf [BaseEvent, {properties}].
+func buildObject(name string, s *schema) (object, error) {
+	obj := object{Name: name, Doc: s.Description}
+	body := s
+	if len(s.AllOf) > 0 {
+		if len(s.AllOf) != 2 || s.AllOf[0].Ref != "#/$defs/"+baseEvent {
+			return obj, fmt.Errorf("allOf must be [BaseEvent, object]")
+		}
+		obj.Event = true
+		body = s.AllOf[1]
+		if obj.Doc == "" {
+			obj.Doc = body.Description
+		}
+	}
+	if body.Type != "object" {
+		return obj, fmt.Errorf("type must be object")
+	}
+
+	required := make(map[string]bool, len(body.Required))
+	for _, r := range body.Required {
+		required[r] = true
+	}
+	for _, p := range body.Properties {
+		if obj.Event && p.Name == "event_type" {
+			// Pinned with const; lives in BaseEvent.
+			continue
+		}
+		typ, err := goType(p.Schema)
+		if err != nil {
+			return obj, fmt.Errorf("%s: %w", p.Name, err)
+		}
+		obj.Fields = append(obj.Fields, field{
+			JSON:     p.Name,
+			Name:     exportedName(p.Name),
+			Type:     typ,
+			Doc:      p.Schema.Description,
+			Required: required[p.Name],
+		})
+	}
+	return obj, nil
+}
+
+func goType(s *schema) (string, error) {
+	if s.GoType != "" {
+		return s.GoType, nil
+	}
+	if s.Ref != "" {
+		return strings.TrimPrefix(s.Ref, "#/$defs/"), nil
+	}
+	switch s.Type {
+	case "string":
+		if s.Format == "date-time" {
+			return "time.Time", nil
+		}
+		return "string", nil
+	case "integer":
+		return "int64", nil
+	case "number":
+		return "float64", nil
+	case "boolean":
+		return "bool", nil
+	case "array":
+		if s.Items == nil {
+			return "", fmt.Errorf("array without items")
+		}
+		elem, err := goType(s.Items)
+		if err != nil {
+			return "", err
+		}
+		return "[]" + elem, nil
+	}
+	return "", fmt.Errorf("unsupported type %q; use a $ref to a definition", s.Type)
+}
+
+var initialisms = map[string]string{"id": "ID", "sku": "SKU", "url": "URL", "api": "API"}
+
+func exportedName(jsonName string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(jsonName, "_") {
+		if up, ok := initialisms[part]; ok {
+			b.WriteString(up)
+		} else if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+func paramName(jsonName string) string {
+	parts := strings.SplitN(jsonName, "_", 2)
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return parts[0] + exportedName(parts[1])
+}
+
+func usesTime(objects []object) bool {
+	for _, o := range objects {
+		for _, f := range o.Fields {
+			if strings.Contains(f.Type, "time.") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeDoc(b *bytes.Buffer, indent, doc string) {
+	for _, line := range strings.Split(strings.TrimSpace(doc), "\n") {
+		if line != "" {
+			fmt.Fprintf(b, "%s// %s\n", indent, line)
+		}
+	}
+}
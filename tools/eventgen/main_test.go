@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Every service's events_gen.go and embedded schema copy must match the
+// schema, like make check-events.
+func TestGeneratedUpToDate(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("..", "..", "schemas", "events", "v2", "events.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := generate(raw, "redstone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := filepath.Glob(filepath.Join("..", "..", "services", "*", "internal", "redstone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("no services found")
+	}
+	for _, dir := range dirs {
+		have, err := os.ReadFile(filepath.Join(dir, "events_gen.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, code) {
+			t.Errorf("%s/events_gen.go is stale; run make events", dir)
+		}
+		copied, err := os.ReadFile(filepath.Join(dir, "schema", "events.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(copied, raw) {
+			t.Errorf("%s/schema/events.json differs from the schema; run make events", dir)
+		}
+	}
+}
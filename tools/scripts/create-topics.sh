@@ -1,4 +1,6 @@
 #!/usr/bin/env sh
 set -e
 docker compose exec -T redpanda rpk topic create   redstone.orders redstone.inventory redstone.payments redstone.notifications   -p 3 || true
+docker compose exec -T redpanda rpk topic create   redstone.orders.inventory-service.retry.5s redstone.orders.inventory-service.retry.1m redstone.orders.inventory-service.retry.10m redstone.orders.inventory-service.dlq   -p 3 || true
+docker compose exec -T redpanda rpk topic create   redstone.inventory.order-service.dlq redstone.payments.order-service.dlq redstone.inventory.payment-service.dlq redstone.orders.notification-service-orders.dlq redstone.inventory.notification-service-inventory.dlq redstone.payments.notification-service-payments.dlq   -p 3 || true
 echo "Topics ready."